@@ -0,0 +1,376 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-github/v60/github"
+	"go.uber.org/zap"
+)
+
+// WithAPIEdit edits files through the Contents API instead of cloning each
+// repository: the files given with WithEditPath are passed through the
+// command, those of the sync manifest are reconciled, or the edits given
+// with WithFileEdit are made, and with WithPush the changes are committed to
+// the branch (see WithBranch) directly, one commit per file. It suits small
+// edits to many repositories, but the command cannot see the rest of the
+// repository.
+func WithAPIEdit(b bool) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.apiEdit = b
+		if b {
+			fre.captureDiff = true
+		}
+		return nil
+	}
+}
+
+// WithEditPath passes the file at p in each repository through the command
+// when editing through the API: the command reads the file on stdin, with
+// GHFOREACH_PATH and GHFOREACH_REPOSITORY set, and its stdout replaces it. A
+// missing file reads as empty and is created unless the command prints
+// nothing. It may be given more than once.
+func WithEditPath(p string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		p = strings.Trim(p, "/")
+		if p == "" {
+			return fmt.Errorf("edit path must not be empty")
+		}
+		fre.editPaths = append(fre.editPaths, p)
+		return nil
+	}
+}
+
+// apiFile is a file of a repository edited through the API.
+type apiFile struct {
+	path string
+	// sha is the blob SHA of the file on the default branch, or "" if it
+	// is missing.
+	sha      string
+	original string
+	updated  string
+}
+
+func (af *apiFile) exists() bool {
+	return af.sha != ""
+}
+
+func (af *apiFile) changed() bool {
+	return af.updated != af.original || (!af.exists() && af.updated != "")
+}
+
+// validateAPIEdit checks that the options in effect can be carried out
+// without a clone.
+func (rh *RepositoryExecutor) validateAPIEdit(command string) error {
+	if !rh.apiEdit {
+		if len(rh.editPaths) > 0 {
+			return fmt.Errorf("edit paths require editing through the API")
+		}
+		return nil
+	}
+	switch {
+	case rh.applyPatch != nil:
+		return fmt.Errorf("cannot apply a patch when editing through the API")
+	case rh.precondition != nil:
+		return fmt.Errorf("cannot check a precondition when editing through the API")
+	case len(rh.artifactGlobs) > 0:
+		return fmt.Errorf("cannot collect artifacts when editing through the API")
+	case (rh.syncManifest != nil || len(rh.fileEdits) > 0) && len(rh.editPaths) > 0:
+		return fmt.Errorf("cannot pass edit paths through a command while syncing or editing files")
+	case rh.syncManifest == nil && len(rh.fileEdits) == 0 && (len(rh.editPaths) == 0 || command == ""):
+		return fmt.Errorf("editing through the API requires a command and edit paths, a sync manifest or file edits")
+	}
+	return nil
+}
+
+// editRepository edits the files of repo through the API, recording the
+// outcome in result, and publishes the changes as configured.
+func (rh *RepositoryExecutor) editRepository(ctx context.Context, repo *github.Repository, result *executionResult) {
+	base, files, err := rh.getAPIFiles(ctx, repo)
+	if err != nil {
+		rh.logger.Error("error getting files", zap.String("repository", result.Repository), zap.Error(err))
+		result.Error = fmt.Errorf("getting files: %w", err)
+		result.Status = FailedStatus
+		return
+	}
+
+	stdoutBuf := &bytes.Buffer{}
+	stderrBuf := &bytes.Buffer{}
+	if rh.syncManifest != nil {
+		result.Attempts = 1
+		stdout, _, flush := rh.commandOutput(result.Repository, stdoutBuf, stderrBuf)
+		err = rh.syncAPIFiles(repo, files, stdout)
+		flush()
+		if err != nil {
+			rh.logger.Error("error syncing files", zap.String("repository", result.Repository), zap.Error(err))
+		}
+	} else if len(rh.fileEdits) > 0 {
+		result.Attempts = 1
+		stdout, _, flush := rh.commandOutput(result.Repository, stdoutBuf, stderrBuf)
+		err = rh.editAPIFiles(files, stdout)
+		flush()
+		if err != nil {
+			rh.logger.Error("error editing files", zap.String("repository", result.Repository), zap.Error(err))
+		}
+	} else {
+		result.Attempts, err = rh.commandRetry.do(ctx, rh.logger, "command in "+result.Repository, isRetryableCommandError, func() error {
+			stdoutBuf.Reset()
+			stderrBuf.Reset()
+			stdout, stderr, flush := rh.commandOutput(result.Repository, stdoutBuf, stderrBuf)
+			defer flush()
+			return rh.filterAPIFiles(result, files, stdout, stderr)
+		})
+		if err != nil {
+			rh.logger.Error("error executing command", zap.String("repository", result.Repository), zap.String("command", result.Command), zap.Error(err))
+		}
+	}
+	result.Stdout = stdoutBuf.String()
+	result.Stderr = stderrBuf.String()
+	result.Error = err
+	result.Status = SucceededStatus
+	if err != nil {
+		result.Status = FailedStatus
+		return
+	}
+
+	for _, file := range files {
+		if !file.changed() {
+			continue
+		}
+		var from *string
+		if file.exists() {
+			from = &file.original
+		}
+		diff, err := contentDiff(file.path, from, &file.updated)
+		if err != nil {
+			rh.logger.Error("error computing diff", zap.String("repository", result.Repository), zap.Error(err))
+			return
+		}
+		result.Diff += diff
+	}
+	rh.classifyDiff(result)
+	// without a clone to commit to, changes are only committed when pushed
+	if rh.push && result.Status == SucceededStatus {
+		rh.publishChanges(ctx, result, func() error {
+			return rh.publishAPIFiles(ctx, repo, base, files, result)
+		})
+	}
+}
+
+// getAPIFiles returns the SHA of the default branch of repo and the files to
+// edit as of it.
+func (rh *RepositoryExecutor) getAPIFiles(ctx context.Context, repo *github.Repository) (string, []*apiFile, error) {
+	owner, name := repoOwner(repo), repo.GetName()
+	base, err := rh.getBranchSHA(ctx, owner, name, repo.GetDefaultBranch())
+	if err != nil {
+		return "", nil, err
+	}
+	if base == "" {
+		return "", nil, fmt.Errorf("default branch %s not found", repo.GetDefaultBranch())
+	}
+	paths := rh.editPaths
+	switch {
+	case rh.syncManifest != nil:
+		paths = []string{}
+		for _, file := range rh.syncManifest.files {
+			paths = append(paths, file.Dest)
+		}
+	case len(rh.fileEdits) > 0:
+		paths = rh.fileEditPaths()
+	}
+
+	opts := &github.RepositoryContentGetOptions{Ref: base}
+	files := []*apiFile{}
+	for _, p := range paths {
+		var file *github.RepositoryContent
+		var dir []*github.RepositoryContent
+		var resp *github.Response
+		err := rh.callAPI(ctx, "get repository contents", func() (*github.Response, error) {
+			var err error
+			file, dir, resp, err = rh.client.Repositories.GetContents(ctx, owner, name, p, opts)
+			return resp, err
+		})
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			files = append(files, &apiFile{path: p})
+			continue
+		} else if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", p, err)
+		}
+		if file == nil || dir != nil {
+			return "", nil, fmt.Errorf("%s is a directory", p)
+		}
+		content, err := rh.fileContent(ctx, repo, file, opts)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s: %w", p, err)
+		}
+		files = append(files, &apiFile{path: p, sha: file.GetSHA(), original: content, updated: content})
+	}
+	return base, files, nil
+}
+
+// getBranchSHA returns the commit SHA branch of owner/name points to, or ""
+// if there is no such branch.
+func (rh *RepositoryExecutor) getBranchSHA(ctx context.Context, owner, name, branch string) (string, error) {
+	var ref *github.Reference
+	var resp *github.Response
+	err := rh.callAPI(ctx, "get reference", func() (*github.Response, error) {
+		var err error
+		ref, resp, err = rh.client.Git.GetRef(ctx, owner, name, "heads/"+branch)
+		return resp, err
+	})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return ref.GetObject().GetSHA(), nil
+}
+
+// filterAPIFiles passes each of files through the command, writing what was
+// updated or created to stdout.
+func (rh *RepositoryExecutor) filterAPIFiles(result *executionResult, files []*apiFile, stdout, stderr io.Writer) error {
+	for _, file := range files {
+		out := &bytes.Buffer{}
+		cmd := exec.Command(rh.shellPath, "-c", result.Command)
+		cmd.Stdin = strings.NewReader(file.original)
+		cmd.Stdout = out
+		cmd.Stderr = stderr
+		cmd.Env = append(os.Environ(),
+			"GHFOREACH_PATH="+file.path,
+			"GHFOREACH_REPOSITORY="+result.Repository,
+		)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %w", file.path, err)
+		}
+		file.updated = out.String()
+		switch {
+		case !file.changed():
+		case file.exists():
+			fmt.Fprintf(stdout, "%s: updated\n", file.path)
+		default:
+			fmt.Fprintf(stdout, "%s: created\n", file.path)
+		}
+	}
+	return nil
+}
+
+// syncAPIFiles reconciles files with the sync manifest, listing those that
+// differ or are missing to w.
+func (rh *RepositoryExecutor) syncAPIFiles(repo *github.Repository, files []*apiFile, w io.Writer) error {
+	for i, sf := range rh.syncManifest.files {
+		file := files[i]
+		updated, changed, err := sf.reconcile(repo, file.original, file.exists())
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		reportDrift(w, file.path, file.exists())
+		file.updated = updated
+	}
+	return nil
+}
+
+// publishAPIFiles commits each changed file to the branch of repo, created at
+// base, then opens a pull request if configured. A branch that already exists
+// at another commit is only reset to base when force-pushing.
+func (rh *RepositoryExecutor) publishAPIFiles(ctx context.Context, repo *github.Repository, base string, files []*apiFile, result *executionResult) error {
+	owner, name := repoOwner(repo), repo.GetName()
+	existing, err := rh.getBranchSHA(ctx, owner, name, rh.branch)
+	if err != nil {
+		return err
+	}
+	ref := &github.Reference{
+		Ref:    github.String("refs/heads/" + rh.branch),
+		Object: &github.GitObject{SHA: github.String(base)},
+	}
+	switch {
+	case existing == "":
+		err = rh.callAPI(ctx, "create reference", func() (*github.Response, error) {
+			_, resp, err := rh.client.Git.CreateRef(ctx, owner, name, ref)
+			return resp, err
+		})
+	case existing == base:
+	case rh.forcePush:
+		err = rh.callAPI(ctx, "update reference", func() (*github.Response, error) {
+			_, resp, err := rh.client.Git.UpdateRef(ctx, owner, name, ref, true)
+			return resp, err
+		})
+	default:
+		// the files were read from base, so committing them on top of other
+		// commits would discard those commits' changes
+		return branchExistsError(rh.branch)
+	}
+	if err != nil {
+		return fmt.Errorf("resetting %s: %w", rh.branch, err)
+	}
+
+	for _, file := range files {
+		if !file.changed() {
+			continue
+		}
+		opts := &github.RepositoryContentFileOptions{
+			Message: github.String(rh.commitMessage),
+			Content: []byte(file.updated),
+			Branch:  github.String(rh.branch),
+		}
+		if rh.commitAuthor != nil {
+			opts.Author = &github.CommitAuthor{
+				Name:  github.String(rh.commitAuthor.Name),
+				Email: github.String(rh.commitAuthor.Email),
+			}
+			opts.Committer = opts.Author
+		}
+		// a commit that failed may still have been made, so it is not
+		// retried
+		if file.exists() {
+			opts.SHA = github.String(file.sha)
+			err = rh.callAPIOnce(ctx, "update file", func() (*github.Response, error) {
+				_, resp, err := rh.client.Repositories.UpdateFile(ctx, owner, name, file.path, opts)
+				return resp, err
+			})
+		} else {
+			err = rh.callAPIOnce(ctx, "create file", func() (*github.Response, error) {
+				_, resp, err := rh.client.Repositories.CreateFile(ctx, owner, name, file.path, opts)
+				return resp, err
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("committing %s: %w", file.path, err)
+		}
+	}
+	if !rh.pullRequest {
+		return nil
+	}
+
+	url, err := rh.openPullRequest(ctx, repo)
+	if err != nil {
+		return fmt.Errorf("opening pull request: %w", err)
+	}
+	result.PullRequestURL = url
+	return nil
+}
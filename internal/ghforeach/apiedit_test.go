@@ -0,0 +1,65 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAPIEdit(t *testing.T) {
+	patch, err := ParsePatch("a.patch", []byte("--- a/x\n+++ b/x\n@@ -1 +1 @@\n-a\n+b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit, err := ParseFileEdit(SetEditOperation, "a.json:a=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		opts    []RepositoryExecutorOption
+		command string
+		err     string
+	}{
+		{"clone", nil, "make", ""},
+		{"edit paths without api", []RepositoryExecutorOption{WithEditPath("VERSION")}, "cat", "require editing through the API"},
+		{"edit paths", []RepositoryExecutorOption{WithAPIEdit(true), WithEditPath("VERSION")}, "cat", ""},
+		{"edit paths without command", []RepositoryExecutorOption{WithAPIEdit(true), WithEditPath("VERSION")}, "", "requires a command and edit paths"},
+		{"file edits", []RepositoryExecutorOption{WithAPIEdit(true), WithFileEdit(edit)}, "", ""},
+		{"file edits and edit paths", []RepositoryExecutorOption{WithAPIEdit(true), WithFileEdit(edit), WithEditPath("VERSION")}, "", "cannot pass edit paths"},
+		{"nothing to edit", []RepositoryExecutorOption{WithAPIEdit(true)}, "cat", "requires a command and edit paths"},
+		{"patch", []RepositoryExecutorOption{WithAPIEdit(true), WithEditPath("VERSION"), WithApplyPatch(patch)}, "cat", "cannot apply a patch"},
+		{"precondition", []RepositoryExecutorOption{WithAPIEdit(true), WithEditPath("VERSION"), WithPrecondition("true")}, "cat", "cannot check a precondition"},
+		{"artifacts", []RepositoryExecutorOption{WithAPIEdit(true), WithEditPath("VERSION"), WithArtifactGlob("*.out")}, "cat", "cannot collect artifacts"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			exec, err := NewRepositoryExecutor(test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = exec.validateAPIEdit(test.command)
+			if test.err == "" && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
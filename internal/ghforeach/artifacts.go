@@ -0,0 +1,238 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// resultsIndexFile lists every result in the results directory.
+	resultsIndexFile = "index.json"
+	// artifactsDir holds the artifacts copied from a clone within its
+	// results directory.
+	artifactsDir = "artifacts"
+)
+
+// WithResultsDir writes each repository's stdout, stderr, exit status and
+// artifacts to dir/<owner>/<repo>/, and an index of every result to
+// dir/index.json, so that results outlive the clones.
+func WithResultsDir(dir string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.resultsDir = dir
+		return nil
+	}
+}
+
+// WithArtifactGlob copies files matching pattern out of each clone into its
+// results directory once the command has run. Patterns containing a slash
+// match paths relative to the root of the repository (e.g. ./report.json);
+// others match file names at any depth. It may be given more than once.
+func WithArtifactGlob(pattern string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+		fre.artifactGlobs = append(fre.artifactGlobs, pattern)
+		return nil
+	}
+}
+
+// resultDir returns the results directory of repository.
+func (rh *RepositoryExecutor) resultDir(repository string) string {
+	return path.Join(rh.resultsDir, repository)
+}
+
+// resetResultDir removes any results of repository left by an earlier run.
+func (rh *RepositoryExecutor) resetResultDir(repository string) {
+	if rh.resultsDir == "" {
+		return
+	}
+	if err := os.RemoveAll(rh.resultDir(repository)); err != nil {
+		rh.logger.Error("error removing results", zap.String("repository", repository), zap.Error(err))
+	}
+}
+
+// matchArtifact reports whether the file at rel, relative to the root of a
+// clone, is an artifact.
+func (rh *RepositoryExecutor) matchArtifact(rel string) bool {
+	for _, pattern := range rh.artifactGlobs {
+		name := path.Base(rel)
+		if strings.Contains(pattern, "/") {
+			pattern = strings.TrimPrefix(strings.TrimPrefix(pattern, "./"), "/")
+			name = rel
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collectArtifacts copies the artifacts of the clone at result.Path into
+// its results directory, recording their paths in result.
+func (rh *RepositoryExecutor) collectArtifacts(result *executionResult) error {
+	if rh.resultsDir == "" || len(rh.artifactGlobs) == 0 {
+		return nil
+	}
+	dest := path.Join(rh.resultDir(result.Repository), artifactsDir)
+	return filepath.WalkDir(result.Path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(result.Path, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !rh.matchArtifact(rel) {
+			return nil
+		}
+		if err := copyFile(p, path.Join(dest, rel)); err != nil {
+			return err
+		}
+		result.Artifacts = append(result.Artifacts, path.Join(artifactsDir, rel))
+		return nil
+	})
+}
+
+func copyFile(src, dest string) error {
+	if err := os.MkdirAll(path.Dir(dest), 0700); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeResultFiles writes the stdout, stderr, exit status, diff and rejected
+// hunks of result to its results directory.
+func (rh *RepositoryExecutor) writeResultFiles(result *executionResult) error {
+	if rh.resultsDir == "" {
+		return nil
+	}
+	dir := rh.resultDir(result.Repository)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	files := map[string]string{
+		"stdout": result.Stdout,
+		"stderr": result.Stderr,
+	}
+	if result.Diff != "" {
+		files["diff.patch"] = result.Diff
+	}
+	if result.Rejects != "" {
+		files["rejects.patch"] = result.Rejects
+	}
+	if result.ExitCode != nil {
+		files["exit_status"] = strconv.Itoa(*result.ExitCode) + "\n"
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(path.Join(dir, name), []byte(contents), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resultsIndex is the index of the results directory.
+type resultsIndex struct {
+	Command  string              `json:"command"`
+	Finished time.Time           `json:"finished"`
+	Results  []resultsIndexEntry `json:"results"`
+}
+
+type resultsIndexEntry struct {
+	Repository string          `json:"repository"`
+	Status     ExecutionStatus `json:"status"`
+	ExitCode   *int            `json:"exit_code,omitempty"`
+	Error      *string         `json:"error"`
+	// Dir is the results directory of the repository, and Artifacts the
+	// artifacts within it, relative to the results directory.
+	Dir       string   `json:"dir"`
+	Artifacts []string `json:"artifacts"`
+}
+
+// writeResultsIndex writes the index of results to the results directory.
+func (rh *RepositoryExecutor) writeResultsIndex(command string, results []*executionResult) error {
+	if rh.resultsDir == "" {
+		return nil
+	}
+	index := resultsIndex{
+		Command:  command,
+		Finished: time.Now(),
+		Results:  []resultsIndexEntry{},
+	}
+	for _, result := range results {
+		entry := resultsIndexEntry{
+			Repository: result.Repository,
+			Status:     result.Status,
+			ExitCode:   result.ExitCode,
+			Dir:        result.Repository,
+			Artifacts:  []string{},
+		}
+		if result.Error != nil {
+			str := result.Error.Error()
+			entry.Error = &str
+		}
+		for _, artifact := range result.Artifacts {
+			entry.Artifacts = append(entry.Artifacts, path.Join(result.Repository, artifact))
+		}
+		index.Results = append(index.Results, entry)
+	}
+	sort.Slice(index.Results, func(i, j int) bool {
+		return index.Results[i].Repository < index.Results[j].Repository
+	})
+	bytes, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(rh.resultsDir, 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(rh.resultsDir, resultsIndexFile), append(bytes, '\n'), 0600)
+}
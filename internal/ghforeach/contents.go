@@ -0,0 +1,266 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+)
+
+// contentPredicate is a condition on a file in a repository's default
+// branch, checked through the Contents API before the repository is cloned.
+type contentPredicate struct {
+	path string
+	// exists is whether path must exist (true) or be missing (false).
+	exists bool
+	// re, if set, must match the contents of the file at path.
+	re *regexp.Regexp
+}
+
+func (cp *contentPredicate) String() string {
+	switch {
+	case cp.re != nil:
+		return fmt.Sprintf("%s =~ %s", cp.path, strconv.Quote(cp.re.String()))
+	case cp.exists:
+		return "exists " + cp.path
+	default:
+		return "missing " + cp.path
+	}
+}
+
+// WithPathExists only iterates repositories containing a file or directory
+// at p.
+func WithPathExists(p string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.contentPredicates = append(fre.contentPredicates, &contentPredicate{path: p, exists: true})
+		return nil
+	}
+}
+
+// WithPathMissing only iterates repositories with nothing at p.
+func WithPathMissing(p string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.contentPredicates = append(fre.contentPredicates, &contentPredicate{path: p, exists: false})
+		return nil
+	}
+}
+
+// WithPathContentRegexp only iterates repositories containing a file at p
+// whose contents match exp.
+func WithPathContentRegexp(p, exp string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		re, err := regexp.Compile(exp)
+		if err != nil {
+			return err
+		}
+		fre.contentPredicates = append(fre.contentPredicates, &contentPredicate{path: p, exists: true, re: re})
+		return nil
+	}
+}
+
+// WithCacheDir sets the directory in which results are cached across runs.
+// An empty dir disables caching.
+func WithCacheDir(dir string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.cacheDir = dir
+		return nil
+	}
+}
+
+// defaultCacheDir returns the per-user cache directory for ghforeach, or ""
+// if there is none.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return path.Join(dir, "ghforeach")
+}
+
+// matchContents reports whether repo satisfies every content predicate.
+func (rh *RepositoryExecutor) matchContents(ctx context.Context, repo *github.Repository) (bool, error) {
+	for _, cp := range rh.contentPredicates {
+		key := cp.String()
+		match, ok := rh.contentCache.get(repo, key)
+		if !ok {
+			var err error
+			match, err = rh.checkContentPredicate(ctx, repo, cp)
+			if err != nil {
+				return false, err
+			}
+			rh.contentCache.set(repo, key, match)
+		}
+		if !match {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (rh *RepositoryExecutor) checkContentPredicate(ctx context.Context, repo *github.Repository, cp *contentPredicate) (bool, error) {
+	owner, name := repoOwner(repo), repo.GetName()
+	var file *github.RepositoryContent
+	var resp *github.Response
+	err := rh.callAPI(ctx, "get repository contents", func() (*github.Response, error) {
+		var err error
+		file, _, resp, err = rh.client.Repositories.GetContents(ctx, owner, name, cp.path, nil)
+		return resp, err
+	})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return !cp.exists, nil
+	} else if err != nil {
+		return false, err
+	}
+	if cp.re == nil {
+		return cp.exists, nil
+	}
+	if file == nil {
+		// a directory has no contents to match
+		return false, nil
+	}
+	content, err := rh.fileContent(ctx, repo, file, nil)
+	if err != nil {
+		return false, err
+	}
+	return cp.re.MatchString(content), nil
+}
+
+// fileContent returns the contents of file, as got from repo with opts,
+// downloading them if the Contents API omitted them.
+func (rh *RepositoryExecutor) fileContent(ctx context.Context, repo *github.Repository, file *github.RepositoryContent, opts *github.RepositoryContentGetOptions) (string, error) {
+	content, err := file.GetContent()
+	if err != nil || content != "" || file.GetSize() == 0 {
+		return content, err
+	}
+	// the Contents API omits files over 1MB, so download them instead
+	err = rh.callAPI(ctx, "download repository contents", func() (*github.Response, error) {
+		rc, resp, err := rh.client.Repositories.DownloadContents(ctx, repoOwner(repo), repo.GetName(), file.GetPath(), opts)
+		if err != nil {
+			return resp, err
+		}
+		defer rc.Close()
+		bytes, err := io.ReadAll(rc)
+		content = string(bytes)
+		return resp, err
+	})
+	return content, err
+}
+
+// contentCache persists content predicate results across runs. Results for a
+// repository are discarded whenever it is pushed to.
+type contentCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]*contentCacheEntry
+	dirty   bool
+}
+
+type contentCacheEntry struct {
+	PushedAt time.Time       `json:"pushed_at"`
+	Results  map[string]bool `json:"results"`
+}
+
+// loadContentCache reads the cache in dir. A nil cache is returned if dir is
+// empty, which caches nothing.
+func loadContentCache(dir string) (*contentCache, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	cc := &contentCache{
+		path:    path.Join(dir, "contents.json"),
+		entries: map[string]*contentCacheEntry{},
+	}
+	bytes, err := os.ReadFile(cc.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, &cc.entries); err != nil {
+		return nil, fmt.Errorf("reading content cache %s: %w", cc.path, err)
+	}
+	return cc, nil
+}
+
+func (cc *contentCache) get(repo *github.Repository, key string) (bool, bool) {
+	if cc == nil {
+		return false, false
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	entry, ok := cc.entries[repo.GetFullName()]
+	if !ok || !entry.PushedAt.Equal(repo.GetPushedAt().Time) {
+		return false, false
+	}
+	match, ok := entry.Results[key]
+	return match, ok
+}
+
+func (cc *contentCache) set(repo *github.Repository, key string, match bool) {
+	if cc == nil {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	entry, ok := cc.entries[repo.GetFullName()]
+	if !ok || !entry.PushedAt.Equal(repo.GetPushedAt().Time) {
+		entry = &contentCacheEntry{
+			PushedAt: repo.GetPushedAt().Time,
+			Results:  map[string]bool{},
+		}
+		cc.entries[repo.GetFullName()] = entry
+	}
+	entry.Results[key] = match
+	cc.dirty = true
+}
+
+// save writes the cache back to disk if it changed.
+func (cc *contentCache) save() error {
+	if cc == nil {
+		return nil
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.dirty {
+		return nil
+	}
+	bytes, err := json.Marshal(cc.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(cc.path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(cc.path, bytes, 0600); err != nil {
+		return err
+	}
+	cc.dirty = false
+	return nil
+}
@@ -0,0 +1,264 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dashboardInterval is how often the dashboard is redrawn.
+	dashboardInterval = 100 * time.Millisecond
+	// dashboardActive and dashboardFailures bound the active repositories
+	// and the most recent failures shown.
+	dashboardActive   = 8
+	dashboardFailures = 5
+	dashboardBarWidth = 30
+)
+
+// dashboard draws the progress of a run at the bottom of a terminal from
+// status events. Output written to it is printed above the progress, so
+// results and logs can share the terminal with it.
+type dashboard struct {
+	w io.Writer
+	// width returns the terminal width, or zero if unknown.
+	width func() int
+	now   func() time.Time
+
+	mu sync.Mutex
+	// pending is output not yet printed above the progress.
+	pending []byte
+	// frameLines is the number of lines of the last progress drawn.
+	frameLines int
+	listed     bool
+	// active holds the stage, and when it was entered, of each repository
+	// without a result.
+	active    map[string]dashboardRepo
+	total     int
+	succeeded int
+	failed    int
+	skipped   int
+	failures  []string
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+type dashboardRepo struct {
+	stage RepositoryStage
+	since time.Time
+}
+
+func newDashboard(w io.Writer, width func() int) *dashboard {
+	return &dashboard{
+		w:       w,
+		width:   width,
+		now:     time.Now,
+		active:  map[string]dashboardRepo{},
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// start redraws the dashboard periodically until close is called.
+func (d *dashboard) start() {
+	go func() {
+		defer close(d.stopped)
+		ticker := time.NewTicker(dashboardInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				d.mu.Lock()
+				d.draw(false)
+				d.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Close stops redrawing and leaves the final progress, and all output, on
+// the terminal.
+func (d *dashboard) Close() error {
+	close(d.stop)
+	<-d.stopped
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.draw(true)
+	return nil
+}
+
+// Write queues p to be printed above the progress at the next redraw.
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending = append(d.pending, p...)
+	return len(p), nil
+}
+
+// Sync satisfies zapcore.WriteSyncer so that logs can be routed through the
+// dashboard.
+func (d *dashboard) Sync() error {
+	return nil
+}
+
+// handle updates the dashboard from event.
+func (d *dashboard) handle(event StatusEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if event.Stage == ListedStage {
+		d.listed = true
+		return
+	}
+	_, known := d.active[event.Repository]
+	if event.Stage != DoneStage {
+		if !known {
+			d.total++
+		}
+		d.active[event.Repository] = dashboardRepo{stage: event.Stage, since: event.Time}
+		return
+	}
+	if !known {
+		// resumed results are done without being queued
+		d.total++
+	}
+	delete(d.active, event.Repository)
+	switch event.Status {
+	case SucceededStatus, NoOpStatus:
+		d.succeeded++
+	case FailedStatus, DriftedStatus:
+		d.failed++
+		failure := event.Repository
+		if event.Error != nil {
+			failure += ": " + firstLine(event.Error.Error())
+		}
+		d.failures = append(d.failures, failure)
+	default:
+		d.skipped++
+	}
+}
+
+// draw erases the last progress, prints pending output and draws the
+// progress again. Unless final, an unterminated line of output is held back
+// until it is complete. It must be called with mu held.
+func (d *dashboard) draw(final bool) {
+	buf := &bytes.Buffer{}
+	if d.frameLines > 0 {
+		// move to the start of the first line of the frame and clear below
+		fmt.Fprintf(buf, "\x1b[%dF\x1b[J", d.frameLines)
+	}
+	n := bytes.LastIndexByte(d.pending, '\n') + 1
+	if final {
+		n = len(d.pending)
+	}
+	buf.Write(d.pending[:n])
+	if final && n > 0 && d.pending[n-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	d.pending = d.pending[n:]
+
+	lines := d.frame()
+	for _, line := range lines {
+		buf.WriteString(truncate(line, d.width()))
+		buf.WriteByte('\n')
+	}
+	d.frameLines = len(lines)
+	d.w.Write(buf.Bytes())
+}
+
+// frame renders the progress as lines. It must be called with mu held.
+func (d *dashboard) frame() []string {
+	done := d.succeeded + d.failed + d.skipped
+	filled := 0
+	if d.total > 0 {
+		filled = dashboardBarWidth * done / d.total
+	}
+	bar := fmt.Sprintf("[%s%s] %d/%d", strings.Repeat("#", filled), strings.Repeat("-", dashboardBarWidth-filled), done, d.total)
+	if !d.listed {
+		bar += " (listing repositories)"
+	}
+
+	stages := map[RepositoryStage]int{}
+	active := make([]string, 0, len(d.active))
+	for repository, repo := range d.active {
+		stages[repo.stage]++
+		active = append(active, repository)
+	}
+	lines := []string{
+		bar,
+		fmt.Sprintf("queued %d  cloning %d  running %d  succeeded %d  failed %d  skipped %d",
+			stages[QueuedStage], stages[CloningStage], stages[RunningStage], d.succeeded, d.failed, d.skipped),
+	}
+
+	// longest running first
+	sort.Slice(active, func(i, j int) bool {
+		a, b := d.active[active[i]], d.active[active[j]]
+		if !a.since.Equal(b.since) {
+			return a.since.Before(b.since)
+		}
+		return active[i] < active[j]
+	})
+	width := 0
+	for _, repository := range active {
+		width = max(width, len(repository))
+	}
+	for i, repository := range active {
+		if i == dashboardActive {
+			lines = append(lines, fmt.Sprintf("  ... and %d more", len(active)-i))
+			break
+		}
+		repo := d.active[repository]
+		elapsed := d.now().Sub(repo.since).Round(time.Second)
+		lines = append(lines, fmt.Sprintf("  %-*s  %-7s  %s", width, repository, repo.stage, elapsed))
+	}
+
+	if len(d.failures) > 0 {
+		lines = append(lines, "failures:")
+		for _, failure := range d.failures[max(len(d.failures)-dashboardFailures, 0):] {
+			lines = append(lines, "  "+failure)
+		}
+	}
+	return lines
+}
+
+// firstLine returns s up to its first newline.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// truncate shortens s to width runes so that it does not wrap. A width of
+// zero leaves s as is.
+func truncate(s string, width int) string {
+	if width <= 0 {
+		return s
+	}
+	runes := []rune(s)
+	if len(runes) < width {
+		return s
+	}
+	return string(runes[:width-1])
+}
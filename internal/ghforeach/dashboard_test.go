@@ -0,0 +1,75 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboard(t *testing.T) {
+	out := &bytes.Buffer{}
+	d := newDashboard(out, func() int { return 0 })
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return start.Add(90 * time.Second) }
+
+	for _, event := range []StatusEvent{
+		{Repository: "org/a", Stage: QueuedStage, Time: start},
+		{Repository: "org/b", Stage: QueuedStage, Time: start},
+		{Repository: "org/long", Stage: QueuedStage, Time: start},
+		{Repository: "org/d", Stage: QueuedStage, Time: start},
+		{Repository: "org/a", Stage: CloningStage, Time: start.Add(time.Second)},
+		{Repository: "org/b", Stage: RunningStage, Time: start},
+		{Repository: "org/d", Stage: DoneStage, Status: FailedStatus, Error: errors.New("exit status 1\nmore detail")},
+		{Repository: "org/e", Stage: DoneStage, Status: SucceededStatus, Resumed: true},
+	} {
+		d.handle(event)
+	}
+
+	expected := []string{
+		"[############------------------] 2/5 (listing repositories)",
+		"queued 1  cloning 1  running 1  succeeded 1  failed 1  skipped 0",
+		"  org/b     running  1m30s",
+		"  org/long  queued   1m30s",
+		"  org/a     cloning  1m29s",
+		"failures:",
+		"  org/d: exit status 1",
+	}
+	if lines := d.frame(); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("expected frame\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+
+	// output is printed above the frame, which is redrawn in place
+	d.draw(false)
+	d.Write([]byte("result\npartial"))
+	out.Reset()
+	d.draw(false)
+	if !strings.HasPrefix(out.String(), "\x1b[7F\x1b[Jresult\n[") {
+		t.Errorf("expected frame to be erased and output printed above it, got %q", out.String())
+	}
+	d.handle(StatusEvent{Stage: ListedStage})
+	out.Reset()
+	d.draw(true)
+	if !strings.Contains(out.String(), "partial\n[") || strings.Contains(out.String(), "listing") {
+		t.Errorf("expected final draw to flush output and finish listing, got %q", out.String())
+	}
+}
@@ -0,0 +1,328 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	fdiff "github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/binary"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// WithDiff captures the changes each command makes to its clone as a
+// unified diff in its result. Repositories where a successful command
+// changed nothing are reported as no-ops.
+func WithDiff(b bool) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.captureDiff = b
+		return nil
+	}
+}
+
+// WithPatchFile writes the diffs of every repository to a single patch file
+// at p once the run is done. It implies WithDiff.
+func WithPatchFile(p string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.captureDiff = true
+		fre.patchFile = p
+		return nil
+	}
+}
+
+// worktreeDiff returns the unified diff between HEAD and the working tree of
+// the clone at dir, including untracked files, or "" if nothing changed.
+func worktreeDiff(dir string) (string, error) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		return "", err
+	}
+	paths, err := changedPaths(repo)
+	if err != nil {
+		return "", err
+	}
+	var tree *object.Tree
+	head, err := repo.Head()
+	if err == nil {
+		commit, err := repo.CommitObject(head.Hash())
+		if err != nil {
+			return "", err
+		}
+		if tree, err = commit.Tree(); err != nil {
+			return "", err
+		}
+	} else if !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return "", err
+	}
+
+	patch := &worktreePatch{}
+	for _, p := range paths {
+		filePatch, err := diffFile(dir, tree, p)
+		if err != nil {
+			return "", fmt.Errorf("diffing %s: %w", p, err)
+		}
+		if filePatch != nil {
+			patch.filePatches = append(patch.filePatches, filePatch)
+		}
+	}
+	return patch.encode()
+}
+
+// contentDiff returns the unified diff of the file at p from from to to,
+// either of which is nil if the file does not exist, or "" if they are equal.
+func contentDiff(p string, from, to *string) (string, error) {
+	filePatch := &worktreeFilePatch{}
+	for _, side := range []struct {
+		content *string
+		file    **worktreeFile
+	}{{from, &filePatch.from}, {to, &filePatch.to}} {
+		if side.content == nil {
+			continue
+		}
+		*side.file = &worktreeFile{
+			path: p,
+			hash: plumbing.ComputeHash(plumbing.BlobObject, []byte(*side.content)),
+			mode: filemode.Regular,
+		}
+		isBinary, err := binary.IsBinary(strings.NewReader(*side.content))
+		if err != nil {
+			return "", err
+		}
+		filePatch.binary = filePatch.binary || isBinary
+	}
+	if (from == nil && to == nil) || (from != nil && to != nil && *from == *to) {
+		return "", nil
+	}
+	if !filePatch.binary {
+		var fromContent, toContent string
+		if from != nil {
+			fromContent = *from
+		}
+		if to != nil {
+			toContent = *to
+		}
+		filePatch.chunks = diffChunks(fromContent, toContent)
+	}
+	patch := &worktreePatch{filePatches: []fdiff.FilePatch{filePatch}}
+	return patch.encode()
+}
+
+// changedPaths returns the paths changed in the working tree of repo,
+// sorted.
+func changedPaths(repo *git.Repository) ([]string, error) {
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(status))
+	for p, fileStatus := range status {
+		if fileStatus.Worktree != git.Unmodified || fileStatus.Staging != git.Unmodified {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// diffFile returns the patch of the file at p between tree and the working
+// tree at dir, or nil if it is unchanged.
+func diffFile(dir string, tree *object.Tree, p string) (*worktreeFilePatch, error) {
+	filePatch := &worktreeFilePatch{}
+	var fromContent, toContent string
+
+	if tree != nil {
+		file, err := tree.File(p)
+		if err != nil && !errors.Is(err, object.ErrFileNotFound) {
+			return nil, err
+		}
+		if file != nil {
+			filePatch.from = &worktreeFile{path: p, hash: file.Hash, mode: file.Mode}
+			isBinary, err := file.IsBinary()
+			if err != nil {
+				return nil, err
+			}
+			filePatch.binary = isBinary
+			if !isBinary {
+				if fromContent, err = file.Contents(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	full := path.Join(dir, filepath.ToSlash(p))
+	info, err := os.Lstat(full)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if info != nil && !info.IsDir() {
+		var content []byte
+		mode := filemode.Regular
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(full)
+			if err != nil {
+				return nil, err
+			}
+			content, mode = []byte(target), filemode.Symlink
+		default:
+			if content, err = os.ReadFile(full); err != nil {
+				return nil, err
+			}
+			if info.Mode()&0111 != 0 {
+				mode = filemode.Executable
+			}
+		}
+		filePatch.to = &worktreeFile{
+			path: p,
+			hash: plumbing.ComputeHash(plumbing.BlobObject, content),
+			mode: mode,
+		}
+		isBinary, err := binary.IsBinary(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		filePatch.binary = filePatch.binary || isBinary
+		toContent = string(content)
+	}
+
+	switch {
+	case filePatch.from == nil && filePatch.to == nil:
+		return nil, nil
+	case filePatch.from != nil && filePatch.to != nil &&
+		filePatch.from.hash == filePatch.to.hash && filePatch.from.mode == filePatch.to.mode:
+		return nil, nil
+	}
+	if filePatch.binary {
+		return filePatch, nil
+	}
+	filePatch.chunks = diffChunks(fromContent, toContent)
+	return filePatch, nil
+}
+
+// diffChunks returns the line diff from from to to.
+func diffChunks(from, to string) []fdiff.Chunk {
+	chunks := []fdiff.Chunk{}
+	for _, d := range diff.Do(from, to) {
+		op := fdiff.Equal
+		switch d.Type {
+		case diffmatchpatch.DiffDelete:
+			op = fdiff.Delete
+		case diffmatchpatch.DiffInsert:
+			op = fdiff.Add
+		}
+		chunks = append(chunks, &worktreeChunk{content: d.Text, op: op})
+	}
+	return chunks
+}
+
+// worktreePatch implements the go-git diff.Patch interface for changes in a
+// working tree, which go-git can only diff between trees.
+type worktreePatch struct {
+	filePatches []fdiff.FilePatch
+}
+
+func (wp *worktreePatch) FilePatches() []fdiff.FilePatch { return wp.filePatches }
+func (wp *worktreePatch) Message() string                { return "" }
+
+// encode returns the patch as a unified diff, or "" if it is empty.
+func (wp *worktreePatch) encode() (string, error) {
+	if len(wp.filePatches) == 0 {
+		return "", nil
+	}
+	buf := &bytes.Buffer{}
+	if err := fdiff.NewUnifiedEncoder(buf, fdiff.DefaultContextLines).Encode(wp); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+type worktreeFilePatch struct {
+	from, to *worktreeFile
+	binary   bool
+	chunks   []fdiff.Chunk
+}
+
+func (fp *worktreeFilePatch) IsBinary() bool        { return fp.binary }
+func (fp *worktreeFilePatch) Chunks() []fdiff.Chunk { return fp.chunks }
+
+func (fp *worktreeFilePatch) Files() (fdiff.File, fdiff.File) {
+	// typed nils must not reach the encoder
+	var from, to fdiff.File
+	if fp.from != nil {
+		from = fp.from
+	}
+	if fp.to != nil {
+		to = fp.to
+	}
+	return from, to
+}
+
+type worktreeFile struct {
+	path string
+	hash plumbing.Hash
+	mode filemode.FileMode
+}
+
+func (wf *worktreeFile) Hash() plumbing.Hash     { return wf.hash }
+func (wf *worktreeFile) Mode() filemode.FileMode { return wf.mode }
+func (wf *worktreeFile) Path() string            { return wf.path }
+
+type worktreeChunk struct {
+	content string
+	op      fdiff.Operation
+}
+
+func (wc *worktreeChunk) Content() string       { return wc.content }
+func (wc *worktreeChunk) Type() fdiff.Operation { return wc.op }
+
+// writePatchFile writes the diffs of results to the patch file, each
+// preceded by a line naming its repository, which git apply ignores.
+func (rh *RepositoryExecutor) writePatchFile(results []*executionResult) error {
+	if rh.patchFile == "" {
+		return nil
+	}
+	sorted := append([]*executionResult{}, results...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Repository < sorted[j].Repository
+	})
+	b := &strings.Builder{}
+	for _, result := range sorted {
+		if result.Diff == "" {
+			continue
+		}
+		fmt.Fprintf(b, "ghforeach: %s\n%s", result.Repository, result.Diff)
+	}
+	return os.WriteFile(rh.patchFile, []byte(b.String()), 0644)
+}
@@ -0,0 +1,905 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+// This file implements the --where filter expression language. Expressions
+// are parsed and type checked up front into a tree of expr nodes which are
+// then evaluated against each listed repository, e.g.
+//
+//	(topic:go or topic:rust) and not archived and name !~ ^legacy-
+//
+// The filter options in filter.go are lowered into the same nodes, so every
+// filter is ultimately evaluated by this one mechanism.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/go-github/v60/github"
+)
+
+type exprType int
+
+const (
+	boolType exprType = iota
+	stringType
+	intType
+	timeType
+	stringListType
+	intListType
+)
+
+func (t exprType) String() string {
+	switch t {
+	case boolType:
+		return "bool"
+	case stringType:
+		return "string"
+	case intType:
+		return "int"
+	case timeType:
+		return "time"
+	case stringListType:
+		return "list of string"
+	case intListType:
+		return "list of int"
+	default:
+		return "unknown"
+	}
+}
+
+func (t exprType) isList() bool {
+	return t == stringListType || t == intListType
+}
+
+// elem returns the element type of a list type.
+func (t exprType) elem() exprType {
+	if t == intListType {
+		return intType
+	}
+	return stringType
+}
+
+// expr is a type checked node of a filter expression.
+type expr interface {
+	typ() exprType
+	eval(repo *github.Repository) any
+	String() string
+}
+
+type exprField struct {
+	typ exprType
+	get func(repo *github.Repository) any
+}
+
+// exprFields are the repository fields available to filter expressions,
+// named after their GitHub API counterparts.
+var exprFields = map[string]exprField{
+	"name":              {stringType, func(r *github.Repository) any { return r.GetName() }},
+	"full_name":         {stringType, func(r *github.Repository) any { return r.GetFullName() }},
+	"owner":             {stringType, func(r *github.Repository) any { return repoOwner(r) }},
+	"description":       {stringType, func(r *github.Repository) any { return r.GetDescription() }},
+	"language":          {stringType, func(r *github.Repository) any { return r.GetLanguage() }},
+	"visibility":        {stringType, func(r *github.Repository) any { return repoVisibility(r) }},
+	"default_branch":    {stringType, func(r *github.Repository) any { return r.GetDefaultBranch() }},
+	"archived":          {boolType, func(r *github.Repository) any { return r.GetArchived() }},
+	"fork":              {boolType, func(r *github.Repository) any { return r.GetFork() }},
+	"is_template":       {boolType, func(r *github.Repository) any { return r.GetIsTemplate() }},
+	"private":           {boolType, func(r *github.Repository) any { return r.GetPrivate() }},
+	"size":              {intType, func(r *github.Repository) any { return r.GetSize() }},
+	"stargazers_count":  {intType, func(r *github.Repository) any { return r.GetStargazersCount() }},
+	"forks_count":       {intType, func(r *github.Repository) any { return r.GetForksCount() }},
+	"open_issues_count": {intType, func(r *github.Repository) any { return r.GetOpenIssuesCount() }},
+	"pushed_at":         {timeType, func(r *github.Repository) any { return r.GetPushedAt().Time }},
+	"created_at":        {timeType, func(r *github.Repository) any { return r.GetCreatedAt().Time }},
+	"updated_at":        {timeType, func(r *github.Repository) any { return r.GetUpdatedAt().Time }},
+	"topics":            {stringListType, func(r *github.Repository) any { return r.Topics }},
+}
+
+type fieldExpr struct {
+	name  string
+	field exprField
+}
+
+func newFieldExpr(name string) (expr, error) {
+	field, ok := exprFields[name]
+	if !ok {
+		names := make([]string, 0, len(exprFields))
+		for name := range exprFields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown field %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return &fieldExpr{name, field}, nil
+}
+
+// mustField returns the node for a field known to exist.
+func mustField(name string) expr {
+	return mustExpr(newFieldExpr(name))
+}
+
+// mustExpr panics if err is non-nil. It is used when lowering filter options,
+// where a type error is a programming error.
+func mustExpr(e expr, err error) expr {
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func (e *fieldExpr) typ() exprType                    { return e.field.typ }
+func (e *fieldExpr) eval(repo *github.Repository) any { return e.field.get(repo) }
+func (e *fieldExpr) String() string                   { return e.name }
+
+type literalExpr struct {
+	t     exprType
+	value any
+}
+
+func newStringLiteral(s string) expr  { return &literalExpr{stringType, s} }
+func newIntLiteral(i int) expr        { return &literalExpr{intType, i} }
+func newBoolLiteral(b bool) expr      { return &literalExpr{boolType, b} }
+func newTimeLiteral(t time.Time) expr { return &literalExpr{timeType, t} }
+func newStringListLiteral(items []string) expr {
+	return &literalExpr{stringListType, items}
+}
+
+func (e *literalExpr) typ() exprType                    { return e.t }
+func (e *literalExpr) eval(repo *github.Repository) any { return e.value }
+
+func (e *literalExpr) String() string {
+	switch v := e.value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case time.Time:
+		return strconv.Quote(v.Format(time.RFC3339))
+	case []string:
+		quoted := make([]string, len(v))
+		for i, s := range v {
+			quoted[i] = strconv.Quote(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	case []int:
+		strs := make([]string, len(v))
+		for i, n := range v {
+			strs[i] = strconv.Itoa(n)
+		}
+		return "[" + strings.Join(strs, ", ") + "]"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type notExpr struct {
+	x expr
+}
+
+func newNotExpr(x expr) (expr, error) {
+	if x.typ() != boolType {
+		return nil, fmt.Errorf("operand of not must be bool, got %s in %s", x.typ(), x)
+	}
+	return &notExpr{x}, nil
+}
+
+func (e *notExpr) typ() exprType                    { return boolType }
+func (e *notExpr) eval(repo *github.Repository) any { return !e.x.eval(repo).(bool) }
+func (e *notExpr) String() string                   { return "not " + e.x.String() }
+
+type logicExpr struct {
+	and  bool
+	x, y expr
+}
+
+func newLogicExpr(and bool, x, y expr) (expr, error) {
+	e := &logicExpr{and, x, y}
+	if x.typ() != boolType || y.typ() != boolType {
+		return nil, fmt.Errorf("operands of %s must be bool, got %s and %s", e.op(), x.typ(), y.typ())
+	}
+	return e, nil
+}
+
+func (e *logicExpr) op() string {
+	if e.and {
+		return "and"
+	}
+	return "or"
+}
+
+func (e *logicExpr) typ() exprType { return boolType }
+
+func (e *logicExpr) eval(repo *github.Repository) any {
+	if e.and {
+		return e.x.eval(repo).(bool) && e.y.eval(repo).(bool)
+	}
+	return e.x.eval(repo).(bool) || e.y.eval(repo).(bool)
+}
+
+func (e *logicExpr) String() string {
+	return fmt.Sprintf("(%s %s %s)", e.x, e.op(), e.y)
+}
+
+// andAll joins exprs with "and". It returns nil for no exprs.
+func andAll(exprs []expr) expr {
+	var joined expr
+	for _, e := range exprs {
+		if joined == nil {
+			joined = e
+			continue
+		}
+		joined = &logicExpr{true, joined, e}
+	}
+	return joined
+}
+
+type compareExpr struct {
+	op   string
+	x, y expr
+}
+
+// newCompareExpr builds a comparison. A string literal compared with a time
+// is parsed as a time relative to now, as with ParsePushedSince.
+func newCompareExpr(op string, x, y expr, now time.Time) (expr, error) {
+	var err error
+	if x.typ() == timeType && y.typ() == stringType {
+		y, err = timeFromLiteral(y, now)
+	} else if x.typ() == stringType && y.typ() == timeType {
+		x, err = timeFromLiteral(x, now)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if x.typ() != y.typ() {
+		return nil, fmt.Errorf("mismatched types %s and %s in %s %s %s", x.typ(), y.typ(), x, op, y)
+	}
+	switch op {
+	case "==", "!=":
+		if x.typ().isList() {
+			return nil, fmt.Errorf("cannot compare %s with %s", x.typ(), op)
+		}
+	case "<", "<=", ">", ">=":
+		if x.typ() != intType && x.typ() != timeType && x.typ() != stringType {
+			return nil, fmt.Errorf("cannot order %s with %s", x.typ(), op)
+		}
+	default:
+		return nil, fmt.Errorf("unknown comparison operator %q", op)
+	}
+	return &compareExpr{op, x, y}, nil
+}
+
+func timeFromLiteral(e expr, now time.Time) (expr, error) {
+	lit, ok := e.(*literalExpr)
+	if !ok {
+		return nil, fmt.Errorf("cannot compare %s with a time", e)
+	}
+	t, err := ParsePushedSince(lit.value.(string), now)
+	if err != nil {
+		return nil, err
+	}
+	return newTimeLiteral(t), nil
+}
+
+func (e *compareExpr) typ() exprType { return boolType }
+
+func (e *compareExpr) eval(repo *github.Repository) any {
+	x, y := e.x.eval(repo), e.y.eval(repo)
+	var c int
+	switch x := x.(type) {
+	case bool:
+		if x != y.(bool) {
+			c = 1
+		}
+	case string:
+		c = strings.Compare(x, y.(string))
+	case int:
+		c = x - y.(int)
+	case time.Time:
+		c = x.Compare(y.(time.Time))
+	}
+	switch e.op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+func (e *compareExpr) String() string {
+	return fmt.Sprintf("%s %s %s", e.x, e.op, e.y)
+}
+
+type matchExpr struct {
+	negate bool
+	x      expr
+	re     *regexp.Regexp
+}
+
+// newMatchExpr builds a regular expression match. Matching a list passes if
+// any element matches.
+func newMatchExpr(negate bool, x expr, re *regexp.Regexp) (expr, error) {
+	if x.typ() != stringType && x.typ() != stringListType {
+		return nil, fmt.Errorf("cannot match %s of type %s against a regular expression", x, x.typ())
+	}
+	return &matchExpr{negate, x, re}, nil
+}
+
+func (e *matchExpr) typ() exprType { return boolType }
+
+func (e *matchExpr) eval(repo *github.Repository) any {
+	matched := false
+	switch x := e.x.eval(repo).(type) {
+	case string:
+		matched = e.re.MatchString(x)
+	case []string:
+		for _, s := range x {
+			if e.re.MatchString(s) {
+				matched = true
+				break
+			}
+		}
+	}
+	return matched != e.negate
+}
+
+func (e *matchExpr) String() string {
+	op := "=~"
+	if e.negate {
+		op = "!~"
+	}
+	return fmt.Sprintf("%s %s %s", e.x, op, strconv.Quote(e.re.String()))
+}
+
+type inExpr struct {
+	x, list expr
+}
+
+// newInExpr builds a membership test. If x is itself a list, the test passes
+// if any element of x is in list.
+func newInExpr(x, list expr) (expr, error) {
+	if !list.typ().isList() {
+		return nil, fmt.Errorf("right operand of in must be a list, got %s in %s", list.typ(), list)
+	}
+	if x.typ() != list.typ().elem() && x.typ() != list.typ() {
+		return nil, fmt.Errorf("mismatched types %s and %s in %s in %s", x.typ(), list.typ(), x, list)
+	}
+	return &inExpr{x, list}, nil
+}
+
+func (e *inExpr) typ() exprType { return boolType }
+
+func (e *inExpr) eval(repo *github.Repository) any {
+	x, list := e.x.eval(repo), e.list.eval(repo)
+	switch list := list.(type) {
+	case []string:
+		if xs, ok := x.([]string); ok {
+			for _, s := range xs {
+				if containsString(list, s) {
+					return true
+				}
+			}
+			return false
+		}
+		return containsString(list, x.(string))
+	case []int:
+		if xs, ok := x.([]int); ok {
+			for _, n := range xs {
+				if containsInt(list, n) {
+					return true
+				}
+			}
+			return false
+		}
+		return containsInt(list, x.(int))
+	}
+	return false
+}
+
+func (e *inExpr) String() string {
+	return fmt.Sprintf("%s in %s", e.x, e.list)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
+
+type countExpr struct {
+	args []expr
+}
+
+// newCountExpr builds count(args...), the number of bool args that hold.
+func newCountExpr(args []expr) (expr, error) {
+	for _, arg := range args {
+		if arg.typ() != boolType {
+			return nil, fmt.Errorf("arguments of count must be bool, got %s in %s", arg.typ(), arg)
+		}
+	}
+	return &countExpr{args}, nil
+}
+
+func (e *countExpr) typ() exprType { return intType }
+
+func (e *countExpr) eval(repo *github.Repository) any {
+	n := 0
+	for _, arg := range e.args {
+		if arg.eval(repo).(bool) {
+			n++
+		}
+	}
+	return n
+}
+
+func (e *countExpr) String() string {
+	args := make([]string, len(e.args))
+	for i, arg := range e.args {
+		args[i] = arg.String()
+	}
+	return "count(" + strings.Join(args, ", ") + ")"
+}
+
+// anyAll joins needles with "or" when all is false and with "and" when it is
+// true. If min is positive, at least min needles must hold instead.
+func anyAll(needles []expr, all bool, min int) expr {
+	if min > 0 {
+		return mustExpr(newCompareExpr(">=", mustExpr(newCountExpr(needles)), newIntLiteral(min), time.Time{}))
+	}
+	joined := needles[0]
+	for _, needle := range needles[1:] {
+		joined = &logicExpr{all, joined, needle}
+	}
+	return joined
+}
+
+type tokenKind int
+
+const (
+	eofToken tokenKind = iota
+	identToken
+	stringToken
+	intToken
+	topicToken
+	punctToken
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	// value is the unquoted value of string and topic tokens.
+	value string
+	pos   int
+}
+
+// is reports whether t is the punctuation or case-insensitive keyword s.
+func (t token) is(s string) bool {
+	switch t.kind {
+	case punctToken:
+		return t.text == s
+	case identToken:
+		return strings.EqualFold(t.text, s)
+	default:
+		return false
+	}
+}
+
+type exprParser struct {
+	src string
+	pos int
+	now time.Time
+}
+
+// parseExpr parses and type checks a filter expression. now anchors relative
+// times such as `pushed_at > "720h"`.
+func parseExpr(src string, now time.Time) (expr, error) {
+	p := &exprParser{src: src, now: now}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("parsing filter expression %q: %w", src, err)
+	}
+	if tok, err := p.next(); err != nil {
+		return nil, fmt.Errorf("parsing filter expression %q: %w", src, err)
+	} else if tok.kind != eofToken {
+		return nil, fmt.Errorf("parsing filter expression %q: unexpected %q at offset %d", src, tok.text, tok.pos)
+	}
+	if e.typ() != boolType {
+		return nil, fmt.Errorf("filter expression %q must be bool, got %s", src, e.typ())
+	}
+	return e, nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *exprParser) peek() (token, error) {
+	pos := p.pos
+	tok, err := p.next()
+	p.pos = pos
+	return tok, err
+}
+
+func (p *exprParser) next() (token, error) {
+	p.skipSpace()
+	start := p.pos
+	if p.pos >= len(p.src) {
+		return token{kind: eofToken, pos: start}, nil
+	}
+	c := p.src[p.pos]
+	switch {
+	case c == '"' || c == '\'':
+		value, err := p.scanString()
+		if err != nil {
+			return token{}, err
+		}
+		return token{stringToken, p.src[start:p.pos], value, start}, nil
+	case isDigit(c) || (c == '-' && p.pos+1 < len(p.src) && isDigit(p.src[p.pos+1])):
+		p.pos++
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.pos++
+		}
+		return token{intToken, p.src[start:p.pos], "", start}, nil
+	case isIdentStart(c):
+		for p.pos < len(p.src) && isIdentPart(p.src[p.pos]) {
+			p.pos++
+		}
+		text := p.src[start:p.pos]
+		if strings.EqualFold(text, "topic") && p.pos < len(p.src) && p.src[p.pos] == ':' {
+			p.pos++
+			value, err := p.scanWord()
+			if err != nil {
+				return token{}, err
+			}
+			return token{topicToken, p.src[start:p.pos], value, start}, nil
+		}
+		return token{identToken, text, "", start}, nil
+	}
+	for _, punct := range []string{"==", "!=", "<=", ">=", "=~", "!~", "&&", "||", "=", "<", ">", "!", "(", ")", "[", "]", ","} {
+		if strings.HasPrefix(p.src[p.pos:], punct) {
+			p.pos += len(punct)
+			return token{punctToken, punct, "", start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected character %q at offset %d", c, start)
+}
+
+// scanString scans a quoted string. Double quoted strings support Go escape
+// sequences; single quoted strings are raw, which suits regular expressions.
+func (p *exprParser) scanString() (string, error) {
+	start := p.pos
+	quote := p.src[p.pos]
+	p.pos++
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '\\' && quote == '"' {
+			p.pos += 2
+			continue
+		}
+		p.pos++
+		if c == quote {
+			if quote == '\'' {
+				return p.src[start+1 : p.pos-1], nil
+			}
+			return strconv.Unquote(p.src[start:p.pos])
+		}
+	}
+	return "", fmt.Errorf("unterminated string at offset %d", start)
+}
+
+// scanWord scans either a quoted string or a bare word running up to the next
+// space or closing bracket, as used for topic names and regular expressions.
+func (p *exprParser) scanWord() (string, error) {
+	p.skipSpace()
+	if p.pos < len(p.src) && (p.src[p.pos] == '"' || p.src[p.pos] == '\'') {
+		return p.scanString()
+	}
+	start := p.pos
+	for p.pos < len(p.src) && !unicode.IsSpace(rune(p.src[p.pos])) && p.src[p.pos] != ')' && p.src[p.pos] != ']' && p.src[p.pos] != ',' {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", fmt.Errorf("expected word at offset %d", start)
+	}
+	return p.src[start:p.pos], nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
+
+func (p *exprParser) parseOr() (expr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if !tok.is("or") && !tok.is("||") {
+			return x, nil
+		}
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if x, err = newLogicExpr(false, x, y); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	x, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if !tok.is("and") && !tok.is("&&") {
+			return x, nil
+		}
+		p.next()
+		y, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		if x, err = newLogicExpr(true, x, y); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *exprParser) parseNot() (expr, error) {
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	if tok.is("not") || tok.is("!") {
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return newNotExpr(x)
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (expr, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	tok, err := p.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case tok.is("==") || tok.is("=") || tok.is("!=") || tok.is("<") || tok.is("<=") || tok.is(">") || tok.is(">="):
+		p.next()
+		y, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		op := tok.text
+		if op == "=" {
+			op = "=="
+		}
+		return newCompareExpr(op, x, y, p.now)
+	case tok.is("=~") || tok.is("!~"):
+		p.next()
+		pattern, err := p.scanWord()
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return newMatchExpr(tok.is("!~"), x, re)
+	case tok.is("in"):
+		p.next()
+		list, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return newInExpr(x, list)
+	case tok.is("not"):
+		// "x not in list"
+		pos := p.pos
+		p.next()
+		if in, err := p.peek(); err != nil || !in.is("in") {
+			p.pos = pos
+			return x, nil
+		}
+		p.next()
+		list, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		e, err := newInExpr(x, list)
+		if err != nil {
+			return nil, err
+		}
+		return newNotExpr(e)
+	}
+	return x, nil
+}
+
+func (p *exprParser) parsePrimary() (expr, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch tok.kind {
+	case eofToken:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case stringToken:
+		return newStringLiteral(tok.value), nil
+	case intToken:
+		n, err := strconv.Atoi(tok.text)
+		if err != nil {
+			return nil, err
+		}
+		return newIntLiteral(n), nil
+	case topicToken:
+		return newInExpr(newStringLiteral(tok.value), mustField("topics"))
+	case identToken:
+		switch strings.ToLower(tok.text) {
+		case "true":
+			return newBoolLiteral(true), nil
+		case "false":
+			return newBoolLiteral(false), nil
+		case "count":
+			if next, err := p.peek(); err == nil && next.is("(") {
+				p.next()
+				return p.parseCount()
+			}
+		}
+		return newFieldExpr(tok.text)
+	}
+	switch {
+	case tok.is("("):
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case tok.is("["):
+		return p.parseList()
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+}
+
+// parseCount parses the remainder of a count(...) call.
+func (p *exprParser) parseCount() (expr, error) {
+	args := []expr{}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		tok, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.is(")") {
+			break
+		}
+		if !tok.is(",") {
+			return nil, fmt.Errorf("expected , or ) at offset %d", tok.pos)
+		}
+	}
+	return newCountExpr(args)
+}
+
+// parseList parses the remainder of a list literal of strings or ints.
+func (p *exprParser) parseList() (expr, error) {
+	strs := []string{}
+	ints := []int{}
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.is("]") && len(strs)+len(ints) == 0 {
+			break
+		}
+		switch {
+		case tok.kind == stringToken && len(ints) == 0:
+			strs = append(strs, tok.value)
+		case tok.kind == intToken && len(strs) == 0:
+			n, err := strconv.Atoi(tok.text)
+			if err != nil {
+				return nil, err
+			}
+			ints = append(ints, n)
+		default:
+			return nil, fmt.Errorf("unexpected %q in list at offset %d", tok.text, tok.pos)
+		}
+		tok, err = p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok.is("]") {
+			break
+		}
+		if !tok.is(",") {
+			return nil, fmt.Errorf("expected , or ] at offset %d", tok.pos)
+		}
+	}
+	if len(ints) > 0 {
+		return &literalExpr{intListType, ints}, nil
+	}
+	return newStringListLiteral(strs), nil
+}
+
+func (p *exprParser) expect(s string) error {
+	tok, err := p.next()
+	if err != nil {
+		return err
+	}
+	if !tok.is(s) {
+		return fmt.Errorf("expected %q at offset %d, got %q", s, tok.pos, tok.text)
+	}
+	return nil
+}
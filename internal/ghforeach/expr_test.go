@@ -0,0 +1,100 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+)
+
+func TestParseExpr(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	goRepo := withRepo(testRepo("org", "service-a", "go", "team-payments"), func(r *github.Repository) {
+		r.Language = github.String("Go")
+		r.Size = github.Int(2048)
+		r.PushedAt = &github.Timestamp{Time: time.Date(2024, 5, 30, 0, 0, 0, 0, time.UTC)}
+	})
+	legacyRepo := withRepo(testRepo("org", "legacy-api", "rust"), func(r *github.Repository) {
+		r.Archived = github.Bool(true)
+	})
+	cases := []struct {
+		expression string
+		repo       *github.Repository
+		match      bool
+	}{
+		{"(topic:go or topic:rust) and not archived and name !~ ^legacy-", goRepo, true},
+		{"(topic:go or topic:rust) and not archived and name !~ ^legacy-", legacyRepo, false},
+		{"TOPIC:rust AND archived", legacyRepo, true},
+		{`language == "Go" && size > 1024`, goRepo, true},
+		{"size in [1, 2048]", goRepo, true},
+		{`name not in ["service-a", "service-b"]`, goRepo, false},
+		{`topics in ["rust", "python"]`, goRepo, false},
+		{`topics =~ '^team-'`, goRepo, true},
+		{`pushed_at >= "72h"`, goRepo, true},
+		{`pushed_at >= "2024-05-31"`, goRepo, false},
+		{`owner == "org" and full_name == "org/service-a"`, goRepo, true},
+		{`!fork && description == ""`, goRepo, true},
+		{"count(topic:go, topic:rust, topic:team-payments) >= 2", goRepo, true},
+		{"count(topic:go, archived) == 2", goRepo, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.expression, func(t *testing.T) {
+			e, err := parseExpr(tc.expression, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.eval(tc.repo).(bool); got != tc.match {
+				t.Errorf("expected %v, got %v for %s", tc.match, got, e)
+			}
+			// the canonical form must parse back to an equivalent expression
+			reparsed, err := parseExpr(e.String(), now)
+			if err != nil {
+				t.Fatalf("reparsing %s: %v", e, err)
+			}
+			if reparsed.String() != e.String() {
+				t.Errorf("expected %s, got %s", e, reparsed)
+			}
+		})
+	}
+}
+
+func TestParseExpr_errors(t *testing.T) {
+	for _, expression := range []string{
+		"name",
+		"stars > 10",
+		`size > "big"`,
+		"archived and",
+		"name =~ (",
+		`name in "service-a"`,
+		`size in ["a"]`,
+		"(archived",
+		`name == "unterminated`,
+		"not size",
+		"archived archived",
+		"count(size) > 1",
+		"count(archived",
+	} {
+		t.Run(expression, func(t *testing.T) {
+			if _, err := parseExpr(expression, time.Now()); err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,483 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	"go.uber.org/zap"
+)
+
+// AttributeFilter selects repositories by a boolean attribute such as
+// whether they are archived or forks.
+type AttributeFilter = int
+
+const (
+	IncludeAttribute AttributeFilter = iota
+	ExcludeAttribute
+	OnlyAttribute
+)
+
+// ParseAttributeFilter parses "include", "exclude" or "only" into an
+// AttributeFilter.
+func ParseAttributeFilter(s string) (AttributeFilter, error) {
+	switch strings.ToLower(s) {
+	case "include":
+		return IncludeAttribute, nil
+	case "exclude":
+		return ExcludeAttribute, nil
+	case "only":
+		return OnlyAttribute, nil
+	default:
+		return 0, fmt.Errorf("invalid attribute filter %q: expected include, exclude or only", s)
+	}
+}
+
+// MatchMode selects whether any or all of several patterns must match.
+type MatchMode = int
+
+const (
+	MatchAny MatchMode = iota
+	MatchAll
+)
+
+// ParseMatchMode parses "any" or "all" into a MatchMode.
+func ParseMatchMode(s string) (MatchMode, error) {
+	switch strings.ToLower(s) {
+	case "any":
+		return MatchAny, nil
+	case "all":
+		return MatchAll, nil
+	default:
+		return 0, fmt.Errorf("invalid match mode %q: expected any or all", s)
+	}
+}
+
+// WithNameRegexp adds a regular expression for matching repository names. It
+// may be given more than once, in which case the name match mode decides
+// whether any or all expressions must match.
+func WithNameRegexp(exp string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		regexp, err := regexp.Compile(exp)
+		if err != nil {
+			return err
+		}
+		fre.nameRegexps = append(fre.nameRegexps, regexp)
+		return nil
+	}
+}
+
+// WithNameMatchMode sets whether a repository name must match any (the
+// default) or all of the name regular expressions.
+func WithNameMatchMode(mode MatchMode) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.nameMatch = mode
+		return nil
+	}
+}
+
+// WithNameList restricts iteration to the listed repositories. Entries may be
+// bare names, which match in any owner, or owner-qualified "owner/name" full
+// names. Qualified entries whose owner is not otherwise listed are fetched
+// directly.
+func WithNameList(names []string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.nameSet = newStringSet(names)
+		return nil
+	}
+}
+
+// WithTopicRegexp adds a regular expression for matching topics. An
+// expression is satisfied if any of a repository's topics matches it. It may be
+// given more than once.
+func WithTopicRegexp(exp string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		regexp, err := regexp.Compile(exp)
+		if err != nil {
+			return err
+		}
+		fre.topicRegexps = append(fre.topicRegexps, regexp)
+		return nil
+	}
+}
+
+// WithTopicMatchMode sets whether a repository must satisfy any (the default)
+// or all of the topic regular expressions, and carry any or all of the topics
+// in the topic list.
+func WithTopicMatchMode(mode MatchMode) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.topicMatch = mode
+		return nil
+	}
+}
+
+// WithTopicMinCount requires a repository to satisfy at least n of the topic
+// regular expressions and carry at least n of the topics in the topic list.
+// It takes precedence over the topic match mode. Zero disables it.
+func WithTopicMinCount(n int) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		if n < 0 {
+			return fmt.Errorf("invalid topic minimum count %d", n)
+		}
+		fre.topicMin = n
+		return nil
+	}
+}
+
+func WithTopicList(topics []string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.topicSet = newStringSet(topics)
+		return nil
+	}
+}
+
+// WithExcludeNameRegexp skips repositories whose name matches exp. Exclusions
+// are evaluated after the include filters.
+func WithExcludeNameRegexp(exp string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		regexp, err := regexp.Compile(exp)
+		if err != nil {
+			return err
+		}
+		fre.excludeNameRegexp = regexp
+		return nil
+	}
+}
+
+// WithExcludeNameList skips the listed repositories. As with WithNameList,
+// entries may be bare names or "owner/name" full names.
+func WithExcludeNameList(names []string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.excludeNameSet = newStringSet(names)
+		return nil
+	}
+}
+
+// WithExcludeTopicRegexp skips repositories having any topic that matches exp.
+func WithExcludeTopicRegexp(exp string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		regexp, err := regexp.Compile(exp)
+		if err != nil {
+			return err
+		}
+		fre.excludeTopicRegexp = regexp
+		return nil
+	}
+}
+
+// WithExcludeTopicList skips repositories having any of the listed topics.
+func WithExcludeTopicList(topics []string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.excludeTopicSet = newStringSet(topics)
+		return nil
+	}
+}
+
+// WithArchived sets how archived repositories are handled. Archived
+// repositories are excluded by default since they cannot be pushed to.
+func WithArchived(filter AttributeFilter) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.archived = filter
+		return nil
+	}
+}
+
+// WithForks sets how forked repositories are handled.
+func WithForks(filter AttributeFilter) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.forks = filter
+		return nil
+	}
+}
+
+// WithTemplates sets how template repositories are handled.
+func WithTemplates(filter AttributeFilter) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.templates = filter
+		return nil
+	}
+}
+
+// WithVisibility restricts iteration to repositories with one of the given
+// visibilities ("public", "private" or "internal").
+func WithVisibility(visibilities []string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.visibilitySet = map[string]struct{}{}
+		for _, visibility := range visibilities {
+			visibility = strings.ToLower(visibility)
+			switch visibility {
+			case "public", "private", "internal":
+			default:
+				return fmt.Errorf("invalid visibility %q", visibility)
+			}
+			fre.visibilitySet[visibility] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// WithLanguages restricts iteration to repositories whose primary language is
+// one of languages. Languages are compared case-insensitively.
+func WithLanguages(languages []string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.languageSet = map[string]struct{}{}
+		for language := range newStringSet(languages) {
+			fre.languageSet[strings.ToLower(language)] = struct{}{}
+		}
+		return nil
+	}
+}
+
+// WithSizeRange restricts iteration to repositories whose size in kilobytes
+// is within [min, max]. A negative bound is ignored.
+func WithSizeRange(min, max int) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		if min >= 0 && max >= 0 && min > max {
+			return fmt.Errorf("invalid size range: min %d is greater than max %d", min, max)
+		}
+		fre.minSize = min
+		fre.maxSize = max
+		return nil
+	}
+}
+
+// WithPushedSince restricts iteration to repositories pushed to at or after t.
+func WithPushedSince(t time.Time) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.pushedSince = &t
+		return nil
+	}
+}
+
+// WithDefaultBranch restricts iteration to repositories whose default branch
+// is named branch.
+func WithDefaultBranch(branch string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.defaultBranch = &branch
+		return nil
+	}
+}
+
+// ParsePushedSince parses either an absolute date (RFC 3339 or YYYY-MM-DD) or
+// a duration relative to now (e.g. "720h") into a time.
+func ParsePushedSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: expected RFC 3339, YYYY-MM-DD or a duration", s)
+}
+
+// repoVisibility returns the visibility of repo, falling back to the private
+// flag for responses that do not include it.
+func repoVisibility(repo *github.Repository) string {
+	if visibility := repo.GetVisibility(); visibility != "" {
+		return strings.ToLower(visibility)
+	}
+	if repo.GetPrivate() {
+		return "private"
+	}
+	return "public"
+}
+
+// newStringSet builds a set from items, ignoring surrounding whitespace and
+// blank entries such as the trailing newline of a list file.
+func newStringSet(items []string) map[string]struct{} {
+	set := map[string]struct{}{}
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		set[item] = struct{}{}
+	}
+	return set
+}
+
+// WithWhere adds a filter expression that repositories must satisfy, e.g.
+// `(topic:go or topic:rust) and not archived and name !~ ^legacy-`. The
+// expression is parsed and type checked immediately. It may be given more
+// than once, in which case all expressions must hold.
+func WithWhere(expression string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		e, err := parseExpr(expression, time.Now())
+		if err != nil {
+			return err
+		}
+		fre.where = append(fre.where, e)
+		return nil
+	}
+}
+
+// compileFilter lowers the configured filter options, followed by any where
+// expressions, into a single expression. It returns nil if nothing is
+// filtered.
+func (rh *RepositoryExecutor) compileFilter() expr {
+	exprs := []expr{}
+	if len(rh.nameRegexps) > 0 {
+		needles := []expr{}
+		for _, re := range rh.nameRegexps {
+			needles = append(needles, mustExpr(newMatchExpr(false, mustField("name"), re)))
+		}
+		exprs = append(exprs, anyAll(needles, rh.nameMatch == MatchAll, 0))
+	}
+	if rh.nameSet != nil {
+		exprs = append(exprs, nameSetExpr(rh.nameSet))
+	}
+	if len(rh.topicRegexps) > 0 {
+		// each expression is satisfied if any topic matches it
+		needles := []expr{}
+		for _, re := range rh.topicRegexps {
+			needles = append(needles, mustExpr(newMatchExpr(false, mustField("topics"), re)))
+		}
+		exprs = append(exprs, anyAll(needles, rh.topicMatch == MatchAll, rh.topicMin))
+	}
+	if rh.topicSet != nil {
+		if (rh.topicMatch == MatchAny && rh.topicMin == 0) || len(rh.topicSet) == 0 {
+			// pass if any topic matches
+			exprs = append(exprs, mustExpr(newInExpr(mustField("topics"), setLiteral(rh.topicSet))))
+		} else {
+			needles := []expr{}
+			for _, topic := range sortedSet(rh.topicSet) {
+				needles = append(needles, mustExpr(newInExpr(newStringLiteral(topic), mustField("topics"))))
+			}
+			exprs = append(exprs, anyAll(needles, rh.topicMatch == MatchAll, rh.topicMin))
+		}
+	}
+
+	// exclusions
+	if rh.excludeNameRegexp != nil {
+		exprs = append(exprs, mustExpr(newMatchExpr(true, mustField("name"), rh.excludeNameRegexp)))
+	}
+	if rh.excludeNameSet != nil {
+		exprs = append(exprs, mustExpr(newNotExpr(nameSetExpr(rh.excludeNameSet))))
+	}
+	if rh.excludeTopicRegexp != nil {
+		// fail if any topic matches
+		exprs = append(exprs, mustExpr(newNotExpr(mustExpr(newMatchExpr(false, mustField("topics"), rh.excludeTopicRegexp)))))
+	}
+	if rh.excludeTopicSet != nil {
+		// fail if any topic matches
+		exprs = append(exprs, mustExpr(newNotExpr(mustExpr(newInExpr(mustField("topics"), setLiteral(rh.excludeTopicSet))))))
+	}
+
+	// attributes
+	for _, attr := range []struct {
+		filter AttributeFilter
+		field  string
+	}{
+		{rh.archived, "archived"},
+		{rh.forks, "fork"},
+		{rh.templates, "is_template"},
+	} {
+		switch attr.filter {
+		case ExcludeAttribute:
+			exprs = append(exprs, mustExpr(newNotExpr(mustField(attr.field))))
+		case OnlyAttribute:
+			exprs = append(exprs, mustField(attr.field))
+		}
+	}
+	if rh.visibilitySet != nil {
+		exprs = append(exprs, mustExpr(newInExpr(mustField("visibility"), setLiteral(rh.visibilitySet))))
+	}
+	if rh.languageSet != nil {
+		languages := []string{}
+		for language := range rh.languageSet {
+			languages = append(languages, regexp.QuoteMeta(language))
+		}
+		sort.Strings(languages)
+		re := regexp.MustCompile("(?i)^(?:" + strings.Join(languages, "|") + ")$")
+		exprs = append(exprs, mustExpr(newMatchExpr(false, mustField("language"), re)))
+	}
+	if rh.minSize >= 0 {
+		exprs = append(exprs, mustExpr(newCompareExpr(">=", mustField("size"), newIntLiteral(rh.minSize), time.Time{})))
+	}
+	if rh.maxSize >= 0 {
+		exprs = append(exprs, mustExpr(newCompareExpr("<=", mustField("size"), newIntLiteral(rh.maxSize), time.Time{})))
+	}
+	if rh.pushedSince != nil {
+		exprs = append(exprs, mustExpr(newCompareExpr(">=", mustField("pushed_at"), newTimeLiteral(*rh.pushedSince), time.Time{})))
+	}
+	if rh.defaultBranch != nil {
+		exprs = append(exprs, mustExpr(newCompareExpr("==", mustField("default_branch"), newStringLiteral(*rh.defaultBranch), time.Time{})))
+	}
+
+	exprs = append(exprs, rh.where...)
+	return andAll(exprs)
+}
+
+// nameSetExpr matches repositories whose name or full name is in set.
+func nameSetExpr(set map[string]struct{}) expr {
+	list := setLiteral(set)
+	byName := mustExpr(newInExpr(mustField("name"), list))
+	byFullName := mustExpr(newInExpr(mustField("full_name"), list))
+	return mustExpr(newLogicExpr(false, byName, byFullName))
+}
+
+// setLiteral returns the sorted elements of set as a list literal.
+func setLiteral(set map[string]struct{}) expr {
+	return newStringListLiteral(sortedSet(set))
+}
+
+func sortedSet(set map[string]struct{}) []string {
+	items := make([]string, 0, len(set))
+	for item := range set {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return items
+}
+
+// matchRepo reports whether repo passes the filter expression, then the
+// custom property predicates and then the content predicates, so that the
+// API is only queried for repositories that are otherwise eligible.
+func (rh *RepositoryExecutor) matchRepo(ctx context.Context, repo *github.Repository) bool {
+	if rh.filter != nil && !rh.filter.eval(repo).(bool) {
+		return false
+	}
+	if len(rh.propertyPredicates) > 0 {
+		match, err := rh.matchProperties(ctx, repo)
+		if err != nil {
+			rh.logger.Error("error checking repository custom properties", zap.String("repository", repo.GetFullName()), zap.Error(err))
+			return false
+		}
+		if !match {
+			return false
+		}
+	}
+	if len(rh.contentPredicates) > 0 {
+		match, err := rh.matchContents(ctx, repo)
+		if err != nil {
+			rh.logger.Error("error checking repository contents", zap.String("repository", repo.GetFullName()), zap.Error(err))
+			return false
+		}
+		return match
+	}
+	return true
+}
@@ -0,0 +1,225 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+)
+
+func testRepo(owner, name string, topics ...string) *github.Repository {
+	return &github.Repository{
+		Name:     github.String(name),
+		FullName: github.String(owner + "/" + name),
+		Owner:    &github.User{Login: github.String(owner)},
+		Topics:   topics,
+	}
+}
+
+func withRepo(repo *github.Repository, modify func(*github.Repository)) *github.Repository {
+	modify(repo)
+	return repo
+}
+
+func TestMatchRepo(t *testing.T) {
+	cases := []struct {
+		name  string
+		opts  []RepositoryExecutorOption
+		repo  *github.Repository
+		match bool
+	}{
+		{
+			"no filters",
+			nil,
+			testRepo("org", "service-a"),
+			true,
+		},
+		{
+			"include and exclude name regexp",
+			[]RepositoryExecutorOption{WithNameRegexp("^service-"), WithExcludeNameRegexp("-legacy$")},
+			testRepo("org", "service-legacy"),
+			false,
+		},
+		{
+			"exclude name list by name",
+			[]RepositoryExecutorOption{WithNameRegexp("^service-"), WithExcludeNameList([]string{"service-a", ""})},
+			testRepo("org", "service-a"),
+			false,
+		},
+		{
+			"exclude name list by other owner full name",
+			[]RepositoryExecutorOption{WithExcludeNameList([]string{"other/service-a"})},
+			testRepo("org", "service-a"),
+			true,
+		},
+		{
+			"exclude topic regexp",
+			[]RepositoryExecutorOption{WithExcludeTopicRegexp("^deprecated")},
+			testRepo("org", "service-a", "go", "deprecated-2023"),
+			false,
+		},
+		{
+			"exclude topic list without matching topic",
+			[]RepositoryExecutorOption{WithTopicList([]string{"go"}), WithExcludeTopicList([]string{"legacy"})},
+			testRepo("org", "service-a", "go"),
+			true,
+		},
+		{
+			"include list by full name",
+			[]RepositoryExecutorOption{WithNameList([]string{"org/service-a\n"})},
+			testRepo("org", "service-a"),
+			true,
+		},
+		{
+			"topic list all",
+			[]RepositoryExecutorOption{WithTopicList([]string{"team-payments", "lang-go"}), WithTopicMatchMode(MatchAll)},
+			testRepo("org", "service-a", "team-payments", "lang-rust"),
+			false,
+		},
+		{
+			"topic list all present",
+			[]RepositoryExecutorOption{WithTopicList([]string{"team-payments", "lang-go"}), WithTopicMatchMode(MatchAll)},
+			testRepo("org", "service-a", "lang-go", "team-payments", "extra"),
+			true,
+		},
+		{
+			"topic regexps all",
+			[]RepositoryExecutorOption{WithTopicRegexp("^team-"), WithTopicRegexp("^lang-"), WithTopicMatchMode(MatchAll)},
+			testRepo("org", "service-a", "team-payments"),
+			false,
+		},
+		{
+			"topic regexps any",
+			[]RepositoryExecutorOption{WithTopicRegexp("^team-"), WithTopicRegexp("^lang-")},
+			testRepo("org", "service-a", "team-payments"),
+			true,
+		},
+		{
+			"topic min count",
+			[]RepositoryExecutorOption{WithTopicList([]string{"a", "b", "c"}), WithTopicMinCount(2)},
+			testRepo("org", "service-a", "a", "c"),
+			true,
+		},
+		{
+			"topic min count not reached",
+			[]RepositoryExecutorOption{WithTopicList([]string{"a", "b", "c"}), WithTopicMatchMode(MatchAll), WithTopicMinCount(2)},
+			testRepo("org", "service-a", "a"),
+			false,
+		},
+		{
+			"name regexps all",
+			[]RepositoryExecutorOption{WithNameRegexp("^service-"), WithNameRegexp("-api$"), WithNameMatchMode(MatchAll)},
+			testRepo("org", "service-a"),
+			false,
+		},
+		{
+			"name regexps any",
+			[]RepositoryExecutorOption{WithNameRegexp("^service-"), WithNameRegexp("-api$")},
+			testRepo("org", "service-a"),
+			true,
+		},
+		{
+			"archived excluded by default",
+			nil,
+			withRepo(testRepo("org", "service-a"), func(r *github.Repository) { r.Archived = github.Bool(true) }),
+			false,
+		},
+		{
+			"archived included",
+			[]RepositoryExecutorOption{WithArchived(IncludeAttribute)},
+			withRepo(testRepo("org", "service-a"), func(r *github.Repository) { r.Archived = github.Bool(true) }),
+			true,
+		},
+		{
+			"only forks",
+			[]RepositoryExecutorOption{WithForks(OnlyAttribute)},
+			testRepo("org", "service-a"),
+			false,
+		},
+		{
+			"visibility falls back to private flag",
+			[]RepositoryExecutorOption{WithVisibility([]string{"private"})},
+			withRepo(testRepo("org", "service-a"), func(r *github.Repository) { r.Private = github.Bool(true) }),
+			true,
+		},
+		{
+			"language is case insensitive",
+			[]RepositoryExecutorOption{WithLanguages([]string{"go"})},
+			withRepo(testRepo("org", "service-a"), func(r *github.Repository) { r.Language = github.String("Go") }),
+			true,
+		},
+		{
+			"size above max",
+			[]RepositoryExecutorOption{WithSizeRange(-1, 100)},
+			withRepo(testRepo("org", "service-a"), func(r *github.Repository) { r.Size = github.Int(101) }),
+			false,
+		},
+		{
+			"pushed before since",
+			[]RepositoryExecutorOption{WithPushedSince(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))},
+			withRepo(testRepo("org", "service-a"), func(r *github.Repository) {
+				r.PushedAt = &github.Timestamp{Time: time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)}
+			}),
+			false,
+		},
+		{
+			"default branch",
+			[]RepositoryExecutorOption{WithDefaultBranch("main")},
+			withRepo(testRepo("org", "service-a"), func(r *github.Repository) { r.DefaultBranch = github.String("main") }),
+			true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			exec, err := NewRepositoryExecutor(tc.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := exec.matchRepo(context.Background(), tc.repo); got != tc.match {
+				t.Errorf("expected match %v, got %v", tc.match, got)
+			}
+		})
+	}
+}
+
+func TestParsePushedSince(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		in       string
+		expected time.Time
+	}{
+		{"2024-01-02", time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"2024-01-02T03:04:05Z", time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"24h", time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range cases {
+		got, err := ParsePushedSince(tc.in, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.in, tc.expected, got)
+		}
+	}
+	if _, err := ParsePushedSince("last tuesday", now); err == nil {
+		t.Error("expected error for invalid time")
+	}
+}
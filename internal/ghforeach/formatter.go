@@ -0,0 +1,285 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// outputFormatter writes the results of a run in an output format.
+type outputFormatter interface {
+	// result writes result as soon as it is available. Formats that cannot
+	// be written incrementally hold it until finish.
+	result(w io.Writer, result *executionResult) error
+	// finish writes whatever follows the last result.
+	finish(w io.Writer, summary *runSummary) error
+}
+
+// outputFormatters constructs the formatter of each output format. A new
+// format only needs an entry here.
+var outputFormatters = map[RepositoryExecutorOutputFormat]func(rh *RepositoryExecutor) outputFormatter{
+	ConsoleOutputFormat: func(rh *RepositoryExecutor) outputFormatter { return &consoleFormatter{stream: rh.stream} },
+	JsonOutputFormat:    func(rh *RepositoryExecutor) outputFormatter { return &jsonFormatter{} },
+	JUnitOutputFormat:   func(rh *RepositoryExecutor) outputFormatter { return &junitFormatter{} },
+	CSVOutputFormat:     func(rh *RepositoryExecutor) outputFormatter { return &csvFormatter{} },
+}
+
+// outputFormatNames are the names by which output formats are selected.
+var outputFormatNames = map[string]RepositoryExecutorOutputFormat{
+	"console": ConsoleOutputFormat,
+	"json":    JsonOutputFormat,
+	"junit":   JUnitOutputFormat,
+	"csv":     CSVOutputFormat,
+}
+
+// ParseOutputFormat parses an output format name: console, json, junit or
+// csv.
+func ParseOutputFormat(s string) (RepositoryExecutorOutputFormat, error) {
+	format, ok := outputFormatNames[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("invalid output format %q: expected console, json, junit or csv", s)
+	}
+	return format, nil
+}
+
+// consoleFormatter writes human-readable results followed by the summary.
+type consoleFormatter struct {
+	stream *streamPrinter
+}
+
+func (cf *consoleFormatter) result(w io.Writer, result *executionResult) error {
+	if cf.stream != nil {
+		// the output was already streamed, but not the changes
+		cf.stream.println(result.Repository, result.statusLine())
+		cf.stream.printText(result.Repository, result.Diff)
+		cf.stream.printText(result.Repository, result.Rejects)
+		return nil
+	}
+	_, err := fmt.Fprintln(w, result.String())
+	return err
+}
+
+func (cf *consoleFormatter) finish(w io.Writer, summary *runSummary) error {
+	_, err := fmt.Fprint(w, summary.String())
+	return err
+}
+
+// jsonFormatter writes a JSON object per result and then one holding the
+// summary.
+type jsonFormatter struct{}
+
+func (jf *jsonFormatter) result(w io.Writer, result *executionResult) error {
+	str, err := result.JsonString()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, str)
+	return err
+}
+
+func (jf *jsonFormatter) finish(w io.Writer, summary *runSummary) error {
+	str, err := summary.JsonString()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, str)
+	return err
+}
+
+// junitFormatter writes a JUnit XML report in which every repository is a
+// test case, for CI systems. The document is written once the run is done.
+type junitFormatter struct {
+	results []*executionResult
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Skipped  int          `xml:"skipped,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+func (jf *junitFormatter) result(w io.Writer, result *executionResult) error {
+	jf.results = append(jf.results, result)
+	return nil
+}
+
+func (jf *junitFormatter) finish(w io.Writer, summary *runSummary) error {
+	suite := junitSuite{Name: "ghforeach", Cases: []junitTestCase{}}
+	var started time.Time
+	var total time.Duration
+	for _, result := range jf.results {
+		testCase := junitTestCase{
+			ClassName: strings.SplitN(result.Repository, "/", 2)[0],
+			Name:      result.Repository,
+			Time:      junitSeconds(result.Duration()),
+			SystemOut: result.Stdout,
+			SystemErr: result.Stderr,
+		}
+		switch result.Status {
+		case FailedStatus:
+			suite.Failures++
+			message := &junitMessage{Type: FailedStatus}
+			if result.Error != nil {
+				message.Message = firstLine(result.Error.Error())
+				message.Text = result.Error.Error() + "\n"
+			}
+			message.Text += result.Stderr
+			testCase.Failure = message
+		case SkippedPreconditionStatus:
+			suite.Skipped++
+			testCase.Skipped = &junitMessage{Message: "precondition not met: " + result.Precondition}
+		case DriftedStatus:
+			suite.Failures++
+			testCase.Failure = &junitMessage{Message: "files differ from the sync manifest", Type: DriftedStatus, Text: result.Stdout}
+		case SkippedReviewStatus:
+			suite.Skipped++
+			testCase.Skipped = &junitMessage{Message: "changes not approved in review"}
+		}
+		if !result.Started.IsZero() && (started.IsZero() || result.Started.Before(started)) {
+			started = result.Started
+		}
+		total += result.Duration()
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	suite.Tests = len(suite.Cases)
+	suite.Time = junitSeconds(total)
+	if !started.IsZero() {
+		suite.Timestamp = started.Format("2006-01-02T15:04:05")
+	}
+
+	doc := junitTestSuites{
+		Name:     suite.Name,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Skipped:  suite.Skipped,
+		Time:     suite.Time,
+		Suites:   []junitSuite{suite},
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(doc); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+func junitSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// csvHeader names the columns written by csvFormatter.
+var csvHeader = []string{
+	"repository",
+	"status",
+	"duration_seconds",
+	"attempts",
+	"clone_attempts",
+	"error",
+	"pull_request_url",
+	"stdout",
+	"stderr",
+}
+
+// csvFormatter writes a CSV row per result, for spreadsheets.
+type csvFormatter struct {
+	writer *csv.Writer
+}
+
+// start writes the header before the first row.
+func (cf *csvFormatter) start(w io.Writer) error {
+	if cf.writer != nil {
+		return nil
+	}
+	cf.writer = csv.NewWriter(w)
+	return cf.writer.Write(csvHeader)
+}
+
+func (cf *csvFormatter) result(w io.Writer, result *executionResult) error {
+	if err := cf.start(w); err != nil {
+		return err
+	}
+	errStr := ""
+	if result.Error != nil {
+		errStr = result.Error.Error()
+	}
+	err := cf.writer.Write([]string{
+		result.Repository,
+		result.Status,
+		strconv.FormatFloat(result.Duration().Seconds(), 'f', 3, 64),
+		strconv.Itoa(result.Attempts),
+		strconv.Itoa(result.CloneAttempts),
+		errStr,
+		result.PullRequestURL,
+		result.Stdout,
+		result.Stderr,
+	})
+	if err != nil {
+		return err
+	}
+	cf.writer.Flush()
+	return cf.writer.Error()
+}
+
+func (cf *csvFormatter) finish(w io.Writer, summary *runSummary) error {
+	// without results, the header still describes the columns
+	if err := cf.start(w); err != nil {
+		return err
+	}
+	cf.writer.Flush()
+	return cf.writer.Error()
+}
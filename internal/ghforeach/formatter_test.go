@@ -0,0 +1,98 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+// formatResults writes the report test results in format.
+func formatResults(t *testing.T, format RepositoryExecutorOutputFormat) string {
+	t.Helper()
+	results, summary := reportResults()
+	formatter := outputFormatters[format](&RepositoryExecutor{})
+	b := &strings.Builder{}
+	for _, result := range results {
+		if err := formatter.result(b, result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := formatter.finish(b, summary); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestJUnitFormatter(t *testing.T) {
+	out := formatResults(t, JUnitOutputFormat)
+	doc := junitTestSuites{}
+	if err := xml.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatalf("expected valid XML, got %v:\n%s", err, out)
+	}
+	if doc.Tests != 3 || doc.Failures != 1 || doc.Skipped != 1 || len(doc.Suites) != 1 {
+		t.Fatalf("unexpected totals: %+v", doc)
+	}
+	cases := doc.Suites[0].Cases
+	if cases[0].Name != "org/a" || cases[0].ClassName != "org" || cases[0].Time != "90.000" || cases[0].Failure != nil {
+		t.Errorf("unexpected passing case: %+v", cases[0])
+	}
+	if failure := cases[1].Failure; failure == nil || failure.Message != "exit status 1" || failure.Text != "exit status 1\ndetail\n<boom>\n" {
+		t.Errorf("expected failure with error and stderr, got %+v", failure)
+	}
+	if cases[2].Skipped == nil {
+		t.Errorf("expected skipped case, got %+v", cases[2])
+	}
+}
+
+func TestCSVFormatter(t *testing.T) {
+	records, err := csv.NewReader(strings.NewReader(formatResults(t, CSVOutputFormat))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || strings.Join(records[0], ",") != strings.Join(csvHeader, ",") {
+		t.Fatalf("expected header and 3 rows, got %v", records)
+	}
+	expected := []string{"org/b|c", "failed", "0.000", "1", "0", "exit status 1\ndetail", "", "", "<boom>\n"}
+	if strings.Join(records[2], "\x00") != strings.Join(expected, "\x00") {
+		t.Errorf("expected row %q, got %q", expected, records[2])
+	}
+
+	// the header is written even without results
+	formatter := outputFormatters[CSVOutputFormat](&RepositoryExecutor{})
+	b := &strings.Builder{}
+	if err := formatter.finish(b, newRunSummary()); err != nil || !strings.HasPrefix(b.String(), "repository,status,") {
+		t.Errorf("expected header without results, got %q, %v", b.String(), err)
+	}
+}
+
+func TestParseOutputFormat(t *testing.T) {
+	for name, expected := range outputFormatNames {
+		if format, err := ParseOutputFormat(strings.ToUpper(name)); err != nil || format != expected {
+			t.Errorf("expected %s to parse, got %v, %v", name, format, err)
+		}
+		if _, ok := outputFormatters[expected]; !ok {
+			t.Errorf("expected a formatter for %s", name)
+		}
+	}
+	if _, err := ParseOutputFormat("yaml"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
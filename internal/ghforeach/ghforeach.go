@@ -20,12 +20,18 @@ package ghforeach
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/alexflint/go-arg"
 	"github.com/google/go-github/v60/github"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/term"
 )
 
 type Args struct {
@@ -36,23 +42,96 @@ type Args struct {
 	AuthToken *string `arg:"env:GH_AUTH_TOKEN" help:"token for authenticating API requests."`
 
 	// repo owner options
-	Org  *string `arg:"-o" help:"organization owning repositories to be iterated."`
-	User *string `arg:"-u" help:"user owning repositories to be iterated."`
+	Org  []string `arg:"-o,separate" help:"organization owning repositories to be iterated. may be repeated."`
+	User []string `arg:"-u,separate" help:"user owning repositories to be iterated. may be repeated."`
 
 	// filtering parameters
-	NameExp   *string `arg:"-n" help:"regular expression for matching repository names."`
-	NameList  *string `arg:"-N" help:"path to file containing repository names (newline separated)."`
-	TopicExp  *string `arg:"-t" help:"regular expression for matching topics."`
-	TopicList *string `arg:"-T" help:"path to file containing topics (newline separated)."`
+	NameExp    []string `arg:"-n,separate" help:"regular expression for matching repository names. may be repeated."`
+	NameMatch  string   `arg:"--name-match" default:"any" help:"whether names must match any or all NAMEEXP expressions."`
+	NameList   *string  `arg:"-N" help:"path to file containing repository names or owner/name full names (newline separated)."`
+	TopicExp   []string `arg:"-t,separate" help:"regular expression for matching topics. may be repeated."`
+	TopicList  *string  `arg:"-T" help:"path to file containing topics (newline separated)."`
+	TopicMatch string   `arg:"--topic-match" default:"any" help:"whether repositories must match any or all TOPICEXP expressions and TOPICLIST topics."`
+	TopicMin   int      `arg:"--topic-min" help:"minimum number of TOPICEXP expressions and TOPICLIST topics a repository must match. overrides TOPICMATCH."`
+
+	// exclusion parameters, evaluated after the filtering parameters
+	ExcludeNameExp   *string `arg:"--exclude-name-exp" help:"regular expression for repository names to skip."`
+	ExcludeNameList  *string `arg:"--exclude-namelist" help:"path to file containing repository names or owner/name full names to skip (newline separated)."`
+	ExcludeTopicExp  *string `arg:"--exclude-topic-exp" help:"regular expression for topics whose repositories are skipped."`
+	ExcludeTopicList *string `arg:"--exclude-topiclist" help:"path to file containing topics whose repositories are skipped (newline separated)."`
+
+	// repository attribute parameters
+	Archived      string   `arg:"--archived" default:"exclude" help:"how to handle archived repositories: include, exclude or only."`
+	Forks         string   `arg:"--forks" default:"include" help:"how to handle forked repositories: include, exclude or only."`
+	Templates     string   `arg:"--templates" default:"include" help:"how to handle template repositories: include, exclude or only."`
+	Visibility    []string `arg:"--visibility,separate" help:"only iterate repositories with this visibility (public, private or internal). may be repeated."`
+	Language      []string `arg:"--language,separate" help:"only iterate repositories with this primary language. may be repeated."`
+	MinSize       int      `arg:"--min-size" default:"-1" help:"minimum repository size in kilobytes. -1 for no minimum."`
+	MaxSize       int      `arg:"--max-size" default:"-1" help:"maximum repository size in kilobytes. -1 for no maximum."`
+	PushedSince   *string  `arg:"--pushed-since" help:"only iterate repositories pushed since this RFC 3339 time, YYYY-MM-DD date or duration ago (e.g. 720h)."`
+	DefaultBranch *string  `arg:"--default-branch" help:"only iterate repositories whose default branch has this name."`
+
+	// custom property parameters
+	Property []string `arg:"--property,separate" help:"custom property predicate: NAME=VALUE, NAME=~REGEXP, NAME (present) or !NAME (absent). may be repeated."`
+
+	// content parameters, checked through the contents API before cloning
+	HasPath     []string `arg:"--has-path,separate" help:"only iterate repositories containing this path. may be repeated."`
+	MissingPath []string `arg:"--missing-path,separate" help:"only iterate repositories not containing this path. may be repeated."`
+	PathMatches []string `arg:"--path-matches,separate" help:"PATH=REGEXP; only iterate repositories with a file at PATH whose contents match REGEXP. may be repeated."`
+	CacheDir    *string  `arg:"--cache-dir" help:"directory for results cached across runs. defaults to the user cache directory. empty to disable caching."`
+
+	// api cache arguments
+	APICache bool          `arg:"--api-cache" help:"enable to cache GitHub API repository listings in CACHE-DIR, revalidating them with conditional requests."`
+	CacheTTL time.Duration `arg:"--cache-ttl" default:"0s" help:"how long cached repository listings are used without revalidating them. 0 revalidates every listing with a conditional request. requires --api-cache."`
+	Refresh  bool          `arg:"--refresh" help:"enable to bypass cached repository listings for a fresh listing. requires --api-cache."`
+
+	// filter expression, e.g. "(topic:go or topic:rust) and not archived and name !~ ^legacy-"
+	Where []string `arg:"-w,separate" help:"filter expression over repository fields that repositories must satisfy. may be repeated."`
+
+	// retry parameters
+	APIRetries      int           `arg:"--api-retries" default:"3" help:"number of times a failed GitHub API request is retried."`
+	CloneRetries    int           `arg:"--clone-retries" default:"3" help:"number of times a failed clone is retried."`
+	CommandRetries  int           `arg:"--command-retries" default:"0" help:"number of times COMMAND is retried when it exits non-zero."`
+	RetryBackoff    time.Duration `arg:"--retry-backoff" default:"1s" help:"delay before the first retry, doubling with each further retry."`
+	RetryMaxBackoff time.Duration `arg:"--retry-max-backoff" default:"30s" help:"maximum delay between retries."`
 
 	// execution parameters
-	Shell     string `arg:"-s" default:"/bin/sh" help:"path to shell used to run command."`
-	TmpDir    string `arg:"-d" default:"./tmp" help:"directory into which repositories will be cloned."`
-	Cleanup   bool   `arg:"-c" help:"enable to delete TMPDIR after operations are complete."`
-	Overwrite bool   `arg:"-O" help:"enable to delete TMPDIR before operations start."`
-	NThreads  int    `arg:"-p" default:"1" help:"number of repositories that will be handled in parallel. -1 for unlimited."`
-	Json      bool   `arg:"-j" help:"enable to display output as JSON."`
-	Debug     bool   `arg:"-D" help:"enable to debug logging."`
+	If           *string  `arg:"--if" help:"precondition command run at root of each repo before COMMAND. repositories where it exits non-zero are skipped."`
+	Shell        string   `arg:"-s" default:"/bin/sh" help:"path to shell used to run command."`
+	TmpDir       string   `arg:"-d" default:"./tmp" help:"directory into which repositories will be cloned."`
+	Cleanup      bool     `arg:"-c" help:"enable to delete TMPDIR after operations are complete."`
+	Overwrite    bool     `arg:"-O" help:"enable to delete TMPDIR before operations start."`
+	Resume       bool     `arg:"--resume" help:"enable to resume the previous run in TMPDIR, retrying only repositories that failed or did not finish."`
+	NThreads     int      `arg:"-p" default:"1" help:"number of repositories whose commands will run in parallel. -1 for unlimited."`
+	CloneThreads int      `arg:"--clone-threads" help:"number of repositories that will be cloned in parallel. defaults to NTHREADS. -1 for unlimited."`
+	APIThreads   int      `arg:"--api-threads" default:"4" help:"number of GitHub API requests that may be in flight at once. -1 for unlimited."`
+	NoProgress   bool     `arg:"--no-progress" help:"enable to print plain output instead of a progress dashboard when stdout is a terminal."`
+	Stream       bool     `arg:"--stream" help:"enable to print command output line by line as it arrives, prefixed with its repository. with any format but console, streamed lines go to stderr."`
+	ResultsDir   *string  `arg:"--results-dir" help:"directory to write the stdout, stderr, exit status and artifacts of each repository to, under OWNER/REPO, with an index.json of every result."`
+	Artifact     []string `arg:"--artifact,separate" help:"glob of files to copy from each clone into its results directory after COMMAND, e.g. coverage.out or ./report.json. requires --results-dir. may be repeated."`
+	Apply        *string  `arg:"--apply" help:"path to a unified diff or git-format patch to apply in each repository instead of running COMMAND."`
+	Fuzz         int      `arg:"--fuzz" default:"0" help:"number of context lines at either end of a hunk of APPLY that may be ignored to apply it."`
+	ThreeWay     bool     `arg:"--three-way" help:"enable to fall back to a three-way merge for files APPLY does not apply to, if the original file is in the repository history."`
+	Sync         *string  `arg:"--sync" help:"path to a YAML manifest of files to keep in sync, to reconcile in each repository instead of running COMMAND. repositories that differ are reported as drifted, or fixed with --commit."`
+	Set          []string `arg:"--set,separate" help:"edit to make in each repository instead of running COMMAND, as FILE:PATH=VALUE: sets the value at PATH in the JSON or YAML FILE, if it exists, keeping its formatting and comments. PATH is keys separated by dots, with [N] for array elements, and VALUE is YAML. may be repeated."`
+	Append       []string `arg:"--append,separate" help:"edit as FILE:PATH=VALUE appending VALUE to the array at PATH, made after every --set. may be repeated."`
+	Delete       []string `arg:"--delete,separate" help:"edit as FILE:PATH deleting the value at PATH, made after every --set and --append. may be repeated."`
+	API          bool     `arg:"--api" help:"enable to edit files through the GitHub API instead of cloning each repository: EDIT files are passed through COMMAND, or the files of SYNC reconciled, and with --push commits are made directly on BRANCH."`
+	Edit         []string `arg:"--edit,separate" help:"path of a file to pass through COMMAND with --api: COMMAND reads it on stdin, with GHFOREACH_PATH and GHFOREACH_REPOSITORY set, and its stdout replaces it. may be repeated."`
+	Diff         bool     `arg:"--diff" help:"enable to capture the changes COMMAND makes to each clone as a unified diff. repositories where it changes nothing are reported as no-ops."`
+	Patch        *string  `arg:"--patch" help:"path to write the diffs of every repository to as a single patch file. implies --diff."`
+	Commit       *string  `arg:"--commit" help:"commit message for the changes COMMAND makes in each repository, committed to BRANCH. implies --diff."`
+	Branch       string   `arg:"--branch" default:"ghforeach" help:"branch changes are committed and pushed to."`
+	Author       *string  `arg:"--author" help:"commit author as NAME <EMAIL>. defaults to the author in git config."`
+	Push         bool     `arg:"--push" help:"enable to push BRANCH to each repository with changes. requires --commit."`
+	Force        bool     `arg:"--force" help:"enable to force-push BRANCH, replacing it where it already exists with other commits. requires --push."`
+	PullRequest  bool     `arg:"--pull-request" help:"enable to open a pull request from BRANCH into the default branch, titled with the first line of the commit message. implies --push."`
+	Review       bool     `arg:"--review" help:"enable to review the changes in each repository before they are committed: approve, skip, edit, open a shell or abort. requires --commit."`
+	Decisions    *string  `arg:"--decisions" help:"path to a file of review decisions. with --review, decisions are saved to it. without, only the changes it approves are committed, and only if unchanged since review."`
+	Report       []string `arg:"--report,separate" help:"path to write a report of the run to, as Markdown (.md) or HTML (.html). may be repeated."`
+	Json         bool     `arg:"-j" help:"enable to display output as JSON."`
+	Format       *string  `arg:"--format" help:"output format: console, json, junit or csv. --json is short for --format json."`
+	Debug        bool     `arg:"-D" help:"enable to debug logging."`
 }
 
 func Run() error {
@@ -78,7 +157,50 @@ func RunWithArgs(args *Args) error {
 	}
 	defer logger.Sync()
 
-	client := github.NewClient(nil)
+	format := ConsoleOutputFormat
+	if args.Format != nil {
+		f, err := ParseOutputFormat(*args.Format)
+		if err != nil {
+			return err
+		}
+		format = f
+	}
+	if args.Json {
+		if args.Format != nil && format != JsonOutputFormat {
+			return fmt.Errorf("--json conflicts with --format %s", *args.Format)
+		}
+		format = JsonOutputFormat
+	}
+
+	// show progress on a terminal, unless the output is meant for a program
+	var dash *dashboard
+	if !args.NoProgress && !args.Review && format == ConsoleOutputFormat && term.IsTerminal(int(os.Stdout.Fd())) {
+		dash = newDashboard(os.Stdout, func() int {
+			width, _, _ := term.GetSize(int(os.Stdout.Fd()))
+			return width
+		})
+		encoder := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+		if args.Debug {
+			encoder = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+		}
+		// logs are printed above the progress rather than through it
+		logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return zapcore.NewCore(encoder, dash, core)
+		}))
+	}
+
+	cacheDir := defaultCacheDir()
+	if args.CacheDir != nil {
+		cacheDir = *args.CacheDir
+	}
+	if !args.APICache && (args.CacheTTL != 0 || args.Refresh) {
+		return fmt.Errorf("--cache-ttl and --refresh require --api-cache")
+	}
+	var httpClient *http.Client
+	if args.APICache && cacheDir != "" {
+		httpClient = NewHTTPCacheClient(cacheDir, args.CacheTTL, args.Refresh)
+	}
+	client := github.NewClient(httpClient)
 	if args.AuthToken != nil {
 		logger.Debug("reading GH_AUTH_TOKEN token from env")
 		client = client.WithAuthToken(*args.AuthToken)
@@ -91,52 +213,273 @@ func RunWithArgs(args *Args) error {
 		WithLogger(logger),
 		WithCleanup(args.Cleanup),
 		WithOverwrite(args.Overwrite),
+		WithResume(args.Resume),
 		WithConcurrency(args.NThreads),
+		WithCloneConcurrency(args.CloneThreads),
+		WithAPIConcurrency(args.APIThreads),
 		WithTmpDir(args.TmpDir),
 		WithShellPath(args.Shell),
+		WithAPIRetryPolicy(retryPolicy(args.APIRetries, args)),
+		WithCloneRetryPolicy(retryPolicy(args.CloneRetries, args)),
+		WithCommandRetryPolicy(retryPolicy(args.CommandRetries, args)),
 	}
 
 	if args.AuthUser != nil && args.AuthToken != nil {
 		opts = append(opts, WithUserAuth(*args.AuthToken, *args.AuthToken))
 	}
-	if args.Org != nil {
-		opts = append(opts, WithOrg(*args.Org))
+	for _, org := range args.Org {
+		opts = append(opts, WithOrg(org))
+	}
+	for _, user := range args.User {
+		opts = append(opts, WithUser(user))
+	}
+	for _, nameExp := range args.NameExp {
+		opts = append(opts, WithNameRegexp(nameExp))
 	}
-	if args.User != nil {
-		opts = append(opts, WithUser(*args.User))
+	for _, topicExp := range args.TopicExp {
+		opts = append(opts, WithTopicRegexp(topicExp))
 	}
-	if args.NameExp != nil {
-		opts = append(opts, WithNameRegexp(*args.NameExp))
+	nameMatch, err := ParseMatchMode(args.NameMatch)
+	if err != nil {
+		return err
 	}
-	if args.TopicExp != nil {
-		opts = append(opts, WithTopicRegexp(*args.TopicExp))
+	topicMatch, err := ParseMatchMode(args.TopicMatch)
+	if err != nil {
+		return err
 	}
+	opts = append(opts,
+		WithNameMatchMode(nameMatch),
+		WithTopicMatchMode(topicMatch),
+		WithTopicMinCount(args.TopicMin),
+	)
 	if args.NameList != nil {
-		bytes, err := os.ReadFile(*args.NameList)
+		nameList, err := readList(*args.NameList)
 		if err != nil {
 			return err
 		}
-		nameList := strings.Split(string(bytes), "\n")
 		opts = append(opts, WithNameList(nameList))
 	}
 	if args.TopicList != nil {
-		bytes, err := os.ReadFile(*args.TopicList)
+		topicList, err := readList(*args.TopicList)
 		if err != nil {
 			return err
 		}
-		topicList := strings.Split(string(bytes), "\n")
 		opts = append(opts, WithTopicList(topicList))
 	}
-	if args.Json {
-		opts = append(opts, WithOutputFormat(JsonOutputFormat))
+	if args.ExcludeNameExp != nil {
+		opts = append(opts, WithExcludeNameRegexp(*args.ExcludeNameExp))
+	}
+	if args.ExcludeTopicExp != nil {
+		opts = append(opts, WithExcludeTopicRegexp(*args.ExcludeTopicExp))
+	}
+	if args.ExcludeNameList != nil {
+		nameList, err := readList(*args.ExcludeNameList)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, WithExcludeNameList(nameList))
+	}
+	if args.ExcludeTopicList != nil {
+		topicList, err := readList(*args.ExcludeTopicList)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, WithExcludeTopicList(topicList))
+	}
+	archived, err := ParseAttributeFilter(args.Archived)
+	if err != nil {
+		return err
+	}
+	forks, err := ParseAttributeFilter(args.Forks)
+	if err != nil {
+		return err
+	}
+	templates, err := ParseAttributeFilter(args.Templates)
+	if err != nil {
+		return err
+	}
+	opts = append(opts,
+		WithArchived(archived),
+		WithForks(forks),
+		WithTemplates(templates),
+		WithSizeRange(args.MinSize, args.MaxSize),
+	)
+	if len(args.Visibility) > 0 {
+		opts = append(opts, WithVisibility(args.Visibility))
+	}
+	if len(args.Language) > 0 {
+		opts = append(opts, WithLanguages(args.Language))
+	}
+	if args.PushedSince != nil {
+		pushedSince, err := ParsePushedSince(*args.PushedSince, time.Now())
+		if err != nil {
+			return err
+		}
+		opts = append(opts, WithPushedSince(pushedSince))
+	}
+	if args.DefaultBranch != nil {
+		opts = append(opts, WithDefaultBranch(*args.DefaultBranch))
+	}
+	for _, property := range args.Property {
+		opts = append(opts, WithProperty(property))
+	}
+	for _, p := range args.HasPath {
+		opts = append(opts, WithPathExists(p))
+	}
+	for _, p := range args.MissingPath {
+		opts = append(opts, WithPathMissing(p))
+	}
+	for _, pathMatches := range args.PathMatches {
+		p, exp, ok := strings.Cut(pathMatches, "=")
+		if !ok {
+			return fmt.Errorf("invalid --path-matches %q: expected PATH=REGEXP", pathMatches)
+		}
+		opts = append(opts, WithPathContentRegexp(p, exp))
+	}
+	if args.CacheDir != nil {
+		opts = append(opts, WithCacheDir(cacheDir))
+	}
+	if args.If != nil {
+		opts = append(opts, WithPrecondition(*args.If))
+	}
+	for _, where := range args.Where {
+		opts = append(opts, WithWhere(where))
+	}
+	opts = append(opts, WithOutputFormat(format))
+	if args.ResultsDir != nil {
+		opts = append(opts, WithResultsDir(*args.ResultsDir))
+	}
+	for _, artifact := range args.Artifact {
+		opts = append(opts, WithArtifactGlob(artifact))
+	}
+	if args.Apply != nil {
+		bytes, err := os.ReadFile(*args.Apply)
+		if err != nil {
+			return err
+		}
+		patch, err := ParsePatch(*args.Apply, bytes)
+		if err != nil {
+			return fmt.Errorf("parsing patch %s: %w", *args.Apply, err)
+		}
+		opts = append(opts, WithApplyPatch(patch), WithPatchFuzz(args.Fuzz), WithThreeWay(args.ThreeWay))
+	}
+	if args.Sync != nil {
+		manifest, err := ReadSyncManifest(*args.Sync)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, WithSyncManifest(manifest))
+	}
+	for _, edits := range []struct {
+		op    EditOperation
+		specs []string
+	}{
+		{SetEditOperation, args.Set},
+		{AppendEditOperation, args.Append},
+		{DeleteEditOperation, args.Delete},
+	} {
+		for _, spec := range edits.specs {
+			edit, err := ParseFileEdit(edits.op, spec)
+			if err != nil {
+				return err
+			}
+			opts = append(opts, WithFileEdit(edit))
+		}
+	}
+	if args.API {
+		opts = append(opts, WithAPIEdit(true))
+	}
+	for _, p := range args.Edit {
+		opts = append(opts, WithEditPath(p))
+	}
+	if args.Diff {
+		opts = append(opts, WithDiff(true))
+	}
+	if args.Patch != nil {
+		opts = append(opts, WithPatchFile(*args.Patch))
+	}
+	if args.Commit != nil {
+		opts = append(opts, WithCommitMessage(*args.Commit), WithBranch(args.Branch))
+	}
+	if args.Author != nil {
+		author, err := mail.ParseAddress(*args.Author)
+		if err != nil {
+			return fmt.Errorf("invalid author %q: %w", *args.Author, err)
+		}
+		opts = append(opts, WithCommitAuthor(author.Name, author.Address))
+	}
+	opts = append(opts, WithPush(args.Push), WithForcePush(args.Force), WithPullRequest(args.PullRequest))
+	if args.Review {
+		// keep machine-readable output on stdout parseable
+		out := os.Stdout
+		if format != ConsoleOutputFormat {
+			out = os.Stderr
+		}
+		opts = append(opts, WithReview(os.Stdin, out))
+	}
+	if args.Decisions != nil {
+		opts = append(opts, WithDecisionsFile(*args.Decisions))
+	}
+	for _, report := range args.Report {
+		format, err := ParseReportFormat(report)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, WithReport(report, format))
+	}
+	if args.Stream {
+		// keep machine-readable output on stdout parseable
+		out := os.Stdout
+		if format != ConsoleOutputFormat {
+			out = os.Stderr
+		}
+		var w io.Writer = out
+		if dash != nil && out == os.Stdout {
+			w = dash
+		}
+		opts = append(opts, WithStreamOutput(w, useColor(out)))
+	}
+	if dash != nil {
+		opts = append(opts, WithOutput(dash), WithStatusListener(dash.handle))
 	}
 
 	handler, err := NewRepositoryExecutor(opts...)
 	if err != nil {
 		return err
 	}
-	if len(args.Command) == 0 {
+	edits := len(args.Set) + len(args.Append) + len(args.Delete)
+	if len(args.Command) == 0 && args.Apply == nil && args.Sync == nil && edits == 0 {
 		return fmt.Errorf("no command provided")
 	}
+	if dash != nil {
+		dash.start()
+		defer dash.Close()
+	}
 	return handler.Go(ctx, args.Command)
 }
+
+// readList reads a newline separated list from the file at path.
+func readList(path string) ([]string, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(bytes), "\n"), nil
+}
+
+// useColor reports whether f is a terminal that should be written in color.
+// Color is disabled by setting NO_COLOR.
+func useColor(f *os.File) bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// retryPolicy builds a retry policy from the shared backoff arguments.
+func retryPolicy(retries int, args *Args) RetryPolicy {
+	policy := DefaultRetryPolicy(retries)
+	policy.InitialBackoff = args.RetryBackoff
+	policy.MaxBackoff = args.RetryMaxBackoff
+	return policy
+}
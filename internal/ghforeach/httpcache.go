@@ -0,0 +1,236 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// HTTPCache is an http.RoundTripper that persists successful GET responses
+// in Dir and revalidates them with conditional requests, so that unchanged
+// listings cost neither transfer nor, on GitHub, rate limit. Responses
+// younger than TTL are served without contacting the server at all.
+type HTTPCache struct {
+	// Dir is the directory holding cached responses.
+	Dir string
+	// TTL is how long a cached response is used without revalidation. Zero
+	// revalidates every response.
+	TTL time.Duration
+	// Refresh bypasses cached responses, fetching and storing fresh ones.
+	Refresh bool
+	// Cacheable reports whether the response to a GET request is cached.
+	// Every one is if nil.
+	Cacheable func(req *http.Request) bool
+	// Transport makes the underlying requests. http.DefaultTransport is used
+	// if nil.
+	Transport http.RoundTripper
+}
+
+// NewHTTPCacheClient returns an http.Client caching repository listings in
+// dir. Other responses, such as branches, pull requests and file contents,
+// are never cached, since a stale one would be acted on.
+func NewHTTPCacheClient(dir string, ttl time.Duration, refresh bool) *http.Client {
+	return &http.Client{Transport: &HTTPCache{Dir: dir, TTL: ttl, Refresh: refresh, Cacheable: isListingRequest}}
+}
+
+// isListingRequest reports whether req gets repositories of an organization,
+// a user or the authenticated user, or a repository by name.
+func isListingRequest(req *http.Request) bool {
+	// GitHub Enterprise Server serves the API under /api/v3
+	p := strings.TrimPrefix(req.URL.Path, "/api/v3")
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+	switch len(segments) {
+	case 2:
+		return segments[0] == "user" && segments[1] == "repos"
+	case 3:
+		return segments[0] == "repos" || (segments[0] == "orgs" || segments[0] == "users") && segments[2] == "repos"
+	}
+	return false
+}
+
+// cachedResponse is a response as stored on disk.
+type cachedResponse struct {
+	URL        string      `json:"url"`
+	StoredAt   time.Time   `json:"stored_at"`
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// rateLimitHeaders describe the rate limit at the time of a response. They
+// are not stored, so that a response served from the cache does not report a
+// stale limit.
+var rateLimitHeaders = []string{
+	"X-Ratelimit-Limit",
+	"X-Ratelimit-Remaining",
+	"X-Ratelimit-Used",
+	"X-Ratelimit-Reset",
+	"X-Ratelimit-Resource",
+}
+
+func (c *HTTPCache) transport() http.RoundTripper {
+	if c.Transport != nil {
+		return c.Transport
+	}
+	return http.DefaultTransport
+}
+
+// key identifies a request. Responses vary by credentials and media type, so
+// both are part of it.
+func (c *HTTPCache) key(req *http.Request) string {
+	h := sha256.New()
+	for _, s := range []string{req.Method, req.URL.String(), req.Header.Get("Authorization"), req.Header.Get("Accept")} {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *HTTPCache) path(key string) string {
+	return path.Join(c.Dir, "http", key[:2], key+".json")
+}
+
+func (c *HTTPCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet || req.Header.Get("Range") != "" || (c.Cacheable != nil && !c.Cacheable(req)) {
+		return c.transport().RoundTrip(req)
+	}
+	key := c.key(req)
+	var cached *cachedResponse
+	if !c.Refresh {
+		cached = c.load(key)
+	}
+	if cached != nil && c.TTL > 0 && time.Since(cached.StoredAt) < c.TTL {
+		return cached.response(req), nil
+	}
+
+	outReq := req
+	if cached != nil {
+		outReq = req.Clone(req.Context())
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			outReq.Header.Set("If-None-Match", etag)
+		}
+		if lastModified := cached.Header.Get("Last-Modified"); lastModified != "" {
+			outReq.Header.Set("If-Modified-Since", lastModified)
+		}
+	}
+	resp, err := c.transport().RoundTrip(outReq)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		resp.Body.Close()
+		for name, values := range resp.Header {
+			cached.Header[name] = values
+		}
+		cached.StoredAt = time.Now()
+		c.store(key, cached)
+		return cached.response(req), nil
+	case resp.StatusCode == http.StatusOK && (resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""):
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		c.store(key, &cachedResponse{
+			URL:        req.URL.String(),
+			StoredAt:   time.Now(),
+			StatusCode: resp.StatusCode,
+			Header:     resp.Header.Clone(),
+			Body:       body,
+		})
+	}
+	return resp, nil
+}
+
+// load returns the cached response for key, or nil if there is none or it
+// cannot be read.
+func (c *HTTPCache) load(key string) *cachedResponse {
+	bytes, err := os.ReadFile(c.path(key))
+	if err != nil {
+		return nil
+	}
+	cached := &cachedResponse{}
+	if err := json.Unmarshal(bytes, cached); err != nil {
+		return nil
+	}
+	return cached
+}
+
+// store writes cached for key, without its rate limit headers. The cache is
+// best effort, so failures are ignored.
+func (c *HTTPCache) store(key string, cached *cachedResponse) {
+	stored := *cached
+	stored.Header = cached.Header.Clone()
+	for _, name := range rateLimitHeaders {
+		stored.Header.Del(name)
+	}
+	bytes, err := json.Marshal(&stored)
+	if err != nil {
+		return
+	}
+	p := c.path(key)
+	if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+		return
+	}
+	// write then rename so concurrent readers never see a partial entry
+	tmp, err := os.CreateTemp(path.Dir(p), ".tmp-*")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(bytes)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// response rebuilds an http.Response for req from the cache.
+func (cr *cachedResponse) response(req *http.Request) *http.Response {
+	header := cr.Header.Clone()
+	header.Del("Content-Length")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", cr.StatusCode, http.StatusText(cr.StatusCode)),
+		StatusCode:    cr.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(cr.Body)),
+		ContentLength: int64(len(cr.Body)),
+		Request:       req,
+	}
+}
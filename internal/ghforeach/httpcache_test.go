@@ -0,0 +1,208 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHTTPCache(t *testing.T) {
+	var requests, notModified int
+	body := "v1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		etag := fmt.Sprintf("%q", body)
+		w.Header().Set("X-RateLimit-Remaining", fmt.Sprint(100-requests))
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	get := func(cache *HTTPCache) (string, http.Header) {
+		t.Helper()
+		resp, err := (&http.Client{Transport: cache}).Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", resp.StatusCode)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b), resp.Header
+	}
+
+	// the first request fills the cache and the second is revalidated
+	cache := &HTTPCache{Dir: dir}
+	if got, _ := get(cache); got != "v1" {
+		t.Errorf("expected v1, got %q", got)
+	}
+	got, header := get(cache)
+	if got != "v1" || notModified != 1 {
+		t.Errorf("expected v1 after 1 revalidation, got %q after %d", got, notModified)
+	}
+	if remaining := header.Get("X-RateLimit-Remaining"); remaining != "98" {
+		t.Errorf("expected current rate limit on revalidated response, got %q", remaining)
+	}
+
+	// within the TTL nothing is requested, and the stale rate limit is dropped
+	cache = &HTTPCache{Dir: dir, TTL: time.Hour}
+	got, header = get(cache)
+	if got != "v1" || requests != 2 {
+		t.Errorf("expected cached v1 without a request, got %q after %d requests", got, requests)
+	}
+	if remaining := header.Get("X-RateLimit-Remaining"); remaining != "" {
+		t.Errorf("expected no rate limit on cached response, got %q", remaining)
+	}
+
+	// a change is picked up on revalidation
+	body = "v2"
+	if got, _ := get(&HTTPCache{Dir: dir}); got != "v2" {
+		t.Errorf("expected v2, got %q", got)
+	}
+
+	// refreshing bypasses the cache entirely
+	before := notModified
+	if got, _ := get(&HTTPCache{Dir: dir, TTL: time.Hour, Refresh: true}); got != "v2" || notModified != before {
+		t.Errorf("expected unconditional v2, got %q after %d revalidations", got, notModified-before)
+	}
+
+	// responses that are not cacheable are always requested
+	before = requests
+	uncached := &HTTPCache{Dir: dir, TTL: time.Hour, Cacheable: func(*http.Request) bool { return false }}
+	body = "v3"
+	if got, _ := get(uncached); got != "v3" || requests != before+1 {
+		t.Errorf("expected v3 to be requested, got %q after %d requests", got, requests-before)
+	}
+}
+
+func TestHTTPCache_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		// storedAge is the age of the cached response, or 0 if there is none.
+		storedAge time.Duration
+		cache     HTTPCache
+		method    string
+		header    http.Header
+		// modified makes the server answer conditional requests in full.
+		modified    bool
+		conditional bool
+		requested   bool
+		expected    string
+	}{
+		{"nothing cached", 0, HTTPCache{}, http.MethodGet, nil, false, false, true, "fresh"},
+		{"revalidated", time.Minute, HTTPCache{}, http.MethodGet, nil, false, true, true, "cached"},
+		{"changed", time.Minute, HTTPCache{}, http.MethodGet, nil, true, true, true, "fresh"},
+		{"within ttl", time.Minute, HTTPCache{TTL: time.Hour}, http.MethodGet, nil, false, false, false, "cached"},
+		{"past ttl", 2 * time.Hour, HTTPCache{TTL: time.Hour}, http.MethodGet, nil, false, true, true, "cached"},
+		{"refresh", time.Minute, HTTPCache{TTL: time.Hour, Refresh: true}, http.MethodGet, nil, false, false, true, "fresh"},
+		{"not cacheable", time.Minute, HTTPCache{TTL: time.Hour, Cacheable: func(*http.Request) bool { return false }}, http.MethodGet, nil, false, false, true, "fresh"},
+		{"range", time.Minute, HTTPCache{TTL: time.Hour}, http.MethodGet, http.Header{"Range": {"bytes=0-1"}}, false, false, true, "fresh"},
+		{"post", time.Minute, HTTPCache{TTL: time.Hour}, http.MethodPost, nil, false, false, true, "fresh"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requested, conditional := false, false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requested = true
+				conditional = r.Header.Get("If-None-Match") != ""
+				if conditional && !test.modified {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", `"fresh"`)
+				fmt.Fprint(w, "fresh")
+			}))
+			defer server.Close()
+
+			cache := test.cache
+			cache.Dir = t.TempDir()
+			req, err := http.NewRequest(test.method, server.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, values := range test.header {
+				req.Header[name] = values
+			}
+			if test.storedAge > 0 {
+				cache.store(cache.key(req), &cachedResponse{
+					URL:        server.URL,
+					StoredAt:   time.Now().Add(-test.storedAge),
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Etag": {`"cached"`}},
+					Body:       []byte("cached"),
+				})
+			}
+
+			resp, err := (&http.Client{Transport: &cache}).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != test.expected || requested != test.requested || conditional != test.conditional {
+				t.Errorf("expected %q (requested %t, conditional %t), got %q (requested %t, conditional %t)",
+					test.expected, test.requested, test.conditional, body, requested, conditional)
+			}
+		})
+	}
+}
+
+func TestIsListingRequest(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected bool
+	}{
+		{"https://api.github.com/orgs/org/repos?per_page=100", true},
+		{"https://api.github.com/users/user/repos", true},
+		{"https://api.github.com/user/repos", true},
+		{"https://api.github.com/repos/org/a", true},
+		{"https://github.example.com/api/v3/orgs/org/repos", true},
+		{"https://api.github.com/repos/org/a/git/ref/heads/ghforeach", false},
+		{"https://api.github.com/repos/org/a/pulls?state=open", false},
+		{"https://api.github.com/repos/org/a/contents/VERSION", false},
+		{"https://api.github.com/repos/org/a/properties/values", false},
+		{"https://api.github.com/user", false},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isListingRequest(req); got != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.url, test.expected, got)
+		}
+	}
+}
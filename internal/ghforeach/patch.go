@@ -0,0 +1,679 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"go.uber.org/zap"
+)
+
+// patchSectionPrefix begins the line naming the repository of each diff in
+// a patch file written by WithPatchFile.
+const patchSectionPrefix = "ghforeach: "
+
+var hunkHeaderRegexp = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// WithApplyPatch applies patch in each clone instead of running a command.
+// Repositories where it does not apply fail, with the rejected hunks in
+// their result. It implies WithDiff.
+func WithApplyPatch(patch *Patch) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.applyPatch = patch
+		fre.captureDiff = true
+		return nil
+	}
+}
+
+// WithPatchFuzz sets the number of context lines at either end of a hunk
+// that may be ignored to apply it to a file that has drifted from the one it
+// was made from, as with patch -F. It defaults to 0.
+func WithPatchFuzz(n int) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		if n < 0 {
+			return fmt.Errorf("patch fuzz must not be negative")
+		}
+		fre.patchFuzz = n
+		return nil
+	}
+}
+
+// WithThreeWay falls back to a three-way merge for files whose hunks do not
+// apply, when the version of the file the patch was made from is in the
+// history of the clone, as with git apply --3way. Files that merge with
+// conflicts are rejected.
+func WithThreeWay(b bool) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.threeWay = b
+		return nil
+	}
+}
+
+// Patch is a unified diff or git-format patch to apply to each clone.
+type Patch struct {
+	name  string
+	files []*patchFile
+	// sectioned is set if the patch was written by WithPatchFile, so that
+	// each repository is only given its own changes.
+	sectioned bool
+}
+
+// patchFile is the changes to a file in a patch.
+type patchFile struct {
+	repository string
+	// oldPath and newPath are empty for created and deleted files.
+	oldPath, newPath string
+	// oldHash is the (possibly abbreviated) hash of the file the patch was
+	// made from, if known.
+	oldHash string
+	// newMode is the permissions the file is given, if the patch sets them.
+	newMode os.FileMode
+	binary  bool
+	header  []string
+	// sawPaths is set once the ---/+++ lines have been read.
+	sawPaths bool
+	hunks    []*patchHunk
+}
+
+type patchHunk struct {
+	oldStart, newStart int
+	old, new           []string
+	// lead and trail count the context lines at either end.
+	lead, trail int
+	// oldNoEOL and newNoEOL are set if that side ends without a newline.
+	oldNoEOL, newNoEOL bool
+	raw                []string
+}
+
+// ParsePatch parses a unified diff or git-format patch, including patch
+// files written by WithPatchFile. Text around the diffs, such as the headers
+// of git format-patch, is ignored. name identifies the patch in results.
+func ParsePatch(name string, data []byte) (*Patch, error) {
+	patch := &Patch{name: name}
+	lines := strings.Split(string(data), "\n")
+	section := ""
+	var file *patchFile
+	newFile := func(header ...string) {
+		file = &patchFile{repository: section, header: header}
+		patch.files = append(patch.files, file)
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, patchSectionPrefix):
+			section = strings.TrimSpace(strings.TrimPrefix(line, patchSectionPrefix))
+			patch.sectioned = true
+			file = nil
+		case strings.HasPrefix(line, "diff --git "):
+			newFile(line)
+			file.oldPath, file.newPath = parseGitDiffPaths(strings.TrimPrefix(line, "diff --git "))
+		case file != nil && !file.sawPaths && len(file.hunks) == 0 && isExtendedHeader(line):
+			file.header = append(file.header, line)
+			switch {
+			case strings.HasPrefix(line, "index "):
+				hashes, _, _ := strings.Cut(strings.TrimPrefix(line, "index "), " ")
+				if old, _, ok := strings.Cut(hashes, ".."); ok && strings.Trim(old, "0") != "" {
+					file.oldHash = old
+				}
+			case strings.HasPrefix(line, "new file mode "):
+				file.oldPath = ""
+				file.newMode = parseFileMode(strings.TrimPrefix(line, "new file mode "))
+			case strings.HasPrefix(line, "new mode "):
+				file.newMode = parseFileMode(strings.TrimPrefix(line, "new mode "))
+			case strings.HasPrefix(line, "deleted file mode"):
+				file.newPath = ""
+			case strings.HasPrefix(line, "rename from "):
+				file.oldPath = strings.TrimPrefix(line, "rename from ")
+			case strings.HasPrefix(line, "rename to "):
+				file.newPath = strings.TrimPrefix(line, "rename to ")
+			case strings.HasPrefix(line, "Binary files "), strings.HasPrefix(line, "GIT binary patch"):
+				file.binary = true
+			}
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			if file == nil || file.sawPaths || len(file.hunks) > 0 {
+				newFile()
+			}
+			file.header = append(file.header, line, lines[i+1])
+			file.oldPath = parsePatchPath(strings.TrimPrefix(line, "--- "), "a/")
+			file.newPath = parsePatchPath(strings.TrimPrefix(lines[i+1], "+++ "), "b/")
+			file.sawPaths = true
+			i++
+		case file != nil && hunkHeaderRegexp.MatchString(line):
+			hunk, n, err := parseHunk(lines[i:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			file.hunks = append(file.hunks, hunk)
+			i += n - 1
+		}
+	}
+	if len(patch.files) == 0 {
+		return nil, fmt.Errorf("no changes found in patch")
+	}
+	// the paths are joined to each clone, so none may lead out of it
+	for _, file := range patch.files {
+		for _, p := range []*string{&file.oldPath, &file.newPath} {
+			if *p == "" {
+				continue
+			}
+			clean, ok := cleanRepoPath(*p)
+			if !ok {
+				return nil, fmt.Errorf("invalid path %q in patch", *p)
+			}
+			*p = clean
+		}
+	}
+	return patch, nil
+}
+
+// parseFileMode returns the permissions of a git file mode such as 100755,
+// or 0 for modes without any, such as those of symlinks.
+func parseFileMode(s string) os.FileMode {
+	mode, err := strconv.ParseUint(strings.TrimSpace(s), 8, 32)
+	if err != nil {
+		return 0
+	}
+	return os.FileMode(mode) & os.ModePerm
+}
+
+func isExtendedHeader(line string) bool {
+	for _, prefix := range []string{"index ", "new file mode", "deleted file mode", "old mode", "new mode",
+		"similarity index", "dissimilarity index", "rename from ", "rename to ", "copy from ", "copy to ",
+		"Binary files ", "GIT binary patch"} {
+		if strings.HasPrefix(line, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGitDiffPaths returns the paths of a diff --git line, without their
+// a/ and b/ prefixes.
+func parseGitDiffPaths(s string) (string, string) {
+	if i := strings.Index(s, " b/"); strings.HasPrefix(s, "a/") && i >= 0 {
+		return s[2:i], s[i+3:]
+	}
+	return "", ""
+}
+
+// parsePatchPath parses the path of a ---/+++ line, removing any timestamp
+// and the a/ or b/ prefix. /dev/null is returned as "".
+func parsePatchPath(s, prefix string) string {
+	s, _, _ = strings.Cut(s, "\t")
+	s = strings.TrimSpace(s)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	if s == "/dev/null" {
+		return ""
+	}
+	return strings.TrimPrefix(s, prefix)
+}
+
+// parseHunk parses the hunk at the start of lines, returning the number of
+// lines it spans.
+func parseHunk(lines []string) (*patchHunk, int, error) {
+	m := hunkHeaderRegexp.FindStringSubmatch(lines[0])
+	count := func(s string) int {
+		if s == "" {
+			return 1
+		}
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	hunk := &patchHunk{raw: []string{lines[0]}}
+	hunk.oldStart, _ = strconv.Atoi(m[1])
+	hunk.newStart, _ = strconv.Atoi(m[3])
+	oldLeft, newLeft := count(m[2]), count(m[4])
+
+	i := 1
+	var last byte
+	seenChange := false
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if strings.HasPrefix(line, `\`) {
+			// "\ No newline at end of file" applies to the line before
+			switch last {
+			case ' ':
+				hunk.oldNoEOL, hunk.newNoEOL = true, true
+			case '-':
+				hunk.oldNoEOL = true
+			case '+':
+				hunk.newNoEOL = true
+			}
+			hunk.raw = append(hunk.raw, line)
+			continue
+		}
+		if oldLeft == 0 && newLeft == 0 {
+			break
+		}
+		kind := byte(' ')
+		if line != "" {
+			kind = line[0]
+			line = line[1:]
+		}
+		switch kind {
+		case ' ':
+			hunk.old = append(hunk.old, line)
+			hunk.new = append(hunk.new, line)
+			oldLeft--
+			newLeft--
+			if seenChange {
+				hunk.trail++
+			} else {
+				hunk.lead++
+			}
+		case '-':
+			hunk.old = append(hunk.old, line)
+			oldLeft--
+			seenChange, hunk.trail = true, 0
+		case '+':
+			hunk.new = append(hunk.new, line)
+			newLeft--
+			seenChange, hunk.trail = true, 0
+		default:
+			return nil, 0, fmt.Errorf("malformed hunk line %q", lines[i])
+		}
+		if oldLeft < 0 || newLeft < 0 {
+			return nil, 0, fmt.Errorf("hunk %q is longer than its header", lines[0])
+		}
+		last = kind
+		hunk.raw = append(hunk.raw, lines[i])
+	}
+	if oldLeft > 0 || newLeft > 0 {
+		return nil, 0, fmt.Errorf("hunk %q is truncated", lines[0])
+	}
+	return hunk, i, nil
+}
+
+// filesFor returns the changes of the patch for repository.
+func (p *Patch) filesFor(repository string) []*patchFile {
+	if !p.sectioned {
+		return p.files
+	}
+	files := []*patchFile{}
+	for _, file := range p.files {
+		if file.repository == repository {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// patchedFile is the outcome of applying the changes to a file.
+type patchedFile struct {
+	path    string
+	content string
+	// mode is the permissions to give the file, if not those it has.
+	mode os.FileMode
+	// remove is set if path is deleted rather than written.
+	remove bool
+}
+
+// applyPatchTo applies the patch to the clone of result. Nothing is written
+// unless every hunk applies; otherwise the rejected hunks are recorded in
+// result.
+func (rh *RepositoryExecutor) applyPatchTo(result *executionResult) error {
+	dir := result.Path
+	var repo *git.Repository
+	outcomes := []patchedFile{}
+	rejects := &strings.Builder{}
+	rejected, total := 0, 0
+	for _, file := range rh.applyPatch.filesFor(result.Repository) {
+		total += len(file.hunks)
+		reject := func(reason string, hunks []*patchHunk) {
+			rejected += max(len(hunks), 1)
+			fmt.Fprintf(rejects, "# %s\n%s\n", reason, strings.Join(file.header, "\n"))
+			for _, hunk := range hunks {
+				fmt.Fprintf(rejects, "%s\n", strings.Join(hunk.raw, "\n"))
+			}
+		}
+		if file.binary {
+			reject("binary patches are not supported", nil)
+			continue
+		}
+
+		var content string
+		if file.oldPath == "" {
+			if _, err := os.Lstat(path.Join(dir, file.newPath)); err == nil {
+				reject(file.newPath+" already exists", file.hunks)
+				continue
+			}
+		} else {
+			bytes, err := os.ReadFile(path.Join(dir, file.oldPath))
+			if errors.Is(err, os.ErrNotExist) {
+				reject(file.oldPath+" does not exist", file.hunks)
+				continue
+			} else if err != nil {
+				return err
+			}
+			content = string(bytes)
+		}
+
+		patched, failed := applyHunks(content, file.hunks, rh.patchFuzz)
+		if len(failed) > 0 && rh.threeWay && file.oldHash != "" {
+			if repo == nil {
+				r, err := git.PlainOpen(dir)
+				if err != nil {
+					return err
+				}
+				repo = r
+			}
+			if merged, ok := mergePatch(repo, file, content); ok {
+				rh.logger.Debug("applied patch with three-way merge", zap.String("repository", result.Repository), zap.String("path", file.oldPath))
+				patched, failed = merged, nil
+			}
+		}
+		if len(failed) > 0 {
+			reject(fmt.Sprintf("%d of %d hunks rejected", len(failed), len(file.hunks)), failed)
+			continue
+		}
+
+		if file.newPath == "" {
+			outcomes = append(outcomes, patchedFile{path: file.oldPath, remove: true})
+			continue
+		}
+		outcomes = append(outcomes, patchedFile{path: file.newPath, content: patched, mode: file.newMode})
+		if file.oldPath != "" && file.oldPath != file.newPath {
+			outcomes = append(outcomes, patchedFile{path: file.oldPath, remove: true})
+		}
+	}
+	if rejects.Len() > 0 {
+		result.Rejects = rejects.String()
+		return fmt.Errorf("patch does not apply: %d of %d hunks rejected", rejected, max(total, rejected))
+	}
+
+	for _, outcome := range outcomes {
+		p := path.Join(dir, outcome.path)
+		if outcome.remove {
+			if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		mode := outcome.mode
+		if mode == 0 {
+			mode = 0644
+			if info, err := os.Stat(p); err == nil {
+				mode = info.Mode().Perm()
+			}
+		}
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, []byte(outcome.content), mode); err != nil {
+			return err
+		}
+		// the mode given to WriteFile only applies to new files
+		if err := os.Chmod(p, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyHunks applies hunks to content, ignoring up to fuzz context lines at
+// either end of a hunk that does not apply exactly. It returns the patched
+// content and the hunks that could not be applied.
+func applyHunks(content string, hunks []*patchHunk, fuzz int) (string, []*patchHunk) {
+	lines, noEOL := splitLines(content)
+	out := []string{}
+	failed := []*patchHunk{}
+	// pos is the next line of lines to copy, and offset how far hunks were
+	// found from where their headers put them.
+	pos, offset := 0, 0
+	for _, hunk := range hunks {
+		at, trim, ok := locateHunk(lines, hunk, pos, offset, fuzz)
+		if !ok {
+			failed = append(failed, hunk)
+			continue
+		}
+		old := len(hunk.old) - trim.lead - trim.trail
+		out = append(out, lines[pos:at]...)
+		out = append(out, hunk.new[trim.lead:len(hunk.new)-trim.trail]...)
+		pos = at + old
+		offset = at - hunk.expected(trim.lead)
+		if pos == len(lines) {
+			switch {
+			case hunk.newNoEOL:
+				noEOL = true
+			case hunk.oldNoEOL:
+				noEOL = false
+			}
+		}
+	}
+	out = append(out, lines[pos:]...)
+	return joinLines(out, noEOL), failed
+}
+
+type hunkTrim struct {
+	lead, trail int
+}
+
+// expected returns the index of lines at which the hunk should apply, with
+// lead context lines ignored, according to its header.
+func (h *patchHunk) expected(lead int) int {
+	if len(h.old) == 0 {
+		// a hunk without old lines inserts after line oldStart
+		return h.oldStart
+	}
+	return h.oldStart - 1 + lead
+}
+
+// locateHunk finds where hunk applies in lines at or after pos, searching
+// outward from where it is expected, with increasing fuzz.
+func locateHunk(lines []string, hunk *patchHunk, pos, offset, fuzz int) (int, hunkTrim, bool) {
+	for f := 0; f <= fuzz; f++ {
+		trim := hunkTrim{lead: min(f, hunk.lead), trail: min(f, hunk.trail)}
+		if f > 0 && trim.lead == 0 && trim.trail == 0 {
+			break
+		}
+		old := hunk.old[trim.lead : len(hunk.old)-trim.trail]
+		expected := hunk.expected(trim.lead) + offset
+		last := len(lines) - len(old)
+		if len(old) == 0 {
+			// nothing to match; only the expected position will do
+			if expected >= pos && expected <= len(lines) {
+				return expected, trim, true
+			}
+			continue
+		}
+		for d := 0; expected-d >= pos || expected+d <= last; d++ {
+			for _, at := range []int{expected - d, expected + d} {
+				if at >= pos && at <= last && slices.Equal(lines[at:at+len(old)], old) {
+					return at, trim, true
+				}
+			}
+		}
+	}
+	return 0, hunkTrim{}, false
+}
+
+// mergePatch applies the changes to file to the version it was made from,
+// found in the history of repo, and merges the result with content. It
+// reports whether that was possible without conflicts.
+func mergePatch(repo *git.Repository, file *patchFile, content string) (string, bool) {
+	base, ok := findBlob(repo, file.oldHash)
+	if !ok {
+		return "", false
+	}
+	theirs, failed := applyHunks(base, file.hunks, 0)
+	if len(failed) > 0 {
+		return "", false
+	}
+	return merge3(base, content, theirs)
+}
+
+// findBlob returns the contents of the blob whose hash begins with prefix.
+func findBlob(repo *git.Repository, prefix string) (string, bool) {
+	var blob *object.Blob
+	if len(prefix) == 40 {
+		b, err := repo.BlobObject(plumbing.NewHash(prefix))
+		if err != nil {
+			return "", false
+		}
+		blob = b
+	} else {
+		blobs, err := repo.BlobObjects()
+		if err != nil {
+			return "", false
+		}
+		defer blobs.Close()
+		for {
+			b, err := blobs.Next()
+			if err != nil {
+				break
+			}
+			if strings.HasPrefix(b.Hash.String(), prefix) {
+				if blob != nil {
+					// ambiguous
+					return "", false
+				}
+				blob = b
+			}
+		}
+		if blob == nil {
+			return "", false
+		}
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return "", false
+	}
+	defer reader.Close()
+	bytes, err := io.ReadAll(reader)
+	if err != nil {
+		return "", false
+	}
+	return string(bytes), true
+}
+
+// merge3 merges the changes from base to ours and from base to theirs line
+// by line, reporting false if they conflict.
+func merge3(base, ours, theirs string) (string, bool) {
+	baseLines, noEOL := splitLines(base)
+	ourLines, ourNoEOL := splitLines(ours)
+	theirLines, theirNoEOL := splitLines(theirs)
+	toOurs := matchLines(base, ours)
+	toTheirs := matchLines(base, theirs)
+
+	out := []string{}
+	b, o, t := 0, 0, 0
+	for {
+		// the next base line unchanged on both sides ends a chunk
+		k := b
+		for k < len(baseLines) && (toOurs[k] < 0 || toTheirs[k] < 0) {
+			k++
+		}
+		oEnd, tEnd := len(ourLines), len(theirLines)
+		if k < len(baseLines) {
+			oEnd, tEnd = toOurs[k], toTheirs[k]
+		}
+		baseChunk, ourChunk, theirChunk := baseLines[b:k], ourLines[o:oEnd], theirLines[t:tEnd]
+		switch {
+		case slices.Equal(ourChunk, baseChunk):
+			out = append(out, theirChunk...)
+		case slices.Equal(theirChunk, baseChunk), slices.Equal(ourChunk, theirChunk):
+			out = append(out, ourChunk...)
+		default:
+			return "", false
+		}
+		if k == len(baseLines) {
+			break
+		}
+		out = append(out, baseLines[k])
+		b, o, t = k+1, oEnd+1, tEnd+1
+	}
+	switch {
+	case ourNoEOL != noEOL:
+		noEOL = ourNoEOL
+	case theirNoEOL != noEOL:
+		noEOL = theirNoEOL
+	}
+	return joinLines(out, noEOL), true
+}
+
+// matchLines maps each line of from to the index of the same line in to, or
+// -1 if it was removed.
+func matchLines(from, to string) []int {
+	fromLines, _ := splitLines(from)
+	matches := make([]int, len(fromLines))
+	i, j := 0, 0
+	for _, d := range diff.Do(terminateLines(from), terminateLines(to)) {
+		n := strings.Count(d.Text, "\n")
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			for ; n > 0; n-- {
+				matches[i] = j
+				i++
+				j++
+			}
+		case diffmatchpatch.DiffDelete:
+			for ; n > 0; n-- {
+				matches[i] = -1
+				i++
+			}
+		case diffmatchpatch.DiffInsert:
+			j += n
+		}
+	}
+	return matches
+}
+
+// terminateLines ends s with a newline, so that its last line compares
+// equal to the same line followed by others.
+func terminateLines(s string) string {
+	if s == "" || strings.HasSuffix(s, "\n") {
+		return s
+	}
+	return s + "\n"
+}
+
+// splitLines splits content into lines, reporting whether it ends without a
+// newline.
+func splitLines(content string) ([]string, bool) {
+	if content == "" {
+		return nil, false
+	}
+	noEOL := !strings.HasSuffix(content, "\n")
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n"), noEOL
+}
+
+func joinLines(lines []string, noEOL bool) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	s := strings.Join(lines, "\n")
+	if !noEOL {
+		s += "\n"
+	}
+	return s
+}
@@ -0,0 +1,237 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParsePatch(t *testing.T) {
+	data := `From 1234 Mon Sep 17 00:00:00 2001
+From: test <test@example.com>
+Subject: [PATCH] change things
+
+---
+ a.txt | 2 +-
+ 2 files changed
+
+diff --git a/a.txt b/a.txt
+index 1111111..2222222 100644
+--- a/a.txt
++++ b/a.txt
+@@ -1,2 +1,2 @@
+ one
+-two
++2
+diff --git a/old.txt b/new.txt
+similarity index 100%
+rename from old.txt
+rename to new.txt
+diff --git a/gone.txt b/gone.txt
+deleted file mode 100644
+index 3333333..0000000
+--- a/gone.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-gone
+\ No newline at end of file
+-- 
+2.40.0
+`
+	patch, err := ParsePatch("change.patch", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patch.files) != 3 || patch.sectioned {
+		t.Fatalf("expected 3 files, got %+v", patch.files)
+	}
+	a, renamed, gone := patch.files[0], patch.files[1], patch.files[2]
+	if a.oldPath != "a.txt" || a.newPath != "a.txt" || a.oldHash != "1111111" || len(a.hunks) != 1 {
+		t.Errorf("unexpected file %+v", a)
+	}
+	if hunk := a.hunks[0]; hunk.lead != 1 || hunk.trail != 0 || len(hunk.old) != 2 || len(hunk.new) != 2 {
+		t.Errorf("unexpected hunk %+v", hunk)
+	}
+	if renamed.oldPath != "old.txt" || renamed.newPath != "new.txt" || len(renamed.hunks) != 0 {
+		t.Errorf("unexpected rename %+v", renamed)
+	}
+	if gone.oldPath != "gone.txt" || gone.newPath != "" || !gone.hunks[0].oldNoEOL || gone.newMode != 0 {
+		t.Errorf("unexpected deletion %+v", gone)
+	}
+
+	modes, err := ParsePatch("modes.patch", []byte("diff --git a/x b/x\nnew file mode 100755\n--- /dev/null\n+++ b/x\n@@ -0,0 +1 @@\n+x\ndiff --git a/y b/y\nold mode 100755\nnew mode 100644\ndiff --git a/z b/z\nnew file mode 120000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, mode := range []os.FileMode{0755, 0644, 0} {
+		if file := modes.files[i]; file.newMode != mode {
+			t.Errorf("expected mode %v for %s, got %v", mode, file.newPath, file.newMode)
+		}
+	}
+
+	bundle, err := ParsePatch("bundle.patch", []byte("ghforeach: org/a\n--- a/x\n+++ b/x\n@@ -1 +1 @@\n-a\n+b\nghforeach: org/b\n--- a/y\n+++ b/y\n@@ -1 +1 @@\n-a\n+b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files := bundle.filesFor("org/b"); len(files) != 1 || files[0].oldPath != "y" {
+		t.Errorf("expected only y for org/b, got %+v", files)
+	}
+	if files := bundle.filesFor("org/c"); len(files) != 0 {
+		t.Errorf("expected nothing for org/c, got %+v", files)
+	}
+
+	if _, err := ParsePatch("empty.patch", []byte("nothing to see\n")); err == nil {
+		t.Error("expected an error for a patch without changes")
+	}
+	if _, err := ParsePatch("truncated.patch", []byte("--- a/x\n+++ b/x\n@@ -1,3 +1,3 @@\n a\n-b\n")); err == nil {
+		t.Error("expected an error for a truncated hunk")
+	}
+
+	// paths may not lead out of the clone
+	for _, data := range []string{
+		"--- a/../../x\n+++ b/../../x\n@@ -1 +1 @@\n-a\n+b\n",
+		"--- /dev/null\n+++ /etc/x\n@@ -0,0 +1 @@\n+b\n",
+		"--- a/.git/config\n+++ b/.git/config\n@@ -1 +1 @@\n-a\n+b\n",
+		"diff --git a/x b/x\nsimilarity index 100%\nrename from x\nrename to ../x\n",
+	} {
+		if _, err := ParsePatch("escape.patch", []byte(data)); err == nil || !strings.Contains(err.Error(), "invalid path") {
+			t.Errorf("expected an invalid path error for %q, got %v", data, err)
+		}
+	}
+	clean, err := ParsePatch("clean.patch", []byte("--- a/./x\n+++ b/dir/../x\n@@ -1 +1 @@\n-a\n+b\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file := clean.files[0]; file.oldPath != "x" || file.newPath != "x" {
+		t.Errorf("expected cleaned paths, got %q and %q", file.oldPath, file.newPath)
+	}
+}
+
+func TestParseHunk(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		old, new string
+		n        int
+		err      string
+	}{
+		{"counts", []string{"@@ -1,2 +1,2 @@", " a", "-b", "+B", "next"}, "a b", "a B", 4, ""},
+		{"default counts", []string{"@@ -3 +3 @@ heading", "-c", "+C"}, "c", "C", 3, ""},
+		{"empty context line", []string{"@@ -1,2 +1,2 @@", "", "-b", "+B"}, " b", " B", 4, ""},
+		{"no newline", []string{"@@ -1 +1 @@", "-a", `\ No newline at end of file`, "+A"}, "a", "A", 4, ""},
+		{"truncated", []string{"@@ -1,3 +1,3 @@", " a"}, "", "", 0, "truncated"},
+		{"malformed", []string{"@@ -1,2 +1,2 @@", " a", "*b"}, "", "", 0, "malformed hunk line"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hunk, n, err := parseHunk(test.lines)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			old, new := strings.Join(hunk.old, " "), strings.Join(hunk.new, " ")
+			if old != test.old || new != test.new || n != test.n {
+				t.Errorf("expected %q to %q over %d lines, got %q to %q over %d", test.old, test.new, test.n, old, new, n)
+			}
+		})
+	}
+}
+
+func TestParsePatchPath(t *testing.T) {
+	tests := []struct {
+		line, prefix string
+		expected     string
+	}{
+		{"a/dir/x.go", "a/", "dir/x.go"},
+		{"b/x.go\t2024-01-01 00:00:00", "b/", "x.go"},
+		{`"a/with space.txt"`, "a/", "with space.txt"},
+		{"/dev/null", "a/", ""},
+		{"x.go", "a/", "x.go"},
+	}
+	for _, test := range tests {
+		if got := parsePatchPath(test.line, test.prefix); got != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.line, test.expected, got)
+		}
+	}
+}
+
+func TestApplyHunks(t *testing.T) {
+	hunk := func(header string, lines ...string) *patchHunk {
+		hunk, _, err := parseHunk(append([]string{header}, lines...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hunk
+	}
+	change := hunk("@@ -2,3 +2,3 @@", " b", "-c", "+C", " d")
+
+	tests := []struct {
+		name     string
+		content  string
+		hunks    []*patchHunk
+		fuzz     int
+		expected string
+		failed   int
+	}{
+		{"exact", "a\nb\nc\nd\ne\n", []*patchHunk{change}, 0, "a\nb\nC\nd\ne\n", 0},
+		{"offset", "x\ny\na\nb\nc\nd\ne\n", []*patchHunk{change}, 0, "x\ny\na\nb\nC\nd\ne\n", 0},
+		{"changed context", "a\nB\nc\nd\ne\n", []*patchHunk{change}, 0, "a\nB\nc\nd\ne\n", 1},
+		{"fuzz", "a\nB\nc\nd\ne\n", []*patchHunk{change}, 1, "a\nB\nC\nd\ne\n", 0},
+		{"missing", "a\nb\nd\n", []*patchHunk{change}, 2, "a\nb\nd\n", 1},
+		{"new file", "", []*patchHunk{hunk("@@ -0,0 +1,2 @@", "+a", "+b")}, 0, "a\nb\n", 0},
+		{"append", "a\n", []*patchHunk{hunk("@@ -1 +1,2 @@", " a", "+b")}, 0, "a\nb\n", 0},
+		{"no newline", "a\nb", []*patchHunk{hunk("@@ -1,2 +1,2 @@", " a", "-b", `\ No newline at end of file`, "+B")}, 0, "a\nB\n", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, failed := applyHunks(test.content, test.hunks, test.fuzz)
+			if got != test.expected || len(failed) != test.failed {
+				t.Errorf("expected %q with %d failed hunks, got %q with %d", test.expected, test.failed, got, len(failed))
+			}
+		})
+	}
+}
+
+func TestMerge3(t *testing.T) {
+	base := "1\n2\n3\n4\n5\n6\n"
+	tests := []struct {
+		name, ours, theirs string
+		expected           string
+		ok                 bool
+	}{
+		{"separate changes", "1\nTWO\n3\n4\n5\n6\n", "1\n2\n3\n4\nFIVE\n6\n", "1\nTWO\n3\n4\nFIVE\n6\n", true},
+		{"same change", "1\n2\nTHREE\n4\n5\n6\n", "1\n2\nTHREE\n4\n5\n6\n", "1\n2\nTHREE\n4\n5\n6\n", true},
+		{"insertions", "0\n1\n2\n3\n4\n5\n6\n", "1\n2\n3\n4\n5\n6\n7\n", "0\n1\n2\n3\n4\n5\n6\n7\n", true},
+		{"conflict", "1\n2\nthree\n4\n5\n6\n", "1\n2\nTHREE\n4\n5\n6\n", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := merge3(base, test.ours, test.theirs)
+			if got != test.expected || ok != test.ok {
+				t.Errorf("expected %q (%v), got %q (%v)", test.expected, test.ok, got, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v60/github"
+)
+
+// propertyPredicate is a condition on one of an organization repository's
+// custom property values.
+type propertyPredicate struct {
+	name string
+	// negate inverts the predicate.
+	negate bool
+	// value, if set, must equal the property value.
+	value *string
+	// re, if set, must match the property value.
+	re *regexp.Regexp
+}
+
+// parsePropertyPredicate parses a custom property predicate of the form
+// NAME=VALUE (equality), NAME=~REGEXP (regular expression match), NAME
+// (presence) or !NAME (absence).
+func parsePropertyPredicate(s string) (*propertyPredicate, error) {
+	pp := &propertyPredicate{}
+	if name, exp, ok := strings.Cut(s, "=~"); ok {
+		re, err := regexp.Compile(exp)
+		if err != nil {
+			return nil, err
+		}
+		pp.name, pp.re = name, re
+	} else if name, value, ok := strings.Cut(s, "="); ok {
+		pp.name, pp.value = name, &value
+	} else if name, ok := strings.CutPrefix(s, "!"); ok {
+		pp.name, pp.negate = name, true
+	} else {
+		pp.name = s
+	}
+	if pp.name == "" {
+		return nil, fmt.Errorf("invalid property predicate %q: missing property name", s)
+	}
+	return pp, nil
+}
+
+func (pp *propertyPredicate) String() string {
+	switch {
+	case pp.re != nil:
+		return fmt.Sprintf("%s =~ %s", pp.name, strconv.Quote(pp.re.String()))
+	case pp.value != nil:
+		return fmt.Sprintf("%s == %s", pp.name, strconv.Quote(*pp.value))
+	case pp.negate:
+		return "!" + pp.name
+	default:
+		return pp.name
+	}
+}
+
+func (pp *propertyPredicate) match(properties map[string]string) bool {
+	value, ok := properties[pp.name]
+	switch {
+	case pp.re != nil:
+		return ok && pp.re.MatchString(value)
+	case pp.value != nil:
+		return ok && value == *pp.value
+	default:
+		return ok != pp.negate
+	}
+}
+
+// WithProperty only iterates repositories whose custom properties satisfy
+// predicate, as parsed by parsePropertyPredicate. It may be given more than
+// once.
+func WithProperty(predicate string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		pp, err := parsePropertyPredicate(predicate)
+		if err != nil {
+			return err
+		}
+		fre.propertyPredicates = append(fre.propertyPredicates, pp)
+		return nil
+	}
+}
+
+// matchProperties reports whether repo satisfies every property predicate.
+func (rh *RepositoryExecutor) matchProperties(ctx context.Context, repo *github.Repository) (bool, error) {
+	properties, err := rh.repoProperties(ctx, repo)
+	if err != nil {
+		return false, err
+	}
+	for _, pp := range rh.propertyPredicates {
+		if !pp.match(properties) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// repoProperties returns the custom property values of repo, fetching them
+// if the listing did not include them. Properties without a value are
+// omitted.
+func (rh *RepositoryExecutor) repoProperties(ctx context.Context, repo *github.Repository) (map[string]string, error) {
+	if repo.CustomProperties != nil {
+		return repo.CustomProperties, nil
+	}
+	var values []*github.CustomPropertyValue
+	var resp *github.Response
+	err := rh.callAPI(ctx, "get repository custom properties", func() (*github.Response, error) {
+		var err error
+		values, resp, err = rh.client.Repositories.GetAllCustomPropertyValues(ctx, repoOwner(repo), repo.GetName())
+		return resp, err
+	})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		// user repositories have no custom properties
+		values, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	properties := map[string]string{}
+	for _, value := range values {
+		if value.Value != nil {
+			properties[value.PropertyName] = *value.Value
+		}
+	}
+	repo.CustomProperties = properties
+	return properties, nil
+}
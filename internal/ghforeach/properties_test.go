@@ -0,0 +1,60 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePropertyPredicate(t *testing.T) {
+	properties := map[string]string{"team": "platform", "tier": "1"}
+	tests := []struct {
+		spec  string
+		str   string
+		match bool
+		err   string
+	}{
+		{"team=platform", `team == "platform"`, true, ""},
+		{"team=", `team == ""`, false, ""},
+		{"tier=~^[12]$", `tier =~ "^[12]$"`, true, ""},
+		{"owner=~.", `owner =~ "."`, false, ""},
+		{"team", "team", true, ""},
+		{"!team", "!team", false, ""},
+		{"!owner", "!owner", true, ""},
+		{"=platform", "", false, "missing property name"},
+		{"!", "", false, "missing property name"},
+		{"team=~(", "", false, "missing closing )"},
+	}
+	for _, test := range tests {
+		pp, err := parsePropertyPredicate(test.spec)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected error containing %q, got %v", test.spec, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+			continue
+		}
+		if pp.String() != test.str || pp.match(properties) != test.match {
+			t.Errorf("%q: expected %s matching %t, got %s matching %t", test.spec, test.str, test.match, pp, pp.match(properties))
+		}
+	}
+}
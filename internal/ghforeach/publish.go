@@ -0,0 +1,286 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/google/go-github/v60/github"
+	"go.uber.org/zap"
+)
+
+// defaultPublishBranch is the branch changes are committed to unless WithBranch is
+// given.
+const defaultPublishBranch = "ghforeach"
+
+// WithCommitMessage commits the changes each successful command makes to a
+// branch of its clone (see WithBranch) with message. It implies WithDiff, and
+// repositories without changes are not committed.
+func WithCommitMessage(message string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		if strings.TrimSpace(message) == "" {
+			return fmt.Errorf("commit message must not be empty")
+		}
+		fre.commitMessage = message
+		fre.captureDiff = true
+		return nil
+	}
+}
+
+// WithBranch sets the branch changes are committed and pushed to. It
+// defaults to "ghforeach".
+func WithBranch(name string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		if err := plumbing.NewBranchReferenceName(name).Validate(); err != nil || name == "" {
+			return fmt.Errorf("invalid branch name %q", name)
+		}
+		fre.branch = name
+		return nil
+	}
+}
+
+// WithCommitAuthor sets the author of commits. By default, the author is
+// read from git config.
+func WithCommitAuthor(name, email string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.commitAuthor = &object.Signature{Name: name, Email: email}
+		return nil
+	}
+}
+
+// WithPush pushes the branch of each commit to the repository. A branch
+// that already exists there with other commits is not replaced unless
+// WithForcePush is given.
+func WithPush(b bool) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.push = b
+		return nil
+	}
+}
+
+// WithForcePush force-pushes the branch of each commit, so that a later run
+// replaces the changes of an earlier one. It requires WithPush.
+func WithForcePush(b bool) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.forcePush = b
+		return nil
+	}
+}
+
+// WithPullRequest opens a pull request from each pushed branch into the
+// default branch, titled with the first line of the commit message and
+// described by the rest. An open pull request from the branch is reused. It
+// implies WithPush.
+func WithPullRequest(b bool) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.pullRequest = b
+		if b {
+			fre.push = true
+		}
+		return nil
+	}
+}
+
+// gitAuth returns the credentials for cloning and pushing, or nil if there
+// are none.
+func (rh *RepositoryExecutor) gitAuth() transport.AuthMethod {
+	if rh.authUser == nil || rh.authToken == nil {
+		return nil
+	}
+	return &http.BasicAuth{
+		Username: *rh.authUser,
+		Password: *rh.authToken,
+	}
+}
+
+// publishChanges publishes the changes recorded in result with publish once
+// they are approved.
+func (rh *RepositoryExecutor) publishChanges(ctx context.Context, result *executionResult, publish func() error) {
+	approved, err := rh.approveChanges(ctx, result)
+	if err != nil {
+		result.Error = err
+		result.Status = FailedStatus
+		return
+	}
+	if result.Diff == "" {
+		// the changes were undone in review
+		result.Status = NoOpStatus
+		return
+	}
+	if !approved {
+		result.Status = SkippedReviewStatus
+		return
+	}
+	if err := publish(); err != nil {
+		rh.logger.Error("error publishing changes", zap.String("repository", result.Repository), zap.Error(err))
+		result.Error = fmt.Errorf("publishing changes: %w", err)
+		result.Status = FailedStatus
+	}
+}
+
+// publish commits, pushes and opens a pull request for the changes command
+// made to the clone of repo, as configured.
+func (rh *RepositoryExecutor) publish(ctx context.Context, repo *github.Repository, result *executionResult) error {
+	r, err := git.PlainOpen(result.Path)
+	if err != nil {
+		return err
+	}
+	worktree, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+	branch := plumbing.NewBranchReferenceName(rh.branch)
+	_, err = r.Reference(branch, false)
+	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return err
+	}
+	// a resumed run may find the branch already created
+	err = worktree.Checkout(&git.CheckoutOptions{Branch: branch, Create: err != nil, Keep: true})
+	if err != nil {
+		return fmt.Errorf("checking out %s: %w", rh.branch, err)
+	}
+	if err := worktree.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		return fmt.Errorf("staging changes: %w", err)
+	}
+	opts := &git.CommitOptions{}
+	if rh.commitAuthor != nil {
+		author := *rh.commitAuthor
+		author.When = time.Now()
+		opts.Author = &author
+	}
+	head, err := worktree.Commit(rh.commitMessage, opts)
+	if err != nil {
+		return fmt.Errorf("committing changes: %w", err)
+	}
+	if !rh.push {
+		return nil
+	}
+
+	refSpec := config.RefSpec(branch + ":" + branch)
+	if rh.forcePush {
+		refSpec = "+" + refSpec
+	} else if err := rh.checkRemoteBranch(ctx, r, head); err != nil {
+		return err
+	}
+	err = r.PushContext(ctx, &git.PushOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []config.RefSpec{refSpec},
+		Auth:       rh.gitAuth(),
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("pushing %s: %w", rh.branch, err)
+	}
+	if !rh.pullRequest {
+		return nil
+	}
+
+	url, err := rh.openPullRequest(ctx, repo)
+	if err != nil {
+		return fmt.Errorf("opening pull request: %w", err)
+	}
+	result.PullRequestURL = url
+	return nil
+}
+
+// checkRemoteBranch returns an error if the branch exists on the remote of r
+// with commits head does not contain, since pushing head would discard them.
+func (rh *RepositoryExecutor) checkRemoteBranch(ctx context.Context, r *git.Repository, head plumbing.Hash) error {
+	remote, err := r.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return err
+	}
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: rh.gitAuth()})
+	if err != nil {
+		return fmt.Errorf("listing remote branches: %w", err)
+	}
+	branch := plumbing.NewBranchReferenceName(rh.branch)
+	for _, ref := range refs {
+		if ref.Name() != branch || ref.Hash() == head {
+			continue
+		}
+		existing, err := r.CommitObject(ref.Hash())
+		if err == nil {
+			var headCommit *object.Commit
+			if headCommit, err = r.CommitObject(head); err == nil {
+				var ancestor bool
+				if ancestor, err = existing.IsAncestor(headCommit); err == nil && ancestor {
+					return nil
+				}
+			}
+		}
+		if err != nil && !errors.Is(err, plumbing.ErrObjectNotFound) {
+			return err
+		}
+		return branchExistsError(rh.branch)
+	}
+	return nil
+}
+
+// branchExistsError returns the error for a branch that cannot be published
+// to without discarding the commits already on it.
+func branchExistsError(branch string) error {
+	return fmt.Errorf("branch %s already exists with other commits; force-push to replace it", branch)
+}
+
+// openPullRequest opens a pull request from the branch into the default
+// branch of repo, unless one is already open, and returns its URL.
+func (rh *RepositoryExecutor) openPullRequest(ctx context.Context, repo *github.Repository) (string, error) {
+	owner, name := repoOwner(repo), repo.GetName()
+	var existing []*github.PullRequest
+	err := rh.callAPI(ctx, "list pull requests", func() (*github.Response, error) {
+		prs, resp, err := rh.client.PullRequests.List(ctx, owner, name, &github.PullRequestListOptions{
+			State: "open",
+			Head:  owner + ":" + rh.branch,
+		})
+		existing = prs
+		return resp, err
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(existing) > 0 {
+		return existing[0].GetHTMLURL(), nil
+	}
+
+	title, body, _ := strings.Cut(strings.TrimSpace(rh.commitMessage), "\n")
+	var pr *github.PullRequest
+	err = rh.callAPI(ctx, "create pull request", func() (*github.Response, error) {
+		created, resp, err := rh.client.PullRequests.Create(ctx, owner, name, &github.NewPullRequest{
+			Title: github.String(title),
+			Head:  github.String(rh.branch),
+			Base:  github.String(repo.GetDefaultBranch()),
+			Body:  github.String(strings.TrimSpace(body)),
+		})
+		pr = created
+		return resp, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return pr.GetHTMLURL(), nil
+}
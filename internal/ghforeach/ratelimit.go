@@ -0,0 +1,142 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+	"go.uber.org/zap"
+)
+
+// defaultSecondaryRateLimitWait is how long to pause after a secondary rate
+// limit response that does not say when to retry, as GitHub recommends.
+const defaultSecondaryRateLimitWait = time.Minute
+
+// maxRateLimitWaits bounds how many times a request waits out a rate limit
+// before failing, so that a limit that never lifts does not stall a run.
+const maxRateLimitWaits = 10
+
+// WithAPIConcurrency sets the number of GitHub API requests that may be in
+// flight at once, independently of the number of repositories handled in
+// parallel. -1 for unlimited.
+func WithAPIConcurrency(n int) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.apiConcurrency = n
+		return nil
+	}
+}
+
+// apiLimiter bounds concurrent API requests and pauses all of them while a
+// rate limit is in effect.
+type apiLimiter struct {
+	// sem holds a slot for each request in flight.
+	sem semaphore
+
+	mu       sync.Mutex
+	resumeAt time.Time
+}
+
+func newAPILimiter(concurrency int) *apiLimiter {
+	return &apiLimiter{sem: newSemaphore(concurrency)}
+}
+
+// acquire waits until no rate limit pause is in effect and a request slot
+// is free.
+func (l *apiLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		wait := time.Until(l.resumeAt)
+		l.mu.Unlock()
+		if wait <= 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return l.sem.acquire(ctx)
+}
+
+func (l *apiLimiter) release() {
+	l.sem.release()
+}
+
+// pauseUntil holds back new requests until t.
+func (l *apiLimiter) pauseUntil(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.resumeAt) {
+		l.resumeAt = t
+	}
+}
+
+// rateLimitWait reports how long to wait before retrying a request that
+// failed with err because of a primary or secondary rate limit.
+func rateLimitWait(err error) (time.Duration, bool) {
+	var rateLimitErr *github.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return time.Until(rateLimitErr.Rate.Reset.Time), true
+	}
+	var abuseErr *github.AbuseRateLimitError
+	if errors.As(err, &abuseErr) {
+		if abuseErr.RetryAfter != nil {
+			return *abuseErr.RetryAfter, true
+		}
+		return defaultSecondaryRateLimitWait, true
+	}
+	var errResp *github.ErrorResponse
+	if errors.As(err, &errResp) && errResp.Response != nil {
+		switch errResp.Response.StatusCode {
+		case http.StatusForbidden, http.StatusTooManyRequests:
+			if v := errResp.Response.Header.Get("Retry-After"); v != "" {
+				if seconds, err := strconv.Atoi(v); err == nil {
+					return time.Duration(seconds) * time.Second, true
+				}
+			}
+			if errResp.Response.StatusCode == http.StatusTooManyRequests {
+				return defaultSecondaryRateLimitWait, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// observeRate logs the remaining rate limit budget from resp and, once it is
+// spent, pauses requests until it resets.
+func (rh *RepositoryExecutor) observeRate(resp *github.Response) {
+	if resp == nil || resp.Rate.Limit == 0 {
+		return
+	}
+	rh.logger.Debug("api rate limit",
+		zap.Int("limit", resp.Rate.Limit),
+		zap.Int("remaining", resp.Rate.Remaining),
+		zap.Time("reset", resp.Rate.Reset.Time),
+	)
+	if resp.Rate.Remaining == 0 {
+		rh.logger.Warn("api rate limit exhausted, pausing requests", zap.Time("until", resp.Rate.Reset.Time))
+		rh.apiLimiter.pauseUntil(resp.Rate.Reset.Time)
+	}
+}
@@ -0,0 +1,266 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ReportFormat is the format of a report file written at the end of a run.
+type ReportFormat = int
+
+const (
+	MarkdownReportFormat ReportFormat = iota
+	HTMLReportFormat
+)
+
+// ParseReportFormat returns the report format for a file path from its
+// extension.
+func ParseReportFormat(p string) (ReportFormat, error) {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".md", ".markdown":
+		return MarkdownReportFormat, nil
+	case ".html", ".htm":
+		return HTMLReportFormat, nil
+	default:
+		return 0, fmt.Errorf("cannot infer report format of %q: expected a .md or .html extension", p)
+	}
+}
+
+// report is a report file to be written at the end of a run.
+type report struct {
+	path   string
+	format ReportFormat
+}
+
+// WithReport writes a report of every result of the run to the file at p,
+// in addition to the normal output. It may be given more than once.
+func WithReport(p string, format ReportFormat) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.reports = append(fre.reports, report{path: p, format: format})
+		return nil
+	}
+}
+
+// writeReports writes the configured reports of results.
+func (rh *RepositoryExecutor) writeReports(results []*executionResult, summary *runSummary) error {
+	if len(rh.reports) == 0 {
+		return nil
+	}
+	sorted := append([]*executionResult{}, results...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Repository < sorted[j].Repository
+	})
+	for _, r := range rh.reports {
+		rh.logger.Debug("writing report", zap.String("path", r.path))
+		if err := writeReportFile(r, sorted, summary); err != nil {
+			return fmt.Errorf("writing report %s: %w", r.path, err)
+		}
+	}
+	return nil
+}
+
+func writeReportFile(r report, results []*executionResult, summary *runSummary) error {
+	file, err := os.Create(r.path)
+	if err != nil {
+		return err
+	}
+	switch r.format {
+	case MarkdownReportFormat:
+		err = writeMarkdownReport(file, results, summary)
+	case HTMLReportFormat:
+		err = writeHTMLReport(file, results, summary)
+	default:
+		err = fmt.Errorf("invalid report format %v", r.format)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// statusBadge returns a short marker for status that reads at a glance.
+func statusBadge(status ExecutionStatus) string {
+	switch status {
+	case SucceededStatus:
+		return "✅ " + status
+	case NoOpStatus:
+		return "➖ " + status
+	case FailedStatus:
+		return "❌ " + status
+	case DriftedStatus:
+		return "⚠️ " + status
+	case SkippedPreconditionStatus, SkippedReviewStatus:
+		return "⏭️ " + status
+	default:
+		return status
+	}
+}
+
+// formatDuration rounds d for display, or returns "-" if it is zero.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d == 0:
+		return "-"
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	default:
+		return d.Round(time.Second).String()
+	}
+}
+
+// writeMarkdownReport renders results as a table followed by collapsible
+// output sections, suitable for GitHub issues and pull requests.
+func writeMarkdownReport(w io.Writer, results []*executionResult, summary *runSummary) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# ghforeach report\n\n")
+	statuses := []string{}
+	for _, status := range summary.statuses() {
+		statuses = append(statuses, fmt.Sprintf("%s: %d", statusBadge(status), summary.Statuses[status]))
+	}
+	fmt.Fprintf(b, "%d %s. %s\n\n", summary.Total, plural(summary.Total, "repository", "repositories"), strings.Join(statuses, ", "))
+
+	pullRequests := hasPullRequests(results)
+	if pullRequests {
+		b.WriteString("| Repository | Status | Duration | Pull request | Error |\n")
+		b.WriteString("| --- | --- | --- | --- | --- |\n")
+	} else {
+		b.WriteString("| Repository | Status | Duration | Error |\n")
+		b.WriteString("| --- | --- | --- | --- |\n")
+	}
+	for _, result := range results {
+		cells := []string{markdownCell(result.Repository), statusBadge(result.Status), formatDuration(result.Duration())}
+		if pullRequests {
+			pr := "-"
+			if result.PullRequestURL != "" {
+				pr = fmt.Sprintf("[link](%s)", result.PullRequestURL)
+			}
+			cells = append(cells, pr)
+		}
+		errStr := "-"
+		if result.Error != nil {
+			errStr = "`" + strings.ReplaceAll(firstLine(result.Error.Error()), "`", "'") + "`"
+		}
+		cells = append(cells, markdownCell(errStr))
+		fmt.Fprintf(b, "| %s |\n", strings.Join(cells, " | "))
+	}
+
+	for _, result := range results {
+		if result.Stdout == "" && result.Stderr == "" && result.Diff == "" && result.Rejects == "" {
+			continue
+		}
+		fmt.Fprintf(b, "\n<details>\n<summary>%s %s</summary>\n\n", statusBadge(result.Status), template.HTMLEscapeString(result.Repository))
+		for _, output := range []struct{ name, lang, text string }{
+			{"stdout", "", result.Stdout},
+			{"stderr", "", result.Stderr},
+			{"diff", "diff", result.Diff},
+			{"rejected hunks", "diff", result.Rejects},
+		} {
+			if output.text == "" {
+				continue
+			}
+			fence := markdownFence(output.text)
+			fmt.Fprintf(b, "%s\n\n%s%s\n%s\n%s\n\n", output.name, fence, output.lang, strings.TrimSuffix(output.text, "\n"), fence)
+		}
+		b.WriteString("</details>\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// hasPullRequests reports whether a pull request was opened for any of
+// results, and so whether reports have a column for them.
+func hasPullRequests(results []*executionResult) bool {
+	for _, result := range results {
+		if result.PullRequestURL != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// markdownCell escapes s for use in a table cell.
+func markdownCell(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+// markdownFence returns a code fence longer than any run of backticks in s.
+func markdownFence(s string) string {
+	longest, run := 0, 0
+	for _, r := range s {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+//go:embed report.html.tmpl
+var htmlReportTemplate string
+
+var htmlReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"duration": formatDuration,
+	"firstLine": func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return firstLine(err.Error())
+	},
+	"statusClass": func(status ExecutionStatus) string {
+		switch status {
+		case SucceededStatus:
+			return "succeeded"
+		case NoOpStatus:
+			return "noop"
+		case FailedStatus, DriftedStatus:
+			return "failed"
+		default:
+			return "skipped"
+		}
+	},
+}).Parse(htmlReportTemplate))
+
+// writeHTMLReport renders results as a self-contained HTML page.
+func writeHTMLReport(w io.Writer, results []*executionResult, summary *runSummary) error {
+	return htmlReport.Execute(w, struct {
+		Generated    time.Time
+		Summary      *runSummary
+		Statuses     []ExecutionStatus
+		Results      []*executionResult
+		PullRequests bool
+	}{
+		Generated:    time.Now(),
+		Summary:      summary,
+		Statuses:     summary.statuses(),
+		Results:      results,
+		PullRequests: hasPullRequests(results),
+	})
+}
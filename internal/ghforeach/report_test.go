@@ -0,0 +1,132 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func reportResults() ([]*executionResult, *runSummary) {
+	started := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	results := []*executionResult{
+		{
+			Repository:     "org/a",
+			Status:         SucceededStatus,
+			Stdout:         "uses ``` fences\n",
+			Attempts:       1,
+			Started:        started,
+			Finished:       started.Add(90 * time.Second),
+			PullRequestURL: "https://github.com/org/a/pull/1",
+		},
+		{
+			Repository: "org/b|c",
+			Status:     FailedStatus,
+			Stderr:     "<boom>\n",
+			Error:      errors.New("exit status 1\ndetail"),
+			Attempts:   1,
+		},
+		{Repository: "org/d", Status: SkippedPreconditionStatus},
+	}
+	summary := newRunSummary()
+	for _, result := range results {
+		summary.add(result)
+	}
+	summary.finish()
+	return results, summary
+}
+
+func TestWriteMarkdownReport(t *testing.T) {
+	results, summary := reportResults()
+	b := &strings.Builder{}
+	if err := writeMarkdownReport(b, results, summary); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"3 repositories. ✅ succeeded: 1, ❌ failed: 1, ⏭️ skipped (precondition): 1\n",
+		"| org/a | ✅ succeeded | 1m30s | [link](https://github.com/org/a/pull/1) | - |\n",
+		"| org/b\\|c | ❌ failed | - | - | `exit status 1` |\n",
+		"<summary>✅ succeeded org/a</summary>\n\nstdout\n\n````\nuses ``` fences\n````\n",
+		"<summary>❌ failed org/b|c</summary>\n\nstderr\n\n```\n<boom>\n```\n",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("expected report to contain %q, got:\n%s", expected, b.String())
+		}
+	}
+	if strings.Contains(b.String(), "org/d</summary>") {
+		t.Errorf("expected no output section for a repository without output")
+	}
+
+	// without pull requests there is no column for them
+	results[0].PullRequestURL = ""
+	b.Reset()
+	if err := writeMarkdownReport(b, results, summary); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"| Repository | Status | Duration | Error |\n| --- | --- | --- | --- |\n",
+		"| org/a | ✅ succeeded | 1m30s | - |\n",
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("expected report to contain %q, got:\n%s", expected, b.String())
+		}
+	}
+}
+
+func TestWriteHTMLReport(t *testing.T) {
+	results, summary := reportResults()
+	b := &strings.Builder{}
+	if err := writeHTMLReport(b, results, summary); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`<span class="badge failed">failed</span> 1`,
+		`<td>1m30s</td>`,
+		`<a href="https://github.com/org/a/pull/1">link</a>`,
+		`<div class="error">exit status 1</div>`,
+		`<details><summary>stderr</summary><pre>&lt;boom&gt;`,
+	} {
+		if !strings.Contains(b.String(), expected) {
+			t.Errorf("expected report to contain %q, got:\n%s", expected, b.String())
+		}
+	}
+
+	// without pull requests there is no column for them
+	results[0].PullRequestURL = ""
+	b.Reset()
+	if err := writeHTMLReport(b, results, summary); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), "Pull request") || !strings.Contains(b.String(), "<td>1m30s</td>\n<td>") {
+		t.Errorf("expected no pull request column, got:\n%s", b.String())
+	}
+}
+
+func TestParseReportFormat(t *testing.T) {
+	if format, err := ParseReportFormat("out/report.MD"); err != nil || format != MarkdownReportFormat {
+		t.Errorf("expected markdown, got %v, %v", format, err)
+	}
+	if format, err := ParseReportFormat("report.html"); err != nil || format != HTMLReportFormat {
+		t.Errorf("expected html, got %v, %v", format, err)
+	}
+	if _, err := ParseReportFormat("report.txt"); err == nil {
+		t.Error("expected error for unknown extension")
+	}
+}
@@ -28,26 +28,127 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/go-git/go-git/v5"
-	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/google/go-github/v60/github"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 )
 
+// ExecutionStatus is the outcome of handling a repository.
+type ExecutionStatus = string
+
+const (
+	PendingStatus   ExecutionStatus = "pending"
+	SucceededStatus ExecutionStatus = "succeeded"
+	// NoOpStatus is a success in which the command changed nothing, when
+	// diffs are captured.
+	NoOpStatus                ExecutionStatus = "no-op"
+	FailedStatus              ExecutionStatus = "failed"
+	SkippedPreconditionStatus ExecutionStatus = "skipped (precondition)"
+	// SkippedReviewStatus is a repository whose changes were not approved in
+	// review.
+	SkippedReviewStatus ExecutionStatus = "skipped (review)"
+	// DriftedStatus is a repository whose files differ from those synced,
+	// when the differences are not committed.
+	DriftedStatus ExecutionStatus = "drifted"
+)
+
 type executionResult struct {
-	Path    string `json:"path"`
-	Command string `json:"command"`
-	Stdout  string `json:"stdout"`
-	Stderr  string `json:"stderr"`
-	Error   error  `json:"error"`
+	Repository   string          `json:"repository"`
+	Path         string          `json:"path"`
+	Command      string          `json:"command"`
+	Precondition string          `json:"precondition,omitempty"`
+	Status       ExecutionStatus `json:"status"`
+	Stdout       string          `json:"stdout"`
+	Stderr       string          `json:"stderr"`
+	Error        error           `json:"error"`
+	// CloneAttempts and Attempts count the attempts made to clone the
+	// repository and to run the command.
+	CloneAttempts int `json:"clone_attempts"`
+	Attempts      int `json:"attempts"`
+	// Resumed is set if the result was recorded by a previous run.
+	Resumed bool `json:"resumed,omitempty"`
+	// Started and Finished bound the time spent on the repository once it
+	// began cloning.
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Diff is the unified diff of the changes the command made, when diffs
+	// are captured.
+	Diff string `json:"diff,omitempty"`
+	// Rejects are the hunks of the patch being applied that did not apply.
+	Rejects string `json:"rejects,omitempty"`
+	// ExitCode is the exit code of the command, if it ran to completion.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Artifacts are the files copied into the results directory of the
+	// repository, relative to it.
+	Artifacts []string `json:"artifacts,omitempty"`
+	// PullRequestURL links the pull request opened with the changes made in
+	// the repository, if any.
+	PullRequestURL string `json:"pull_request_url,omitempty"`
+}
+
+// Duration is the time spent on the repository, or zero if it never began.
+func (er *executionResult) Duration() time.Duration {
+	if er.Started.IsZero() || er.Finished.Before(er.Started) {
+		return 0
+	}
+	return er.Finished.Sub(er.Started)
+}
+
+// MarshalJSON renders the error as its message, or null.
+func (er executionResult) MarshalJSON() ([]byte, error) {
+	type alias executionResult
+	var errStr *string
+	if er.Error != nil {
+		str := er.Error.Error()
+		errStr = &str
+	}
+	return json.Marshal(struct {
+		alias
+		Error *string `json:"error"`
+	}{alias(er), errStr})
+}
+
+func (er *executionResult) UnmarshalJSON(data []byte) error {
+	type alias executionResult
+	aux := struct {
+		*alias
+		Error *string `json:"error"`
+	}{alias: (*alias)(er)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	er.Error = nil
+	if aux.Error != nil {
+		er.Error = errors.New(*aux.Error)
+	}
+	return nil
 }
 
 func (er *executionResult) String() string {
-	str := fmt.Sprintf(">>>>> %s: %s\n", er.Path, er.Command)
+	str := fmt.Sprintf(">>>>> %s: %s\n", er.Repository, er.Command)
+	if er.Path != "" {
+		str = fmt.Sprintf(">>>>> %s (%s): %s\n", er.Repository, er.Path, er.Command)
+	}
+	if er.Status == SkippedPreconditionStatus {
+		str += fmt.Sprintf("SKIPPED (precondition): %s\n", er.Precondition)
+		return str
+	}
 	str += fmt.Sprintf("STDERR:\n%s\n", er.Stderr)
 	str += fmt.Sprintf("STDOUT:\n%s\n", er.Stdout)
+	if er.Diff != "" {
+		str += fmt.Sprintf("DIFF:\n%s\n", er.Diff)
+	} else if er.Status == NoOpStatus {
+		str += "NO CHANGES\n"
+	}
+	if er.Rejects != "" {
+		str += fmt.Sprintf("REJECTED HUNKS:\n%s\n", er.Rejects)
+	}
 	if er.Error != nil {
 		str += fmt.Sprintf("error: %v\n", er.Error)
 	}
@@ -67,126 +168,143 @@ type RepositoryExecutorOutputFormat = int
 const (
 	ConsoleOutputFormat RepositoryExecutorOutputFormat = iota
 	JsonOutputFormat
+	JUnitOutputFormat
+	CSVOutputFormat
 )
 
 type RepositoryExecutorOption = func(*RepositoryExecutor) error
 
+// WithOrg adds an organization whose repositories will be iterated. It may be
+// given more than once.
 func WithOrg(org string) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.org = &org
+		fre.orgs = append(fre.orgs, org)
 		return nil
 	}
 }
 
+// WithUser adds a user whose repositories will be iterated. It may be given
+// more than once.
 func WithUser(user string) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.user = &user
+		fre.users = append(fre.users, user)
 		return nil
 	}
 }
 
-func WithNameRegexp(exp string) RepositoryExecutorOption {
+func WithClient(client *github.Client) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		regexp, err := regexp.Compile(exp)
-		if err != nil {
-			return err
-		}
-		fre.nameRegexp = regexp
+		fre.client = client
 		return nil
 	}
 }
 
-func WithNameList(names []string) RepositoryExecutorOption {
+func WithLogger(logger *zap.Logger) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.nameSet = map[string]struct{}{}
-		for _, name := range names {
-			fre.nameSet[name] = struct{}{}
-		}
+		fre.logger = logger
 		return nil
 	}
 }
 
-func WithTopicRegexp(exp string) RepositoryExecutorOption {
+func WithUserAuth(user, token string) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		regexp, err := regexp.Compile(exp)
-		if err != nil {
-			return err
-		}
-		fre.topicRegexp = regexp
+		fre.authUser = &user
+		fre.authToken = &token
 		return nil
 	}
 }
 
-func WithTopicList(topics []string) RepositoryExecutorOption {
+func WithOverwrite(b bool) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.topicSet = map[string]struct{}{}
-		for _, topic := range topics {
-			fre.topicSet[topic] = struct{}{}
-		}
+		fre.overwrite = b
 		return nil
 	}
 }
 
-func WithClient(client *github.Client) RepositoryExecutorOption {
+func WithCleanup(b bool) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.client = client
+		fre.cleanup = b
 		return nil
 	}
 }
 
-func WithLogger(logger *zap.Logger) RepositoryExecutorOption {
+func WithTmpDir(dir string) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.logger = logger
+		fre.tmpDir = dir
 		return nil
 	}
 }
 
-func WithUserAuth(user, token string) RepositoryExecutorOption {
+// WithConcurrency sets the number of repositories whose commands run in
+// parallel. -1 for unlimited.
+func WithConcurrency(n int) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.authUser = &user
-		fre.authToken = &token
+		fre.concurrency = n
 		return nil
 	}
 }
 
-func WithOverwrite(b bool) RepositoryExecutorOption {
+// WithCloneConcurrency sets the number of repositories cloned in parallel,
+// independently of the number running commands, so that downloads continue
+// while slow commands run. It defaults to the concurrency given with
+// WithConcurrency. At most as many repositories as both limits together are
+// cloned and waiting for or running their command at once. -1 for
+// unlimited.
+func WithCloneConcurrency(n int) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.overwrite = b
+		fre.cloneConcurrency = n
 		return nil
 	}
 }
 
-func WithCleanup(b bool) RepositoryExecutorOption {
+// WithOutput sets the writer results are output to. It defaults to stdout.
+func WithOutput(w io.Writer) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.cleanup = b
+		fre.out = w
 		return nil
 	}
 }
 
-func WithTmpDir(dir string) RepositoryExecutorOption {
+func WithOutputFormat(format RepositoryExecutorOutputFormat) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.tmpDir = dir
+		if _, ok := outputFormatters[format]; !ok {
+			return fmt.Errorf("invalid output format %v", format)
+		}
+		fre.outputFormat = format
 		return nil
 	}
 }
 
-func WithConcurrency(n int) RepositoryExecutorOption {
+// WithPrecondition sets a command run in each clone before the main command.
+// Repositories where it exits non-zero are skipped rather than failed.
+func WithPrecondition(command string) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.concurrency = n
+		fre.precondition = &command
 		return nil
 	}
 }
 
-func WithOutputFormat(format RepositoryExecutorOutputFormat) RepositoryExecutorOption {
+func WithShellPath(path string) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.outputFormat = format
+		fre.shellPath = path
 		return nil
 	}
 }
 
-func WithShellPath(path string) RepositoryExecutorOption {
+// withResultHook registers a function called with each result as it is
+// output.
+func withResultHook(hook func(*executionResult)) RepositoryExecutorOption {
 	return func(fre *RepositoryExecutor) error {
-		fre.shellPath = path
+		fre.resultHooks = append(fre.resultHooks, hook)
+		return nil
+	}
+}
+
+// withRunStateHook registers a function called with the run state journal
+// once it is opened.
+func withRunStateHook(hook func(*runState)) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.runStateHook = hook
 		return nil
 	}
 }
@@ -199,20 +317,79 @@ type RepositoryExecutor struct {
 	authToken *string
 
 	// filter parameters
-	nameRegexp  *regexp.Regexp
-	nameSet     map[string]struct{}
-	topicRegexp *regexp.Regexp
-	topicSet    map[string]struct{}
+	nameRegexps        []*regexp.Regexp
+	nameMatch          MatchMode
+	nameSet            map[string]struct{}
+	topicRegexps       []*regexp.Regexp
+	topicSet           map[string]struct{}
+	topicMatch         MatchMode
+	topicMin           int
+	excludeNameRegexp  *regexp.Regexp
+	excludeNameSet     map[string]struct{}
+	excludeTopicRegexp *regexp.Regexp
+	excludeTopicSet    map[string]struct{}
+	archived           AttributeFilter
+	forks              AttributeFilter
+	templates          AttributeFilter
+	visibilitySet      map[string]struct{}
+	languageSet        map[string]struct{}
+	minSize            int
+	maxSize            int
+	pushedSince        *time.Time
+	defaultBranch      *string
+	where              []expr
+	filter             expr
+	propertyPredicates []*propertyPredicate
+	contentPredicates  []*contentPredicate
+	contentCache       *contentCache
 
 	// operation parameters
 	shellPath    string
+	precondition *string
+	cacheDir     string
 	overwrite    bool
 	cleanup      bool
-	tmpDir       string
-	concurrency  int
-	outputFormat RepositoryExecutorOutputFormat
-	org          *string
-	user         *string
+	resume       bool
+	apiRetry     RetryPolicy
+	cloneRetry   RetryPolicy
+	commandRetry RetryPolicy
+	// apiConcurrency bounds API requests in flight, enforced by apiLimiter
+	apiConcurrency int
+	apiLimiter     *apiLimiter
+	tmpDir         string
+	concurrency    int
+	// cloneConcurrency bounds clones in flight, separately from concurrency,
+	// or is 0 to bound them by concurrency
+	cloneConcurrency int
+	outputFormat     RepositoryExecutorOutputFormat
+	stream           *streamPrinter
+	out              io.Writer
+	statusListeners  []func(StatusEvent)
+	reports          []report
+	resultsDir       string
+	artifactGlobs    []string
+	captureDiff      bool
+	patchFile        string
+	commitMessage    string
+	branch           string
+	commitAuthor     *object.Signature
+	push             bool
+	forcePush        bool
+	pullRequest      bool
+	reviewer         *reviewer
+	decisionsFile    string
+	decisions        *reviewDecisions
+	applyPatch       *Patch
+	patchFuzz        int
+	threeWay         bool
+	syncManifest     *SyncManifest
+	apiEdit          bool
+	editPaths        []string
+	fileEdits        []*FileEdit
+	orgs             []string
+	users            []string
+	resultHooks      []func(*executionResult)
+	runStateHook     func(*runState)
 }
 
 func NewRepositoryExecutor(opts ...RepositoryExecutorOption) (*RepositoryExecutor, error) {
@@ -222,11 +399,20 @@ func NewRepositoryExecutor(opts ...RepositoryExecutorOption) (*RepositoryExecuto
 	}
 
 	exec := &RepositoryExecutor{
-		client:      github.NewClient(nil),
-		logger:      zap.L(),
-		tmpDir:      path.Join(wd, "tmp"),
-		concurrency: 1,
-		shellPath:   "/bin/sh",
+		client:         github.NewClient(nil),
+		logger:         zap.L(),
+		tmpDir:         path.Join(wd, "tmp"),
+		concurrency:    1,
+		out:            os.Stdout,
+		branch:         defaultPublishBranch,
+		shellPath:      "/bin/sh",
+		cacheDir:       defaultCacheDir(),
+		apiRetry:       DefaultRetryPolicy(3),
+		cloneRetry:     DefaultRetryPolicy(3),
+		apiConcurrency: 4,
+		archived:       ExcludeAttribute,
+		minSize:        -1,
+		maxSize:        -1,
 	}
 
 	for _, opt := range opts {
@@ -236,10 +422,57 @@ func NewRepositoryExecutor(opts ...RepositoryExecutorOption) (*RepositoryExecuto
 		}
 	}
 
+	exec.filter = exec.compileFilter()
+	exec.apiLimiter = newAPILimiter(exec.apiConcurrency)
+
 	return exec, nil
 }
 
 func (rh *RepositoryExecutor) Go(ctx context.Context, command string) error {
+	if rh.resume && rh.overwrite {
+		return fmt.Errorf("cannot resume a run while overwriting its temp directory")
+	}
+	if len(rh.artifactGlobs) > 0 && rh.resultsDir == "" {
+		return fmt.Errorf("artifacts require a results directory")
+	}
+	switch {
+	case rh.applyPatch != nil && rh.syncManifest != nil:
+		return fmt.Errorf("cannot both apply a patch and sync files")
+	case (rh.applyPatch != nil || rh.syncManifest != nil) && len(rh.fileEdits) > 0:
+		return fmt.Errorf("cannot edit files while applying a patch or syncing files")
+	case command != "" && (rh.applyPatch != nil || rh.syncManifest != nil || len(rh.fileEdits) > 0):
+		return fmt.Errorf("cannot run a command while applying a patch, syncing or editing files")
+	case rh.applyPatch != nil:
+		command = "apply " + rh.applyPatch.name
+	case rh.syncManifest != nil:
+		command = "sync " + rh.syncManifest.name
+	case len(rh.fileEdits) > 0:
+		edits := []string{}
+		for _, edit := range rh.fileEdits {
+			edits = append(edits, edit.String())
+		}
+		command = strings.Join(edits, "; ")
+	}
+	if err := rh.validateAPIEdit(command); err != nil {
+		return err
+	}
+	if rh.push && rh.commitMessage == "" {
+		return fmt.Errorf("pushing changes requires a commit message")
+	}
+	if rh.forcePush && !rh.push {
+		return fmt.Errorf("force-pushing changes requires pushing them")
+	}
+	if (rh.reviewer != nil || rh.decisionsFile != "") && rh.commitMessage == "" {
+		return fmt.Errorf("reviewing changes requires a commit message")
+	}
+	if rh.decisionsFile != "" {
+		decisions, err := loadReviewDecisions(rh.decisionsFile, rh.reviewer == nil)
+		if err != nil {
+			return err
+		}
+		rh.decisions = decisions
+	}
+
 	if rh.overwrite {
 		rh.logger.Debug("removing temp directory", zap.String("path", rh.tmpDir))
 		err := os.RemoveAll(rh.tmpDir)
@@ -264,100 +497,474 @@ func (rh *RepositoryExecutor) Go(ctx context.Context, command string) error {
 		}()
 	}
 
+	if rh.filter != nil {
+		rh.logger.Debug("filtering repositories", zap.Stringer("filter", rh.filter))
+	}
+	if len(rh.propertyPredicates) > 0 {
+		rh.logger.Debug("filtering repository custom properties", zap.Stringers("predicates", rh.propertyPredicates))
+	}
+	if len(rh.contentPredicates) > 0 {
+		rh.logger.Debug("filtering repository contents", zap.Stringers("predicates", rh.contentPredicates))
+		cache, err := loadContentCache(rh.cacheDir)
+		if err != nil {
+			return err
+		}
+		rh.contentCache = cache
+		defer func() {
+			if err := rh.contentCache.save(); err != nil {
+				rh.logger.Error("error saving content cache", zap.Error(err))
+			}
+		}()
+	}
+
+	state, err := openRunState(rh.tmpDir, rh.runMetadata(command), rh.resume)
+	if err != nil {
+		return err
+	}
+	defer state.close()
+	if rh.runStateHook != nil {
+		rh.runStateHook(state)
+	}
+
 	g, ctx := errgroup.WithContext(ctx)
 	repoCh := make(chan *github.Repository)
 	resultCh := make(chan *executionResult)
 
 	g.Go(func() error {
 		defer close(repoCh)
-		return rh.getRepositories(ctx, repoCh)
+		if err := rh.getRepositories(ctx, repoCh); err != nil {
+			return err
+		}
+		rh.emit(StatusEvent{Stage: ListedStage})
+		return nil
 	})
 
 	g.Go(func() error {
 		defer close(resultCh)
+		// each repository passes through the clone stage and then the
+		// command stage, each bounded separately, so that clones continue
+		// while other repositories' commands run.
 		repoG, repoCtx := errgroup.WithContext(ctx)
-		repoG.SetLimit(rh.concurrency)
+		cloneConcurrency := rh.cloneConcurrency
+		if cloneConcurrency == 0 {
+			cloneConcurrency = rh.concurrency
+		}
+		stages := &pipelineStages{
+			clone:   newSemaphore(cloneConcurrency),
+			command: newSemaphore(rh.concurrency),
+		}
+		// bound the repositories cloned but not yet done too, so that fast
+		// clones do not pile up ahead of slow commands
+		if cloneConcurrency > 0 && rh.concurrency > 0 {
+			repoG.SetLimit(cloneConcurrency + rh.concurrency)
+		}
+		var dispatchErr error
+	dispatch:
 		for repo := range repoCh {
 			select {
 			case <-ctx.Done():
 				rh.logger.Error("context error", zap.Error(ctx.Err()))
 			default:
+				if result, ok := state.completed(repo); ok {
+					rh.logger.Debug("skipping repository completed by previous run", zap.String("repository", repo.GetFullName()))
+					result.Resumed = true
+					rh.emitResult(result)
+					resultCh <- result
+					continue
+				}
+				if err := state.record(repo, PendingStatus, nil); err != nil {
+					// repositories already dispatched still send their
+					// results, so stop dispatching and wait for them
+					dispatchErr = err
+					break dispatch
+				}
+				rh.emit(StatusEvent{Repository: repo.GetFullName(), Stage: QueuedStage})
 				repoG.Go(func() error {
-					repoDir := path.Join(rh.tmpDir, repo.GetName())
-					if _, err := os.Stat(repoDir); errors.Is(err, os.ErrNotExist) {
-						err := rh.cloneRepo(repoCtx, repoDir, repo)
-						if err != nil {
-							rh.logger.Error("error cloning repository", zap.String("repository", repo.GetName()), zap.Error(err))
-							return nil
-						}
-					}
-
-					if rh.cleanup {
-						defer func() {
-							os.RemoveAll(repoDir)
-						}()
+					result := rh.handleRepository(repoCtx, repo, command, stages)
+					if err := rh.writeResultFiles(result); err != nil {
+						rh.logger.Error("error writing results", zap.String("repository", result.Repository), zap.Error(err))
 					}
-
-					stdoutBuf := &bytes.Buffer{}
-					stderrBuf := &bytes.Buffer{}
-					err := rh.execCommand(command, repoDir, stdoutBuf, stderrBuf)
-					if err != nil {
-						rh.logger.Error("error executing command", zap.String("command", command), zap.Error(err))
+					if err := state.record(repo, result.Status, result); err != nil {
+						return err
 					}
-					resultCh <- &executionResult{
-						Path:    repoDir,
-						Command: command,
-						Stdout:  stdoutBuf.String(),
-						Stderr:  stderrBuf.String(),
-						Error:   err,
+					rh.emitResult(result)
+					resultCh <- result
+					if errors.Is(result.Error, errReviewAborted) {
+						return errReviewAborted
 					}
 					return nil
 				})
 			}
 		}
-		return repoG.Wait()
+		err := repoG.Wait()
+		if dispatchErr != nil {
+			return dispatchErr
+		}
+		return err
 	})
 
 	g.Go(func() error {
+		formatter := outputFormatters[rh.outputFormat](rh)
+		summary := newRunSummary()
+		results := []*executionResult{}
 		for result := range resultCh {
 			select {
 			case <-ctx.Done():
 				rh.logger.Error("context error", zap.Error(ctx.Err()))
 			default:
-				switch rh.outputFormat {
-				case JsonOutputFormat:
-					str, err := result.JsonString()
-					if err != nil {
-						rh.logger.Error("error marshalling result to json", zap.Error(err))
-					} else {
-						fmt.Println(str)
-					}
-				case ConsoleOutputFormat:
-					fmt.Println(result.String())
-				default:
-					rh.logger.Error("invalid output format", zap.Any("format", rh.outputFormat))
+				for _, hook := range rh.resultHooks {
+					hook(result)
+				}
+				summary.add(result)
+				if len(rh.reports) > 0 || rh.resultsDir != "" || rh.patchFile != "" {
+					results = append(results, result)
+				}
+				if err := formatter.result(rh.out, result); err != nil {
+					rh.logger.Error("error writing result", zap.String("repository", result.Repository), zap.Error(err))
 				}
 			}
 		}
-		return nil
+		if ctx.Err() != nil {
+			return nil
+		}
+		summary.finish()
+		if err := formatter.finish(rh.out, summary); err != nil {
+			rh.logger.Error("error writing output", zap.Error(err))
+		}
+		if err := rh.writePatchFile(results); err != nil {
+			return fmt.Errorf("writing patch file: %w", err)
+		}
+		if err := rh.writeResultsIndex(command, results); err != nil {
+			return fmt.Errorf("writing results index: %w", err)
+		}
+		return rh.writeReports(results, summary)
 	})
 
 	return g.Wait()
 }
 
-func (rh *RepositoryExecutor) getRepositories(ctx context.Context, ch chan<- *github.Repository) error {
-	if rh.org != nil {
-		rh.logger.Debug("fetching organization repositories", zap.String("organization", *rh.org))
-		return rh.getRepositoriesForOrg(ctx, *rh.org, ch)
-	} else if rh.authUser != nil && rh.authToken != nil && rh.user != nil && *rh.authUser == *rh.user {
-		rh.logger.Debug("fetching user repositories", zap.String("user", *rh.user))
-		return rh.getRepositoriesForAuthenticatedUser(ctx, ch)
-	} else if rh.user != nil {
-		rh.logger.Debug("fetching user repositories", zap.String("user", *rh.user))
-		return rh.getRepositoriesForUser(ctx, *rh.user, ch)
+// repoDir returns the owner-qualified working directory for repo, so that
+// repositories sharing a name under different owners do not collide.
+func (rh *RepositoryExecutor) repoDir(repo *github.Repository) string {
+	return path.Join(rh.tmpDir, repoOwner(repo), repo.GetName())
+}
+
+// repoOwner returns the login of the owner of repo, falling back to the owner
+// component of its full name.
+func repoOwner(repo *github.Repository) string {
+	if login := repo.GetOwner().GetLogin(); login != "" {
+		return login
+	}
+	owner, _, _ := strings.Cut(repo.GetFullName(), "/")
+	return owner
+}
+
+// pipelineStages bounds the repositories in each stage of a run.
+type pipelineStages struct {
+	clone   semaphore
+	command semaphore
+}
+
+// handleRepository clones repo if needed and runs command in it, waiting for
+// a free slot in each stage.
+func (rh *RepositoryExecutor) handleRepository(ctx context.Context, repo *github.Repository, command string, stages *pipelineStages) *executionResult {
+	repoDir := rh.repoDir(repo)
+	result := &executionResult{
+		Repository: repo.GetFullName(),
+		Path:       repoDir,
+		Command:    command,
+	}
+	defer func() {
+		result.Finished = time.Now()
+	}()
+	rh.resetResultDir(result.Repository)
+
+	if rh.apiEdit {
+		// nothing is cloned, so only the command stage applies
+		result.Path = ""
+		if err := stages.command.acquire(ctx); err != nil {
+			result.Error = err
+			result.Status = FailedStatus
+			return result
+		}
+		defer stages.command.release()
+		result.Started = time.Now()
+		rh.emit(StatusEvent{Repository: result.Repository, Stage: RunningStage})
+		rh.editRepository(ctx, repo, result)
+		return result
+	}
+
+	if err := stages.clone.acquire(ctx); err != nil {
+		result.Error = err
+		result.Status = FailedStatus
+		return result
+	}
+	result.Started = time.Now()
+	rh.emit(StatusEvent{Repository: result.Repository, Stage: CloningStage})
+	err := rh.cloneRepository(ctx, repo, result)
+	stages.clone.release()
+	if err != nil {
+		result.Error = fmt.Errorf("cloning repository: %w", err)
+		result.Status = FailedStatus
+		return result
+	}
+
+	rh.emit(StatusEvent{Repository: result.Repository, Stage: QueuedStage})
+	if err := stages.command.acquire(ctx); err != nil {
+		result.Error = err
+		result.Status = FailedStatus
+		return result
+	}
+	defer stages.command.release()
+	rh.emit(StatusEvent{Repository: result.Repository, Stage: RunningStage})
+	rh.runRepository(ctx, repo, result)
+	return result
+}
+
+// cloneRepository clones repo into its working directory unless it is
+// already there, recording the attempts made in result.
+func (rh *RepositoryExecutor) cloneRepository(ctx context.Context, repo *github.Repository, result *executionResult) error {
+	repoDir := result.Path
+	if _, err := os.Stat(repoDir); !errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	attempts, err := rh.cloneRetry.do(ctx, rh.logger, "clone "+repo.GetFullName(), isRetryableCloneError, func() error {
+		err := rh.cloneRepo(ctx, repoDir, repo)
+		if err != nil {
+			// remove any partial clone before trying again
+			os.RemoveAll(repoDir)
+		}
+		return err
+	})
+	result.CloneAttempts = attempts
+	if err != nil {
+		rh.logger.Error("error cloning repository", zap.String("repository", repo.GetFullName()), zap.Error(err))
+		os.RemoveAll(repoDir)
+	}
+	return err
+}
+
+// runRepository runs the precondition, if any, and command in the clone of
+// repo, recording the outcome in result.
+func (rh *RepositoryExecutor) runRepository(ctx context.Context, repo *github.Repository, result *executionResult) {
+	repoDir, command := result.Path, result.Command
+	if rh.cleanup {
+		defer func() {
+			os.RemoveAll(repoDir)
+		}()
+	}
+
+	if rh.precondition != nil {
+		result.Precondition = *rh.precondition
+		stdoutBuf := &bytes.Buffer{}
+		stderrBuf := &bytes.Buffer{}
+		stdout, stderr, flush := rh.commandOutput(repo.GetFullName(), stdoutBuf, stderrBuf)
+		err := rh.execCommand(*rh.precondition, repoDir, stdout, stderr)
+		flush()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			rh.logger.Debug("precondition not met", zap.String("repository", repo.GetFullName()), zap.String("precondition", *rh.precondition), zap.Error(err))
+			result.Status = SkippedPreconditionStatus
+			return
+		} else if err != nil {
+			rh.logger.Error("error executing precondition", zap.String("repository", repo.GetFullName()), zap.String("precondition", *rh.precondition), zap.Error(err))
+			result.Stdout = stdoutBuf.String()
+			result.Stderr = stderrBuf.String()
+			result.Error = err
+			result.Status = FailedStatus
+			return
+		}
+	}
+
+	stdoutBuf := &bytes.Buffer{}
+	stderrBuf := &bytes.Buffer{}
+	var err error
+	if rh.applyPatch != nil {
+		result.Attempts = 1
+		err = rh.applyPatchTo(result)
+		if err != nil {
+			rh.logger.Error("error applying patch", zap.String("repository", repo.GetFullName()), zap.Error(err))
+		}
+	} else if rh.syncManifest != nil {
+		result.Attempts = 1
+		stdout, _, flush := rh.commandOutput(repo.GetFullName(), stdoutBuf, stderrBuf)
+		err = rh.syncFiles(repo, repoDir, stdout)
+		flush()
+		if err != nil {
+			rh.logger.Error("error syncing files", zap.String("repository", repo.GetFullName()), zap.Error(err))
+		}
+	} else if len(rh.fileEdits) > 0 {
+		result.Attempts = 1
+		stdout, _, flush := rh.commandOutput(repo.GetFullName(), stdoutBuf, stderrBuf)
+		err = rh.editFiles(repoDir, stdout)
+		flush()
+		if err != nil {
+			rh.logger.Error("error editing files", zap.String("repository", repo.GetFullName()), zap.Error(err))
+		}
 	} else {
+		result.Attempts, err = rh.commandRetry.do(ctx, rh.logger, "command in "+repo.GetFullName(), isRetryableCommandError, func() error {
+			stdoutBuf.Reset()
+			stderrBuf.Reset()
+			stdout, stderr, flush := rh.commandOutput(repo.GetFullName(), stdoutBuf, stderrBuf)
+			defer flush()
+			return rh.execCommand(command, repoDir, stdout, stderr)
+		})
+		if err != nil {
+			rh.logger.Error("error executing command", zap.String("repository", repo.GetFullName()), zap.String("command", command), zap.Error(err))
+		}
+	}
+	result.Stdout = stdoutBuf.String()
+	result.Stderr = stderrBuf.String()
+	result.Error = err
+	result.Status = SucceededStatus
+	if err != nil {
+		result.Status = FailedStatus
+	}
+	if rh.captureDiff {
+		diff, err := worktreeDiff(repoDir)
+		if err != nil {
+			rh.logger.Error("error computing diff", zap.String("repository", repo.GetFullName()), zap.Error(err))
+		}
+		result.Diff = diff
+		if err == nil {
+			rh.classifyDiff(result)
+		}
+	}
+	var exitErr *exec.ExitError
+	ranCommand := rh.applyPatch == nil && rh.syncManifest == nil && len(rh.fileEdits) == 0
+	if ranCommand && (err == nil || errors.As(err, &exitErr)) {
+		code := 0
+		if exitErr != nil {
+			code = exitErr.ExitCode()
+		}
+		result.ExitCode = &code
+	}
+	if err := rh.collectArtifacts(result); err != nil {
+		rh.logger.Error("error collecting artifacts", zap.String("repository", result.Repository), zap.Error(err))
+	}
+	if rh.commitMessage != "" && result.Status == SucceededStatus {
+		rh.publishChanges(ctx, result, func() error {
+			return rh.publish(ctx, repo, result)
+		})
+	}
+}
+
+// classifyDiff marks a successful result that changed nothing as a no-op,
+// and one that found sync drift without committing it as drifted.
+func (rh *RepositoryExecutor) classifyDiff(result *executionResult) {
+	switch {
+	case result.Status != SucceededStatus:
+	case result.Diff == "":
+		result.Status = NoOpStatus
+	case rh.syncManifest != nil && rh.commitMessage == "":
+		result.Status = DriftedStatus
+	}
+}
+
+func (rh *RepositoryExecutor) getRepositories(ctx context.Context, ch chan<- *github.Repository) error {
+	owners := rh.qualifiedNameOwners()
+	if len(rh.orgs) == 0 && len(rh.users) == 0 && len(owners) == 0 {
 		return fmt.Errorf("no user or org specified")
 	}
+
+	// the same repository may be reachable through more than one owner
+	// listing (e.g. the authenticated user's listing includes organization
+	// repositories), so deduplicate by full name.
+	seen := map[string]struct{}{}
+	dedupCh := make(chan *github.Repository)
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		defer close(dedupCh)
+		for _, org := range rh.orgs {
+			rh.logger.Debug("fetching organization repositories", zap.String("organization", org))
+			if err := rh.getRepositoriesForOrg(gctx, org, dedupCh); err != nil {
+				return err
+			}
+		}
+		for _, user := range rh.users {
+			rh.logger.Debug("fetching user repositories", zap.String("user", user))
+			var err error
+			if rh.authUser != nil && rh.authToken != nil && *rh.authUser == user {
+				err = rh.getRepositoriesForAuthenticatedUser(gctx, dedupCh)
+			} else {
+				err = rh.getRepositoriesForUser(gctx, user, dedupCh)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, fullName := range owners {
+			rh.logger.Debug("fetching repository", zap.String("repository", fullName))
+			if err := rh.getRepositoryByFullName(gctx, fullName, dedupCh); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	g.Go(func() error {
+		for repo := range dedupCh {
+			if _, ok := seen[repo.GetFullName()]; ok {
+				continue
+			}
+			seen[repo.GetFullName()] = struct{}{}
+			if err := sendRepository(gctx, ch, repo); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return g.Wait()
+}
+
+// qualifiedNameOwners returns the "owner/name" entries of the name list whose
+// owner is not already being listed through an org or user.
+func (rh *RepositoryExecutor) qualifiedNameOwners() []string {
+	listed := map[string]struct{}{}
+	for _, owner := range append(append([]string{}, rh.orgs...), rh.users...) {
+		listed[strings.ToLower(owner)] = struct{}{}
+	}
+	fullNames := []string{}
+	for name := range rh.nameSet {
+		owner, _, ok := strings.Cut(name, "/")
+		if !ok {
+			continue
+		}
+		if _, ok := listed[strings.ToLower(owner)]; ok {
+			continue
+		}
+		fullNames = append(fullNames, name)
+	}
+	sort.Strings(fullNames)
+	return fullNames
+}
+
+func (rh *RepositoryExecutor) getRepositoryByFullName(ctx context.Context, fullName string, ch chan<- *github.Repository) error {
+	owner, name, _ := strings.Cut(fullName, "/")
+	var repo *github.Repository
+	err := rh.callAPI(ctx, "get repository", func() (*github.Response, error) {
+		var resp *github.Response
+		var err error
+		repo, resp, err = rh.client.Repositories.Get(ctx, owner, name)
+		return resp, err
+	})
+	if err != nil {
+		return err
+	}
+	if rh.matchRepo(ctx, repo) {
+		return sendRepository(ctx, ch, repo)
+	}
+	return nil
+}
+
+// sendRepository sends repo on ch unless ctx is done first, so that listing
+// stops rather than blocks once nothing reads ch.
+func sendRepository(ctx context.Context, ch chan<- *github.Repository, repo *github.Repository) error {
+	select {
+	case ch <- repo:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (rh *RepositoryExecutor) getRepositoriesForOrg(ctx context.Context, org string, ch chan<- *github.Repository) error {
@@ -370,13 +977,21 @@ func (rh *RepositoryExecutor) getRepositoriesForOrg(ctx context.Context, org str
 			return ctx.Err()
 		default:
 		}
-		repos, resp, err := rh.client.Repositories.ListByOrg(ctx, org, opt)
+		var repos []*github.Repository
+		var resp *github.Response
+		err := rh.callAPI(ctx, "list organization repositories", func() (*github.Response, error) {
+			var err error
+			repos, resp, err = rh.client.Repositories.ListByOrg(ctx, org, opt)
+			return resp, err
+		})
 		if err != nil {
 			return err
 		}
 		for _, repo := range repos {
-			if rh.matchRepo(repo) {
-				ch <- repo
+			if rh.matchRepo(ctx, repo) {
+				if err := sendRepository(ctx, ch, repo); err != nil {
+					return err
+				}
 			}
 		}
 		if resp.NextPage == 0 {
@@ -397,13 +1012,21 @@ func (rh *RepositoryExecutor) getRepositoriesForUser(ctx context.Context, user s
 			return ctx.Err()
 		default:
 		}
-		repos, resp, err := rh.client.Repositories.ListByUser(ctx, user, opt)
+		var repos []*github.Repository
+		var resp *github.Response
+		err := rh.callAPI(ctx, "list user repositories", func() (*github.Response, error) {
+			var err error
+			repos, resp, err = rh.client.Repositories.ListByUser(ctx, user, opt)
+			return resp, err
+		})
 		if err != nil {
 			return err
 		}
 		for _, repo := range repos {
-			if rh.matchRepo(repo) {
-				ch <- repo
+			if rh.matchRepo(ctx, repo) {
+				if err := sendRepository(ctx, ch, repo); err != nil {
+					return err
+				}
 			}
 		}
 		if resp.NextPage == 0 {
@@ -424,13 +1047,21 @@ func (rh *RepositoryExecutor) getRepositoriesForAuthenticatedUser(ctx context.Co
 			return ctx.Err()
 		default:
 		}
-		repos, resp, err := rh.client.Repositories.ListByAuthenticatedUser(ctx, opt)
+		var repos []*github.Repository
+		var resp *github.Response
+		err := rh.callAPI(ctx, "list authenticated user repositories", func() (*github.Response, error) {
+			var err error
+			repos, resp, err = rh.client.Repositories.ListByAuthenticatedUser(ctx, opt)
+			return resp, err
+		})
 		if err != nil {
 			return err
 		}
 		for _, repo := range repos {
-			if rh.matchRepo(repo) {
-				ch <- repo
+			if rh.matchRepo(ctx, repo) {
+				if err := sendRepository(ctx, ch, repo); err != nil {
+					return err
+				}
 			}
 		}
 		if resp.NextPage == 0 {
@@ -441,46 +1072,6 @@ func (rh *RepositoryExecutor) getRepositoriesForAuthenticatedUser(ctx context.Co
 	return nil
 }
 
-func (rh *RepositoryExecutor) matchRepo(repo *github.Repository) bool {
-	if rh.nameRegexp != nil {
-		if !rh.nameRegexp.MatchString(repo.GetName()) {
-			return false
-		}
-	}
-	if rh.nameSet != nil {
-		if _, ok := rh.nameSet[repo.GetName()]; !ok {
-			return false
-		}
-	}
-	if rh.topicRegexp != nil {
-		// pass if any topic matches
-		pass := false
-		for _, topic := range repo.Topics {
-			if rh.topicRegexp.MatchString(topic) {
-				pass = true
-				break
-			}
-		}
-		if !pass {
-			return false
-		}
-	}
-	if rh.topicSet != nil {
-		// pass if any topic matches
-		pass := false
-		for _, topic := range repo.Topics {
-			if _, ok := rh.topicSet[topic]; ok {
-				pass = true
-				break
-			}
-		}
-		if !pass {
-			return false
-		}
-	}
-	return true
-}
-
 func (rh *RepositoryExecutor) execCommand(command string, dir string, stdout, stderr io.Writer) error {
 	cmd := exec.Command(rh.shellPath, "-c", command)
 	cmd.Dir = dir
@@ -493,16 +1084,9 @@ func (rh *RepositoryExecutor) execCommand(command string, dir string, stdout, st
 }
 
 func (rh *RepositoryExecutor) cloneRepo(ctx context.Context, dest string, repo *github.Repository) error {
-	var auth *http.BasicAuth
-	if rh.authUser != nil && rh.authToken != nil {
-		auth = &http.BasicAuth{
-			Username: *rh.authUser,
-			Password: *rh.authToken,
-		}
-	}
 	_, err := git.PlainCloneContext(ctx, dest, false, &git.CloneOptions{
 		URL:  repo.GetCloneURL(),
-		Auth: auth,
+		Auth: rh.gitAuth(),
 	})
 	if err != nil {
 		return err
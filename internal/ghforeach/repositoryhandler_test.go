@@ -0,0 +1,1521 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/google/go-github/v60/github"
+	"go.uber.org/zap"
+)
+
+// fakeGitHub serves just enough of the GitHub REST API to list repositories.
+// Each repository is backed by a local git repository used as its clone URL.
+type fakeGitHub struct {
+	t      *testing.T
+	dir    string
+	server *httptest.Server
+	repos  map[string][]*github.Repository
+	files  map[string]map[string]string
+	// properties are custom property values served separately from the
+	// repository listing.
+	properties map[string]map[string]string
+	// pulls are the pull requests opened by repository.
+	pulls map[string][]*github.NewPullRequest
+	// branches are the commit SHAs of the branches created through the API
+	// by repository, and commits the files committed to them.
+	branches map[string]map[string]string
+	commits  map[string][]*fakeCommit
+
+	// requests counts requests by path, failures the number of upcoming
+	// requests by path, or by method and path, to fail with a 502 and
+	// rateLimits the number to reject with a secondary rate limit.
+	mu         sync.Mutex
+	requests   map[string]int
+	failures   map[string]int
+	rateLimits map[string]int
+}
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	fg := &fakeGitHub{
+		t:          t,
+		dir:        t.TempDir(),
+		repos:      map[string][]*github.Repository{},
+		files:      map[string]map[string]string{},
+		properties: map[string]map[string]string{},
+		pulls:      map[string][]*github.NewPullRequest{},
+		branches:   map[string]map[string]string{},
+		commits:    map[string][]*fakeCommit{},
+		requests:   map[string]int{},
+		failures:   map[string]int{},
+		rateLimits: map[string]int{},
+	}
+	fg.server = httptest.NewServer(http.HandlerFunc(fg.serveHTTP))
+	t.Cleanup(fg.server.Close)
+	return fg
+}
+
+// addRepo creates a local repository for owner/name containing files and
+// registers it with the fake API.
+func (fg *fakeGitHub) addRepo(owner, name string, files map[string]string, modify func(*github.Repository)) *github.Repository {
+	fg.t.Helper()
+	dir := path.Join(fg.dir, owner, name)
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		fg.t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		fg.t.Fatal(err)
+	}
+	if files == nil {
+		files = map[string]string{"README.md": name}
+	}
+	for file, content := range files {
+		if err := os.MkdirAll(path.Dir(path.Join(dir, file)), 0700); err != nil {
+			fg.t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(dir, file), []byte(content), 0600); err != nil {
+			fg.t.Fatal(err)
+		}
+		if _, err := w.Add(file); err != nil {
+			fg.t.Fatal(err)
+		}
+	}
+	_, err = w.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		fg.t.Fatal(err)
+	}
+
+	repo := &github.Repository{
+		Name:          github.String(name),
+		FullName:      github.String(owner + "/" + name),
+		Owner:         &github.User{Login: github.String(owner)},
+		CloneURL:      github.String(dir),
+		DefaultBranch: github.String("master"),
+		Visibility:    github.String("public"),
+	}
+	if modify != nil {
+		modify(repo)
+	}
+	fg.repos[owner] = append(fg.repos[owner], repo)
+	fg.files[repo.GetFullName()] = files
+	return repo
+}
+
+func (fg *fakeGitHub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	fg.mu.Lock()
+	fg.requests[r.URL.Path]++
+	failure := r.URL.Path
+	if fg.failures[r.Method+" "+failure] > 0 {
+		failure = r.Method + " " + failure
+	}
+	fail := fg.failures[failure] > 0
+	if fail {
+		fg.failures[failure]--
+	}
+	limited := !fail && fg.rateLimits[r.URL.Path] > 0
+	if limited {
+		fg.rateLimits[r.URL.Path]--
+	}
+	fg.mu.Unlock()
+	if fail {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+		return
+	}
+	if limited {
+		w.Header().Set("Retry-After", "0")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprint(w, `{"message": "You have exceeded a secondary rate limit.", "documentation_url": "https://docs.github.com/rest/overview/rate-limits-for-the-rest-api#about-secondary-rate-limits"}`)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 4 && parts[0] == "repos" && parts[3] == "pulls":
+		fullName := parts[1] + "/" + parts[2]
+		if r.Method == http.MethodGet {
+			// pull requests are only listed to find one from the same branch
+			prs := []*github.PullRequest{}
+			fg.mu.Lock()
+			for i, pr := range fg.pulls[fullName] {
+				if r.URL.Query().Get("head") == parts[1]+":"+pr.GetHead() {
+					prs = append(prs, &github.PullRequest{HTMLURL: github.String(fmt.Sprintf("https://github.com/%s/pull/%d", fullName, i+1))})
+				}
+			}
+			fg.mu.Unlock()
+			fg.writeJSON(w, prs)
+			return
+		}
+		pr := &github.NewPullRequest{}
+		if err := json.NewDecoder(r.Body).Decode(pr); err != nil {
+			fg.t.Error(err)
+		}
+		fg.mu.Lock()
+		fg.pulls[fullName] = append(fg.pulls[fullName], pr)
+		n := len(fg.pulls[fullName])
+		fg.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		fg.writeJSON(w, &github.PullRequest{HTMLURL: github.String(fmt.Sprintf("https://github.com/%s/pull/%d", fullName, n))})
+	case len(parts) > 5 && parts[0] == "repos" && parts[3] == "git" && parts[4] == "ref" && parts[5] == "heads":
+		fullName, branch := parts[1]+"/"+parts[2], strings.Join(parts[6:], "/")
+		fg.mu.Lock()
+		sha, ok := fg.branches[fullName][branch]
+		fg.mu.Unlock()
+		if branch == "master" {
+			sha, ok = fakeBaseSHA, true
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fg.writeJSON(w, &github.Reference{
+			Ref:    github.String("refs/heads/" + branch),
+			Object: &github.GitObject{SHA: github.String(sha)},
+		})
+	case len(parts) > 4 && parts[0] == "repos" && parts[3] == "git" && parts[4] == "refs":
+		// creations name the reference in the body and updates in the path
+		body := struct {
+			Ref string `json:"ref"`
+			SHA string `json:"sha"`
+		}{Ref: "refs/" + strings.Join(parts[5:], "/")}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			fg.t.Error(err)
+		}
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		}
+		ref := &github.Reference{Ref: github.String(body.Ref), Object: &github.GitObject{SHA: github.String(body.SHA)}}
+		fullName := parts[1] + "/" + parts[2]
+		fg.mu.Lock()
+		if fg.branches[fullName] == nil {
+			fg.branches[fullName] = map[string]string{}
+		}
+		fg.branches[fullName][strings.TrimPrefix(ref.GetRef(), "refs/heads/")] = ref.GetObject().GetSHA()
+		fg.mu.Unlock()
+		fg.writeJSON(w, ref)
+	case len(parts) > 4 && parts[0] == "repos" && parts[3] == "contents" && r.Method == http.MethodPut:
+		commit := &fakeCommit{path: strings.Join(parts[4:], "/")}
+		if err := json.NewDecoder(r.Body).Decode(&commit.opts); err != nil {
+			fg.t.Error(err)
+		}
+		fullName := parts[1] + "/" + parts[2]
+		fg.mu.Lock()
+		fg.commits[fullName] = append(fg.commits[fullName], commit)
+		fg.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		fg.writeJSON(w, &github.RepositoryContentResponse{})
+	case len(parts) == 5 && parts[0] == "repos" && parts[3] == "properties" && parts[4] == "values":
+		values := []*github.CustomPropertyValue{}
+		for name, value := range fg.properties[parts[1]+"/"+parts[2]] {
+			values = append(values, &github.CustomPropertyValue{PropertyName: name, Value: github.String(value)})
+		}
+		fg.writeJSON(w, values)
+	case len(parts) > 4 && parts[0] == "repos" && parts[3] == "contents":
+		filePath := strings.Join(parts[4:], "/")
+		content, ok := fg.files[parts[1]+"/"+parts[2]][filePath]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fg.writeJSON(w, &github.RepositoryContent{
+			Type:     github.String("file"),
+			Path:     github.String(filePath),
+			Encoding: github.String("base64"),
+			Size:     github.Int(len(content)),
+			SHA:      github.String(plumbing.ComputeHash(plumbing.BlobObject, []byte(content)).String()),
+			Content:  github.String(base64.StdEncoding.EncodeToString([]byte(content))),
+		})
+	case len(parts) == 3 && (parts[0] == "orgs" || parts[0] == "users") && parts[2] == "repos":
+		fg.writeJSON(w, fg.repos[parts[1]])
+	case len(parts) == 3 && parts[0] == "repos":
+		for _, repo := range fg.repos[parts[1]] {
+			if repo.GetName() == parts[2] {
+				fg.writeJSON(w, repo)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fakeBaseSHA is the commit SHA the default branch of every repository
+// points to through the API.
+const fakeBaseSHA = "0123456789abcdef0123456789abcdef01234567"
+
+// fakeCommit is a file committed through the Contents API.
+type fakeCommit struct {
+	path string
+	opts github.RepositoryContentFileOptions
+}
+
+func (fg *fakeGitHub) requestCount(path string) int {
+	fg.mu.Lock()
+	defer fg.mu.Unlock()
+	return fg.requests[path]
+}
+
+func (fg *fakeGitHub) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fg.t.Error(err)
+	}
+}
+
+func (fg *fakeGitHub) client() *github.Client {
+	client := github.NewClient(nil)
+	u, err := url.Parse(fg.server.URL + "/")
+	if err != nil {
+		fg.t.Fatal(err)
+	}
+	client.BaseURL = u
+	return client
+}
+
+// collectResults runs command with opts and returns the results keyed by
+// repository full name.
+func collectResults(t *testing.T, fg *fakeGitHub, command string, opts ...RepositoryExecutorOption) map[string]*executionResult {
+	t.Helper()
+	results := map[string]*executionResult{}
+	opts = append([]RepositoryExecutorOption{
+		WithClient(fg.client()),
+		WithLogger(zap.NewNop()),
+		WithTmpDir(t.TempDir()),
+		WithCacheDir(""),
+		WithOutput(io.Discard),
+		withResultHook(func(result *executionResult) {
+			results[result.Repository] = result
+		}),
+	}, opts...)
+	exec, err := NewRepositoryExecutor(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Go(context.Background(), command); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestGo_multipleOwners(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("alpha", "service", nil, nil)
+	fg.addRepo("beta", "service", nil, nil)
+	fg.addRepo("gamma", "tool", nil, nil)
+	fg.addRepo("gamma", "other", nil, nil)
+
+	results := collectResults(t, fg, "pwd",
+		WithOrg("alpha"),
+		WithUser("beta"),
+		WithNameList([]string{"service", "gamma/tool"}),
+	)
+
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for _, name := range []string{"alpha/service", "beta/service", "gamma/tool"} {
+		result, ok := results[name]
+		if !ok {
+			t.Fatalf("missing result for %s", name)
+		}
+		if result.Error != nil {
+			t.Errorf("%s: %v", name, result.Error)
+		}
+		if !strings.HasSuffix(strings.TrimSpace(result.Stdout), name) {
+			t.Errorf("%s: expected owner-qualified working directory, got %q", name, result.Stdout)
+		}
+	}
+}
+
+func TestGo_contentPredicates(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "go-service", map[string]string{"go.mod": "module example.com/go-service\n\nrequire oldlib v1.0.0\n"}, nil)
+	fg.addRepo("org", "go-owned", map[string]string{"go.mod": "module example.com/go-owned\n", "CODEOWNERS": "* @org/team\n"}, nil)
+	fg.addRepo("org", "node-service", map[string]string{"package.json": "{}"}, nil)
+
+	cacheDir := t.TempDir()
+	opts := []RepositoryExecutorOption{
+		WithOrg("org"),
+		WithPathExists("go.mod"),
+		WithPathMissing("CODEOWNERS"),
+		WithPathContentRegexp("go.mod", "oldlib"),
+		WithCacheDir(cacheDir),
+	}
+	results := collectResults(t, fg, "ls", opts...)
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if _, ok := results["org/go-service"]; !ok {
+		t.Fatal("expected result for org/go-service")
+	}
+
+	// a second run is answered from the cache
+	before := fg.requestCount("/repos/org/go-service/contents/go.mod")
+	results = collectResults(t, fg, "ls", opts...)
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if after := fg.requestCount("/repos/org/go-service/contents/go.mod"); after != before {
+		t.Errorf("expected cached contents checks, got %d more requests", after-before)
+	}
+}
+
+func TestGo_properties(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "payments", nil, nil)
+	fg.properties["org/payments"] = map[string]string{"tier": "critical", "owner-team": "payments"}
+	fg.addRepo("org", "ledger", nil, func(r *github.Repository) {
+		r.CustomProperties = map[string]string{"tier": "critical", "owner-team": "ledger", "runtime": "go"}
+	})
+	fg.addRepo("org", "docs", nil, nil)
+	fg.properties["org/docs"] = map[string]string{"tier": "low"}
+
+	results := collectResults(t, fg, "ls",
+		WithOrg("org"),
+		WithProperty("tier=critical"),
+		WithProperty("owner-team=~^pay"),
+		WithProperty("!runtime"),
+	)
+	if len(results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(results))
+	}
+	if _, ok := results["org/payments"]; !ok {
+		t.Fatal("expected result for org/payments")
+	}
+	if n := fg.requestCount("/repos/org/ledger/properties/values"); n != 0 {
+		t.Errorf("expected listed properties to be used, got %d requests", n)
+	}
+}
+
+func TestGo_precondition(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "old", map[string]string{"go.mod": "require oldlib v1.0.0\n"}, nil)
+	fg.addRepo("org", "new", map[string]string{"go.mod": "require newlib v1.0.0\n"}, nil)
+
+	results := collectResults(t, fg, "echo ran",
+		WithOrg("org"),
+		WithPrecondition("grep -q oldlib go.mod"),
+	)
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	if old := results["org/old"]; old.Status != SucceededStatus || old.Stdout != "ran\n" {
+		t.Errorf("expected org/old to run, got status %q and stdout %q", old.Status, old.Stdout)
+	}
+	if new := results["org/new"]; new.Status != SkippedPreconditionStatus || new.Stdout != "" || new.Error != nil {
+		t.Errorf("expected org/new to be skipped, got status %q, stdout %q and error %v", new.Status, new.Stdout, new.Error)
+	}
+}
+
+// failingJournal fails writes of the run state journal that fail reports.
+type failingJournal struct {
+	journalFile
+	fail func(entry []byte) bool
+}
+
+func (fj *failingJournal) Write(p []byte) (int, error) {
+	if fj.fail(p) {
+		return 0, errors.New("disk full")
+	}
+	return fj.journalFile.Write(p)
+}
+
+func TestGo_journalFailure(t *testing.T) {
+	fg := newFakeGitHub(t)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		fg.addRepo("org", name, nil, nil)
+	}
+
+	// the third repository cannot be journaled as pending, while the
+	// results of the two before it still can
+	var mu sync.Mutex
+	pending, finished := 0, 0
+	exec, err := NewRepositoryExecutor(
+		WithClient(fg.client()),
+		WithLogger(zap.NewNop()),
+		WithCacheDir(""),
+		WithOutput(io.Discard),
+		WithTmpDir(t.TempDir()),
+		WithOrg("org"),
+		WithConcurrency(4),
+		withRunStateHook(func(rs *runState) {
+			rs.file = &failingJournal{journalFile: rs.file, fail: func(entry []byte) bool {
+				mu.Lock()
+				defer mu.Unlock()
+				if !bytes.Contains(entry, []byte(`"status":"pending"`)) {
+					finished++
+					return false
+				}
+				pending++
+				return pending == 3
+			}}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Go(context.Background(), "sleep 0.2"); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("expected the journal error, got %v", err)
+	}
+	// the repositories already dispatched finished before Go returned
+	mu.Lock()
+	defer mu.Unlock()
+	if finished != 2 {
+		t.Errorf("expected the results of 2 repositories to be journaled, got %d", finished)
+	}
+}
+
+func TestGo_resume(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", nil, nil)
+	fg.addRepo("org", "b", nil, nil)
+	fg.addRepo("org", "c", nil, nil)
+
+	dir := t.TempDir()
+	log := path.Join(dir, "log")
+	failMarker := path.Join(dir, "fail-b")
+	if err := os.WriteFile(failMarker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	command := fmt.Sprintf(`name=$(basename "$PWD"); echo $name >> %s; test ! -e %s-$name`, log, path.Join(dir, "fail"))
+	tmpDir := path.Join(dir, "tmp")
+
+	results := collectResults(t, fg, command, WithOrg("org"), WithTmpDir(tmpDir))
+	if results["org/b"].Status != FailedStatus {
+		t.Fatalf("expected org/b to fail, got %q", results["org/b"].Status)
+	}
+
+	// a resumed run with different filters is refused
+	exec, err := NewRepositoryExecutor(
+		WithClient(fg.client()),
+		WithLogger(zap.NewNop()),
+		WithCacheDir(""),
+		WithOrg("org"),
+		WithTmpDir(tmpDir),
+		WithNameRegexp("a"),
+		WithResume(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Go(context.Background(), command); err == nil || !strings.Contains(err.Error(), "cannot resume") {
+		t.Fatalf("expected resume to be refused, got %v", err)
+	}
+
+	if err := os.Remove(failMarker); err != nil {
+		t.Fatal(err)
+	}
+	results = collectResults(t, fg, command, WithOrg("org"), WithTmpDir(tmpDir), WithResume(true))
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	for name, result := range results {
+		if result.Status != SucceededStatus {
+			t.Errorf("%s: expected success, got %q", name, result.Status)
+		}
+		if result.Resumed != (name != "org/b") {
+			t.Errorf("%s: unexpected resumed %v", name, result.Resumed)
+		}
+	}
+	bytes, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs := strings.Fields(string(bytes)); len(runs) != 4 || runs[3] != "b" {
+		t.Errorf("expected only b to be rerun, got runs %v", runs)
+	}
+}
+
+func TestGo_retries(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", nil, nil)
+	fg.failures["/orgs/org/repos"] = 2
+
+	policy := RetryPolicy{Retries: 2, InitialBackoff: time.Millisecond}
+	marker := path.Join(t.TempDir(), "ran")
+	results := collectResults(t, fg, fmt.Sprintf("test -e %[1]s || { touch %[1]s; exit 1; }", marker),
+		WithOrg("org"),
+		WithAPIRetryPolicy(policy),
+		WithCommandRetryPolicy(policy),
+	)
+	result, ok := results["org/a"]
+	if !ok {
+		t.Fatal("expected result for org/a after retried listing")
+	}
+	if result.Status != SucceededStatus || result.Attempts != 2 || result.CloneAttempts != 1 {
+		t.Errorf("expected success after 2 attempts and 1 clone attempt, got %q after %d and %d", result.Status, result.Attempts, result.CloneAttempts)
+	}
+	if n := fg.requestCount("/orgs/org/repos"); n != 3 {
+		t.Errorf("expected 3 listing requests, got %d", n)
+	}
+}
+
+func TestGo_resumeTruncatedJournal(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", nil, nil)
+	fg.addRepo("org", "b", nil, nil)
+
+	dir := t.TempDir()
+	log := path.Join(dir, "log")
+	failMarker := path.Join(dir, "fail-b")
+	if err := os.WriteFile(failMarker, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	command := fmt.Sprintf(`name=$(basename "$PWD"); echo $name >> %s; test ! -e %s-$name`, log, path.Join(dir, "fail"))
+	tmpDir := path.Join(dir, "tmp")
+	collectResults(t, fg, command, WithOrg("org"), WithTmpDir(tmpDir))
+
+	// the run died while writing an entry
+	journal := path.Join(tmpDir, runStateFile)
+	file, err := os.OpenFile(journal, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(`{"time":"2024-01-01T00:00:00Z","repository":"org/`); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// resuming reruns b, and a second resume has nothing left to run
+	if err := os.Remove(failMarker); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		results := collectResults(t, fg, command, WithOrg("org"), WithTmpDir(tmpDir), WithResume(true))
+		if b := results["org/b"]; b.Status != SucceededStatus || b.Resumed != (i == 1) {
+			t.Errorf("resume %d: expected org/b to succeed, resumed %t, got %s resumed %t", i+1, i == 1, b.Status, b.Resumed)
+		}
+	}
+	bytes, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs := strings.Fields(string(bytes)); len(runs) != 3 || runs[2] != "b" {
+		t.Errorf("expected only b to be rerun once, got runs %v", runs)
+	}
+	bytes, err = os.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range strings.Split(strings.TrimSuffix(string(bytes), "\n"), "\n") {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("expected line %d of the journal to be valid, got %q", i+1, line)
+		}
+	}
+}
+
+func TestGo_rateLimits(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", nil, nil)
+	fg.rateLimits["/orgs/org/repos"] = 2
+
+	results := collectResults(t, fg, "true",
+		WithOrg("org"),
+		WithAPIRetryPolicy(RetryPolicy{}),
+		WithAPIConcurrency(1),
+	)
+	if result, ok := results["org/a"]; !ok || result.Status != SucceededStatus {
+		t.Fatalf("expected org/a to succeed once the rate limit lifted, got %v", results)
+	}
+	if n := fg.requestCount("/orgs/org/repos"); n != 3 {
+		t.Errorf("expected 3 listing requests, got %d", n)
+	}
+
+	// a limit that does not lift fails the request eventually
+	fg.requests = map[string]int{}
+	fg.rateLimits["/orgs/org/repos"] = maxRateLimitWaits + 5
+	exec, err := NewRepositoryExecutor(WithClient(fg.client()), WithTmpDir(t.TempDir()), WithCacheDir(""), WithLogger(zap.NewNop()), WithOutput(io.Discard),
+		WithOrg("org"),
+		WithAPIRetryPolicy(RetryPolicy{}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Go(context.Background(), "true"); err == nil {
+		t.Error("expected listing to fail while rate limited")
+	}
+	if n := fg.requestCount("/orgs/org/repos"); n != maxRateLimitWaits+1 {
+		t.Errorf("expected %d listing requests, got %d", maxRateLimitWaits+1, n)
+	}
+}
+
+func TestRateLimitWait(t *testing.T) {
+	retryAfter := 5 * time.Second
+	reset := time.Now().Add(time.Hour)
+	for _, tc := range []struct {
+		name    string
+		err     error
+		limited bool
+		wait    time.Duration
+	}{
+		{"nil", nil, false, 0},
+		{"primary", &github.RateLimitError{Rate: github.Rate{Reset: github.Timestamp{Time: reset}}}, true, time.Hour},
+		{"secondary", &github.AbuseRateLimitError{RetryAfter: &retryAfter}, true, retryAfter},
+		{"secondary without retry after", &github.AbuseRateLimitError{}, true, defaultSecondaryRateLimitWait},
+		{"too many requests", &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}}, true, defaultSecondaryRateLimitWait},
+		{"forbidden", &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusForbidden, Header: http.Header{}}}, false, 0},
+		{"server error", &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusBadGateway, Header: http.Header{}}}, false, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			wait, limited := rateLimitWait(tc.err)
+			if limited != tc.limited {
+				t.Fatalf("expected limited %v, got %v", tc.limited, limited)
+			}
+			if d := wait - tc.wait; d > time.Second || d < -time.Second {
+				t.Errorf("expected wait of about %v, got %v", tc.wait, wait)
+			}
+		})
+	}
+}
+
+func TestGo_pipelineStages(t *testing.T) {
+	fg := newFakeGitHub(t)
+	for _, name := range []string{"a", "b", "c"} {
+		fg.addRepo("org", name, nil, nil)
+	}
+
+	// with one command slot, the first command can only see every clone if
+	// cloning continues while it runs
+	command := `for i in $(seq 500); do [ -d ../a ] && [ -d ../b ] && [ -d ../c ] && exit 0; sleep 0.01; done; exit 1`
+	results := collectResults(t, fg, command,
+		WithOrg("org"),
+		WithConcurrency(1),
+		WithCloneConcurrency(-1),
+	)
+	for _, name := range []string{"org/a", "org/b", "org/c"} {
+		if result, ok := results[name]; !ok || result.Status != SucceededStatus {
+			t.Errorf("expected %s to succeed, got %v", name, result)
+		}
+	}
+}
+
+func TestGo_pipelineLimit(t *testing.T) {
+	fg := newFakeGitHub(t)
+	for i := 0; i < 12; i++ {
+		fg.addRepo("org", fmt.Sprintf("repo%02d", i), nil, nil)
+	}
+
+	// clones are fast and commands slow, yet at most 2 clones and 1 command
+	// are in flight at once
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	results := collectResults(t, fg, "sleep 0.05",
+		WithOrg("org"),
+		WithConcurrency(1),
+		WithCloneConcurrency(2),
+		WithStatusListener(func(event StatusEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			switch event.Stage {
+			case CloningStage:
+				inFlight++
+				most = max(most, inFlight)
+			case DoneStage:
+				inFlight--
+			}
+		}),
+	)
+	if len(results) != 12 {
+		t.Fatalf("expected 12 results, got %d", len(results))
+	}
+	if most > 3 {
+		t.Errorf("expected at most 3 repositories in flight, got %d", most)
+	}
+}
+
+func TestGo_cancelWhileListing(t *testing.T) {
+	fg := newFakeGitHub(t)
+	for i := 0; i < 50; i++ {
+		fg.addRepo("org", fmt.Sprintf("repo%02d", i), nil, nil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	exec, err := NewRepositoryExecutor(
+		WithClient(fg.client()),
+		WithLogger(zap.NewNop()),
+		WithTmpDir(t.TempDir()),
+		WithCacheDir(""),
+		WithOutput(io.Discard),
+		WithOrg("org"),
+		// cancel as soon as the first repository is listed, while the rest
+		// are still being sent
+		WithStatusListener(func(event StatusEvent) {
+			if event.Stage == QueuedStage {
+				cancel()
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- exec.Go(ctx, "true")
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the run to stop once cancelled")
+	}
+}
+
+func TestGo_streamOutput(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", nil, nil)
+	fg.addRepo("org", "long-name", nil, nil)
+
+	stream := &bytes.Buffer{}
+	results := collectResults(t, fg, `echo one; echo two >&2; printf three`,
+		WithOrg("org"),
+		WithConcurrency(2),
+		WithStreamOutput(stream, false),
+	)
+	for _, name := range []string{"org/a", "org/long-name"} {
+		if result := results[name]; result == nil || result.Stdout != "one\nthree" || result.Stderr != "two\n" {
+			t.Errorf("expected full output in result for %s, got %v", name, result)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(stream.String(), "\n"), "\n")
+	counts := map[string]int{}
+	for _, line := range lines {
+		counts[line]++
+	}
+	// every line is aligned to the same width from the start
+	long, short := "[org/long-name]"+strings.Repeat(" ", streamPrefixWidth-13)+" ", "[org/a]"+strings.Repeat(" ", streamPrefixWidth-5)+" "
+	for _, line := range []string{
+		long + "one",
+		long + "two",
+		long + "three",
+		short + "one",
+		short + "two",
+		short + "three",
+	} {
+		if counts[line] != 1 {
+			t.Errorf("expected streamed line %q once, got:\n%s", line, stream.String())
+		}
+	}
+}
+
+func TestGo_streamDiff(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", nil, nil)
+
+	stream := &bytes.Buffer{}
+	collectResults(t, fg, `echo new > new.txt`,
+		WithOrg("org"),
+		WithDiff(true),
+		WithStreamOutput(stream, false),
+	)
+	prefix := "[org/a]" + strings.Repeat(" ", streamPrefixWidth-5) + " "
+	for _, line := range []string{prefix + SucceededStatus, prefix + "+++ b/new.txt", prefix + "+new"} {
+		if !strings.Contains(stream.String(), line+"\n") {
+			t.Errorf("expected streamed line %q, got:\n%s", line, stream.String())
+		}
+	}
+}
+
+func TestGo_statusEvents(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", nil, nil)
+
+	var mu sync.Mutex
+	stages := []RepositoryStage{}
+	collectResults(t, fg, "true",
+		WithOrg("org"),
+		WithStatusListener(func(event StatusEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			stages = append(stages, event.Stage)
+			if event.Stage == DoneStage && event.Status != SucceededStatus {
+				t.Errorf("expected done event to carry success, got %q", event.Status)
+			}
+		}),
+	)
+	if !slices.Contains(stages, ListedStage) {
+		t.Errorf("expected listed event, got %v", stages)
+	}
+	repoStages := slices.DeleteFunc(slices.Clone(stages), func(stage RepositoryStage) bool { return stage == ListedStage })
+	expected := []RepositoryStage{QueuedStage, CloningStage, QueuedStage, RunningStage, DoneStage}
+	if !slices.Equal(repoStages, expected) {
+		t.Errorf("expected stages %v, got %v", expected, repoStages)
+	}
+}
+
+func TestGo_summary(t *testing.T) {
+	fg := newFakeGitHub(t)
+	for _, name := range []string{"a", "b", "c", "odd", "skip"} {
+		fg.addRepo("org", name, nil, nil)
+	}
+
+	out := &bytes.Buffer{}
+	collectResults(t, fg, `case $(basename $PWD) in odd) echo different; exit 1;; *) echo ok;; esac`,
+		WithOrg("org"),
+		WithPrecondition(`[ $(basename $PWD) != skip ]`),
+		WithOutputFormat(JsonOutputFormat),
+		WithOutput(out),
+	)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("expected 5 results and a summary, got:\n%s", out.String())
+	}
+	var summary struct {
+		Summary *runSummary `json:"summary"`
+	}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &summary); err != nil || summary.Summary == nil {
+		t.Fatalf("expected summary at end of stream, got %q: %v", lines[len(lines)-1], err)
+	}
+	got := summary.Summary
+	if got.Total != 5 || got.Statuses[SucceededStatus] != 3 || got.Statuses[FailedStatus] != 1 || got.Statuses[SkippedPreconditionStatus] != 1 {
+		t.Errorf("unexpected totals: %d %v", got.Total, got.Statuses)
+	}
+	if len(got.Failures) != 1 || got.Failures[0].Repository != "org/odd" || got.Failures[0].Error != "exit status 1" {
+		t.Errorf("unexpected failures: %v", got.Failures)
+	}
+	if len(got.Outputs) != 2 || got.Outputs[0].Stdout != "ok\n" || !slices.Equal(got.Outputs[0].Repositories, []string{"org/a", "org/b", "org/c"}) {
+		t.Errorf("unexpected output groups: %+v", got.Outputs)
+	}
+}
+
+func TestGo_resultsDir(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", nil, nil)
+	fg.addRepo("org", "b", nil, nil)
+
+	resultsDir := t.TempDir()
+	collectResults(t, fg, `mkdir -p pkg && echo cover > pkg/coverage.out && echo '{}' > report.json && echo out && echo err >&2 && [ $(basename $PWD) = a ] || exit 3`,
+		WithOrg("org"),
+		WithCleanup(true),
+		WithResultsDir(resultsDir),
+		WithArtifactGlob("coverage.out"),
+		WithArtifactGlob("./report.json"),
+		WithArtifactGlob("pkg/*.json"),
+	)
+
+	read := func(p string) string {
+		bytes, err := os.ReadFile(path.Join(resultsDir, p))
+		if err != nil {
+			t.Error(err)
+		}
+		return string(bytes)
+	}
+	for p, expected := range map[string]string{
+		"org/a/stdout":                     "out\n",
+		"org/a/stderr":                     "err\n",
+		"org/a/exit_status":                "0\n",
+		"org/b/exit_status":                "3\n",
+		"org/a/artifacts/pkg/coverage.out": "cover\n",
+		"org/b/artifacts/report.json":      "{}\n",
+	} {
+		if got := read(p); got != expected {
+			t.Errorf("expected %s to contain %q, got %q", p, expected, got)
+		}
+	}
+
+	index := resultsIndex{}
+	if err := json.Unmarshal([]byte(read(resultsIndexFile)), &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Results) != 2 {
+		t.Fatalf("expected 2 results in index, got %+v", index)
+	}
+	b := index.Results[1]
+	if b.Repository != "org/b" || b.Status != FailedStatus || b.ExitCode == nil || *b.ExitCode != 3 ||
+		!slices.Equal(b.Artifacts, []string{"org/b/artifacts/pkg/coverage.out", "org/b/artifacts/report.json"}) {
+		t.Errorf("unexpected index entry %+v", b)
+	}
+}
+
+func TestGo_diff(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", map[string]string{"README.md": "one\ntwo\nthree\n", "old.txt": "old\n"}, nil)
+	fg.addRepo("org", "b", nil, nil)
+
+	patchFile := path.Join(t.TempDir(), "changes.patch")
+	results := collectResults(t, fg, `[ $(basename $PWD) = b ] || { sed -i s/two/2/ README.md && rm old.txt && echo new > new.txt; }`,
+		WithOrg("org"),
+		WithPatchFile(patchFile),
+	)
+
+	a := results["org/a"]
+	if a.Status != SucceededStatus {
+		t.Fatalf("expected org/a to succeed, got %s: %v", a.Status, a.Error)
+	}
+	for _, line := range []string{"diff --git a/README.md b/README.md", "-two", "+2", "deleted file mode 100644", "--- a/old.txt", "new file mode 100644", "+++ b/new.txt", "+new"} {
+		if !strings.Contains(a.Diff, line+"\n") {
+			t.Errorf("expected diff of org/a to contain %q, got:\n%s", line, a.Diff)
+		}
+	}
+	if b := results["org/b"]; b.Status != NoOpStatus || b.Diff != "" {
+		t.Errorf("expected org/b to be a no-op, got %s with diff %q", b.Status, b.Diff)
+	}
+
+	patch, err := os.ReadFile(patchFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(patch) != "ghforeach: org/a\n"+a.Diff {
+		t.Errorf("unexpected patch file:\n%s", patch)
+	}
+}
+
+func TestGo_pullRequests(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", nil, nil)
+	fg.addRepo("org", "b", nil, nil)
+
+	command := `[ $(basename $PWD) = b ] || echo changed > README.md`
+	opts := []RepositoryExecutorOption{
+		WithOrg("org"),
+		WithCommitMessage("Update README\n\nAs requested."),
+		WithCommitAuthor("test", "test@example.com"),
+		WithPullRequest(true),
+	}
+	results := collectResults(t, fg, command, opts...)
+	a := results["org/a"]
+	if a.Status != SucceededStatus || a.PullRequestURL != "https://github.com/org/a/pull/1" {
+		t.Fatalf("expected a pull request for org/a, got %s %q: %v", a.Status, a.PullRequestURL, a.Error)
+	}
+	if b := results["org/b"]; b.Status != NoOpStatus || b.PullRequestURL != "" {
+		t.Errorf("expected org/b to be a no-op without a pull request, got %s %q", b.Status, b.PullRequestURL)
+	}
+	pr := fg.pulls["org/a"][0]
+	if pr.GetTitle() != "Update README" || pr.GetBody() != "As requested." || pr.GetHead() != "ghforeach" || pr.GetBase() != "master" {
+		t.Errorf("unexpected pull request %+v", pr)
+	}
+
+	// the branch was pushed with the commit
+	r, err := git.PlainOpen(path.Join(fg.dir, "org", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := r.Reference("refs/heads/ghforeach", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := commit.File("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := file.Contents(); contents != "changed\n" || commit.Author.Name != "test" {
+		t.Errorf("unexpected commit by %s with README.md %q", commit.Author.Name, contents)
+	}
+
+	// a second run does not replace the branch pushed by the first
+	command = `[ $(basename $PWD) = b ] || echo changed again > README.md`
+	results = collectResults(t, fg, command, opts...)
+	if a := results["org/a"]; a.Status != FailedStatus || a.Error == nil || !strings.Contains(a.Error.Error(), "already exists with other commits") {
+		t.Errorf("expected pushing over the existing branch to fail, got %s: %v", a.Status, a.Error)
+	}
+	if ref, err := r.Reference("refs/heads/ghforeach", true); err != nil || ref.Hash() != commit.Hash {
+		t.Errorf("expected the branch to be left at %s, got %v: %v", commit.Hash, ref, err)
+	}
+
+	// unless forced, and then reuses the open pull request
+	results = collectResults(t, fg, command, append(opts, WithForcePush(true))...)
+	if a := results["org/a"]; a.Status != SucceededStatus || a.PullRequestURL != "https://github.com/org/a/pull/1" || len(fg.pulls["org/a"]) != 1 {
+		t.Errorf("expected the pull request to be reused, got %s %q and %d pull requests: %v", a.Status, a.PullRequestURL, len(fg.pulls["org/a"]), a.Error)
+	}
+	if ref, err := r.Reference("refs/heads/ghforeach", true); err != nil || ref.Hash() == commit.Hash {
+		t.Errorf("expected the branch to be replaced, got %v: %v", ref, err)
+	}
+
+	exec, err := NewRepositoryExecutor(WithClient(fg.client()), WithOrg("org"), WithCommitMessage("a"), WithForcePush(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Go(context.Background(), "true"); err == nil || !strings.Contains(err.Error(), "requires pushing") {
+		t.Errorf("expected force-pushing without pushing to be rejected, got %v", err)
+	}
+}
+
+// reviewAnswers answers each review prompt written to out with the next
+// answer for the repository under review.
+type reviewAnswers struct {
+	out     *bytes.Buffer
+	answers map[string][]string
+}
+
+func (ra *reviewAnswers) Read(p []byte) (int, error) {
+	out := ra.out.Bytes()
+	i := bytes.LastIndex(out, []byte("===== review "))
+	if i < 0 {
+		return 0, io.EOF
+	}
+	repository := strings.Fields(string(out[i+len("===== review "):]))[0]
+	answers := ra.answers[repository]
+	if len(answers) == 0 {
+		return 0, io.EOF
+	}
+	ra.answers[repository] = answers[1:]
+	return copy(p, answers[0]+"\n"), nil
+}
+
+func TestGo_review(t *testing.T) {
+	fg := newFakeGitHub(t)
+	for _, name := range []string{"a", "b", "c"} {
+		fg.addRepo("org", name, nil, nil)
+	}
+	decisionsFile := path.Join(t.TempDir(), "decisions.json")
+	command := `echo changed > README.md`
+	opts := []RepositoryExecutorOption{
+		WithOrg("org"),
+		WithCommitMessage("Update README"),
+		WithCommitAuthor("test", "test@example.com"),
+		WithDecisionsFile(decisionsFile),
+	}
+
+	// the shell undoes the change, leaving nothing to review
+	shell := path.Join(t.TempDir(), "shell")
+	if err := os.WriteFile(shell, []byte("#!/bin/sh\nprintf c > README.md\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SHELL", shell)
+	out := &bytes.Buffer{}
+	answers := &reviewAnswers{out: out, answers: map[string][]string{
+		"org/a": {"a"},
+		"org/b": {"x", "s"},
+		"org/c": {"h"},
+	}}
+	results := collectResults(t, fg, command, append(opts, WithReview(answers, out))...)
+	for repository, expected := range map[string]ExecutionStatus{
+		"org/a": SucceededStatus,
+		"org/b": SkippedReviewStatus,
+		"org/c": NoOpStatus,
+	} {
+		if status := results[repository].Status; status != expected {
+			t.Errorf("expected %s to be %s after review, got %s: %v", repository, expected, status, results[repository].Error)
+		}
+	}
+	if !strings.Contains(out.String(), `unrecognized choice "x"`) || !strings.Contains(out.String(), "===== review org/c: no changes left") {
+		t.Errorf("unexpected review output:\n%s", out)
+	}
+
+	// the decisions are applied to a later run without review
+	results = collectResults(t, fg, command, append(opts, WithPush(true))...)
+	for repository, expected := range map[string]ExecutionStatus{
+		"org/a": SucceededStatus,
+		"org/b": SkippedReviewStatus,
+		"org/c": SkippedReviewStatus,
+	} {
+		if status := results[repository].Status; status != expected {
+			t.Errorf("expected %s to be %s when applying decisions, got %s: %v", repository, expected, status, results[repository].Error)
+		}
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		r, err := git.PlainOpen(path.Join(fg.dir, "org", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.Reference("refs/heads/ghforeach", false)
+		if pushed := err == nil; pushed != (name == "a") {
+			t.Errorf("expected only org/a to be pushed, got org/%s pushed: %v", name, pushed)
+		}
+	}
+
+	// changes that differ from those reviewed are not published
+	results = collectResults(t, fg, `echo different > README.md`, opts...)
+	if a := results["org/a"]; a.Status != FailedStatus || a.Error == nil || !strings.Contains(a.Error.Error(), "differ from those approved") {
+		t.Errorf("expected changed changes to fail, got %s: %v", a.Status, a.Error)
+	}
+}
+
+func TestGo_reviewAbort(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", nil, nil)
+
+	out := &bytes.Buffer{}
+	exec, err := NewRepositoryExecutor(
+		WithClient(fg.client()),
+		WithLogger(zap.NewNop()),
+		WithTmpDir(t.TempDir()),
+		WithCacheDir(""),
+		WithOutput(io.Discard),
+		WithOrg("org"),
+		WithCommitMessage("Update README"),
+		WithReview(&reviewAnswers{out: out, answers: map[string][]string{"org/a": {"q"}}}, out),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Go(context.Background(), `echo changed > README.md`); !errors.Is(err, errReviewAborted) {
+		t.Errorf("expected the run to be aborted, got %v", err)
+	}
+}
+
+func TestGo_applyPatch(t *testing.T) {
+	original := "1\n2\n3\n4\n5\n6\n7\n8\n9\n"
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", map[string]string{"numbers.txt": original}, nil)
+	fg.addRepo("org", "b", map[string]string{"numbers.txt": strings.Replace(original, "5", "five", 1)}, nil)
+	fg.addRepo("org", "c", map[string]string{"numbers.txt": original}, nil)
+
+	// c has moved on from the original, in the context of the hunk
+	dir := path.Join(fg.dir, "org", "c")
+	if err := os.WriteFile(path.Join(dir, "numbers.txt"), []byte(strings.Replace(original, "2", "two", 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Commit("second commit", &git.CommitOptions{
+		All:    true,
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	hash := plumbing.ComputeHash(plumbing.BlobObject, []byte(original)).String()[:7]
+	patch, err := ParsePatch("numbers.patch", []byte(`diff --git a/numbers.txt b/numbers.txt
+index `+hash+`..1234567 100644
+--- a/numbers.txt
++++ b/numbers.txt
+@@ -2,7 +2,7 @@
+ 2
+ 3
+ 4
+-5
++FIVE
+ 6
+ 7
+ 8
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := collectResults(t, fg, "", WithOrg("org"), WithApplyPatch(patch))
+	if a := results["org/a"]; a.Status != SucceededStatus || a.Command != "apply numbers.patch" || !strings.Contains(a.Diff, "+FIVE\n") {
+		t.Errorf("expected the patch to apply to org/a, got %s: %v\n%s", a.Status, a.Error, a.Diff)
+	}
+	b := results["org/b"]
+	if b.Status != FailedStatus || b.Diff != "" || !strings.Contains(b.Rejects, "@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+FIVE\n") {
+		t.Errorf("expected the hunk to be rejected in org/b, got %s: %v\n%s", b.Status, b.Error, b.Rejects)
+	}
+	if c := results["org/c"]; c.Status != FailedStatus || c.Rejects == "" {
+		t.Errorf("expected the hunk to be rejected in org/c without a three-way merge, got %s", c.Status)
+	}
+
+	results = collectResults(t, fg, "", WithOrg("org"), WithApplyPatch(patch), WithThreeWay(true))
+	if c := results["org/c"]; c.Status != SucceededStatus || !strings.Contains(c.Diff, " two\n") || !strings.Contains(c.Diff, "+FIVE\n") {
+		t.Errorf("expected the patch to merge into org/c, got %s: %v\n%s", c.Status, c.Error, c.Diff)
+	}
+	if b := results["org/b"]; b.Status != FailedStatus {
+		t.Errorf("expected org/b to conflict, got %s", b.Status)
+	}
+}
+
+func TestGo_applyPatchMode(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", map[string]string{"numbers.txt": "1\n"}, nil)
+
+	patch, err := ParsePatch("modes.patch", []byte(`diff --git a/run.sh b/run.sh
+new file mode 100755
+--- /dev/null
++++ b/run.sh
+@@ -0,0 +1 @@
++echo run
+diff --git a/numbers.txt b/numbers.txt
+old mode 100644
+new mode 100755
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := collectResults(t, fg, "", WithOrg("org"), WithApplyPatch(patch))
+	a := results["org/a"]
+	if a.Status != SucceededStatus {
+		t.Fatalf("expected the patch to apply to org/a, got %s: %v\n%s", a.Status, a.Error, a.Rejects)
+	}
+	for _, name := range []string{"run.sh", "numbers.txt"} {
+		info, err := os.Stat(path.Join(a.Path, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm()&0100 == 0 {
+			t.Errorf("expected %s to be executable, got %v", name, info.Mode())
+		}
+	}
+}
+
+func TestGo_sync(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", map[string]string{
+		"LICENSE":            "MIT\n",
+		".github/CODEOWNERS": "docs/ @org/writers\n* @org/maintainers\n",
+		".editorconfig":      "custom\n",
+		"config.yml":         "# keep\na:\n  b: 2\n  c: 3\n",
+	}, nil)
+	fg.addRepo("org", "b", nil, nil)
+	fg.addRepo("org", "c", map[string]string{
+		"LICENSE":            "MIT\n",
+		".github/CODEOWNERS": "* @org/maintainers\n",
+		".editorconfig":      "custom\n",
+		"config.yml":         "a:\n  b: 1 # old\n",
+	}, nil)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "LICENSE"), []byte("MIT\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	manifestFile := path.Join(dir, "sync.yml")
+	if err := os.WriteFile(manifestFile, []byte(`files:
+  - dest: LICENSE
+    source: LICENSE
+  - dest: .github/CODEOWNERS
+    content: "* @{{ .Owner }}/maintainers\n"
+    template: true
+    mode: merge
+  - dest: .editorconfig
+    content: "root = true\n"
+    mode: create-only
+  - dest: config.yml
+    content: "a:\n  b: 2\n"
+    mode: merge
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadSyncManifest(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := collectResults(t, fg, "", WithOrg("org"), WithSyncManifest(manifest))
+	if a := results["org/a"]; a.Status != NoOpStatus {
+		t.Errorf("expected org/a to be in sync, got %s: %v\n%s", a.Status, a.Error, a.Diff)
+	}
+	if b := results["org/b"]; b.Status != DriftedStatus || b.Stdout != "LICENSE: missing\n.github/CODEOWNERS: missing\n.editorconfig: missing\nconfig.yml: missing\n" {
+		t.Errorf("expected org/b to be missing every file, got %s: %v\n%s", b.Status, b.Error, b.Stdout)
+	}
+	c := results["org/c"]
+	if c.Status != DriftedStatus || c.Stdout != "config.yml: differs\n" || !strings.Contains(c.Diff, "-  b: 1 # old\n+  b: 2 # old\n") {
+		t.Errorf("expected config.yml to differ in org/c, got %s: %v\n%s%s", c.Status, c.Error, c.Stdout, c.Diff)
+	}
+
+	results = collectResults(t, fg, "", WithOrg("org"), WithSyncManifest(manifest),
+		WithCommitMessage("Sync files"),
+		WithCommitAuthor("test", "test@example.com"),
+		WithPullRequest(true),
+	)
+	for _, name := range []string{"b", "c"} {
+		if result := results["org/"+name]; result.Status != SucceededStatus || result.PullRequestURL == "" {
+			t.Errorf("expected drift in org/%s to be fixed, got %s: %v", name, result.Status, result.Error)
+		}
+	}
+	if a := results["org/a"]; a.Status != NoOpStatus || len(fg.pulls["org/a"]) != 0 {
+		t.Errorf("expected org/a to be left alone, got %s", a.Status)
+	}
+}
+
+func TestGo_apiEdit(t *testing.T) {
+	fg := newFakeGitHub(t)
+	// the clone URLs are broken, so any clone fails
+	noClone := func(repo *github.Repository) {
+		repo.CloneURL = github.String(path.Join(fg.dir, "missing"))
+	}
+	fg.addRepo("org", "a", map[string]string{"VERSION": "1.0\n"}, noClone)
+	fg.addRepo("org", "b", map[string]string{"VERSION": "2.0\n"}, noClone)
+	fg.addRepo("org", "c", nil, noClone)
+
+	command := `[ "$GHFOREACH_REPOSITORY" = org/b ] && cat || sed s/1.0/1.1/`
+	results := collectResults(t, fg, command, WithOrg("org"), WithAPIEdit(true), WithEditPath("VERSION"))
+	a := results["org/a"]
+	if a.Status != SucceededStatus || a.Stdout != "VERSION: updated\n" || !strings.Contains(a.Diff, "-1.0\n+1.1\n") {
+		t.Errorf("expected VERSION to be updated in org/a, got %s: %v\n%s%s", a.Status, a.Error, a.Stdout, a.Diff)
+	}
+	if b := results["org/b"]; b.Status != NoOpStatus {
+		t.Errorf("expected org/b to be a no-op, got %s: %v", b.Status, b.Error)
+	}
+	// a missing file reads as empty, and nothing printed leaves it missing
+	if c := results["org/c"]; c.Status != NoOpStatus {
+		t.Errorf("expected org/c to be a no-op, got %s: %v\n%s", c.Status, c.Error, c.Diff)
+	}
+
+	// nothing is committed unless pushed
+	opts := []RepositoryExecutorOption{WithOrg("org"), WithAPIEdit(true), WithEditPath("VERSION"),
+		WithCommitMessage("Bump version"),
+		WithCommitAuthor("test", "test@example.com"),
+	}
+	results = collectResults(t, fg, `echo 1.1`, opts...)
+	if a := results["org/a"]; a.Status != SucceededStatus || len(fg.commits) != 0 || len(fg.branches) != 0 {
+		t.Errorf("expected nothing to be committed without pushing, got %s and commits %+v", a.Status, fg.commits)
+	}
+
+	// an existing branch with other commits is left alone
+	fg.branches["org/a"] = map[string]string{"ghforeach": "stale"}
+	opts = append(opts, WithPullRequest(true))
+	results = collectResults(t, fg, `echo 1.1`, opts...)
+	if a := results["org/a"]; a.Status != FailedStatus || a.Error == nil || !strings.Contains(a.Error.Error(), "already exists with other commits") {
+		t.Errorf("expected publishing to the existing branch of org/a to fail, got %s: %v", a.Status, a.Error)
+	}
+	if sha := fg.branches["org/a"]["ghforeach"]; sha != "stale" || len(fg.commits["org/a"]) != 0 {
+		t.Errorf("expected the branch of org/a to be left at stale, got %q and commits %+v", sha, fg.commits["org/a"])
+	}
+
+	// unless forced
+	fg.commits = map[string][]*fakeCommit{}
+	results = collectResults(t, fg, `echo 1.1`, append(opts, WithForcePush(true))...)
+	for _, name := range []string{"a", "b", "c"} {
+		if result := results["org/"+name]; result.Status != SucceededStatus || result.PullRequestURL == "" {
+			t.Errorf("expected a pull request for org/%s, got %s: %v", name, result.Status, result.Error)
+		}
+		if sha := fg.branches["org/"+name]["ghforeach"]; sha != fakeBaseSHA {
+			t.Errorf("expected the branch of org/%s to be reset to the default branch, got %q", name, sha)
+		}
+		commits := fg.commits["org/"+name]
+		if len(commits) != 1 || commits[0].path != "VERSION" || string(commits[0].opts.Content) != "1.1\n" || commits[0].opts.GetBranch() != "ghforeach" {
+			t.Fatalf("expected VERSION to be committed to org/%s, got %+v", name, commits)
+		}
+		if (commits[0].opts.GetSHA() == "") != (name == "c") || commits[0].opts.Author.GetName() != "test" {
+			t.Errorf("unexpected commit to org/%s: %+v", name, commits[0].opts)
+		}
+	}
+	if results["org/c"].Stdout != "VERSION: created\n" {
+		t.Errorf("expected VERSION to be created in org/c, got %q", results["org/c"].Stdout)
+	}
+
+	// a failed commit may have been made, so it is not retried
+	fg.commits = map[string][]*fakeCommit{}
+	fg.failures["PUT /repos/org/a/contents/VERSION"] = 1
+	retry := WithAPIRetryPolicy(RetryPolicy{Retries: 2, InitialBackoff: time.Millisecond})
+	results = collectResults(t, fg, `echo 1.2`, append(opts, WithForcePush(true), retry)...)
+	if a := results["org/a"]; a.Status != FailedStatus || len(fg.commits["org/a"]) != 0 {
+		t.Errorf("expected the failed commit to org/a not to be retried, got %s and commits %+v", a.Status, fg.commits["org/a"])
+	}
+	if b := results["org/b"]; b.Status != SucceededStatus || len(fg.commits["org/b"]) != 1 {
+		t.Errorf("expected a commit to org/b, got %s: %v", b.Status, b.Error)
+	}
+
+	// files can be synced without cloning too
+	manifestFile := path.Join(t.TempDir(), "sync.yml")
+	if err := os.WriteFile(manifestFile, []byte("files:\n  - dest: VERSION\n    content: \"2.0\\n\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := ReadSyncManifest(manifestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results = collectResults(t, fg, "", WithOrg("org"), WithAPIEdit(true), WithSyncManifest(manifest))
+	for name, status := range map[string]ExecutionStatus{"a": DriftedStatus, "b": NoOpStatus, "c": DriftedStatus} {
+		if result := results["org/"+name]; result.Status != status {
+			t.Errorf("expected org/%s to be %s, got %s: %v", name, status, result.Status, result.Error)
+		}
+	}
+	if c := results["org/c"]; c.Stdout != "VERSION: missing\n" {
+		t.Errorf("expected VERSION to be missing in org/c, got %q", c.Stdout)
+	}
+
+	exec, err := NewRepositoryExecutor(WithClient(fg.client()), WithTmpDir(t.TempDir()), WithOrg("org"), WithAPIEdit(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Go(context.Background(), "cat"); err == nil {
+		t.Error("expected editing through the API without edit paths to fail")
+	}
+}
+
+func TestGo_fileEdits(t *testing.T) {
+	fg := newFakeGitHub(t)
+	fg.addRepo("org", "a", map[string]string{
+		"package.json": "{\n  \"name\": \"a\",\n  \"version\": \"1.0.0\"\n}\n",
+		"action.yml":   "# the action\nname: a\nversion: 1.0.0 # bumped by release\n",
+	}, nil)
+	fg.addRepo("org", "b", map[string]string{
+		"package.json": "{\n  \"name\": \"b\",\n  \"version\": \"2.0.0\"\n}\n",
+	}, nil)
+
+	edits := []RepositoryExecutorOption{WithOrg("org")}
+	for _, edit := range []struct{ op, spec string }{
+		{SetEditOperation, `package.json:version="2.0.0"`},
+		{SetEditOperation, `action.yml:version=2.0.0`},
+		{DeleteEditOperation, `action.yml:deprecated`},
+	} {
+		edit, err := ParseFileEdit(edit.op, edit.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edits = append(edits, WithFileEdit(edit))
+	}
+
+	results := collectResults(t, fg, "", edits...)
+	a := results["org/a"]
+	if a.Status != SucceededStatus || a.Stdout != "package.json: set version\naction.yml: set version\n" {
+		t.Errorf("expected org/a to be edited, got %s: %v\n%s", a.Status, a.Error, a.Stdout)
+	}
+	if !strings.Contains(a.Diff, "-version: 1.0.0 # bumped by release\n+version: 2.0.0 # bumped by release\n") {
+		t.Errorf("expected the comment in action.yml to be kept, got\n%s", a.Diff)
+	}
+	if a.Command != `set package.json:version="2.0.0"; set action.yml:version=2.0.0; delete action.yml:deprecated` || a.ExitCode != nil {
+		t.Errorf("unexpected command %q", a.Command)
+	}
+	// missing files are left alone
+	if b := results["org/b"]; b.Status != NoOpStatus {
+		t.Errorf("expected org/b to be a no-op, got %s: %v\n%s", b.Status, b.Error, b.Diff)
+	}
+
+	// the same edits can be made through the API
+	results = collectResults(t, fg, "", append(edits, WithAPIEdit(true), WithCommitMessage("Release 2.0.0"), WithPush(true))...)
+	if a := results["org/a"]; a.Status != SucceededStatus || len(fg.commits["org/a"]) != 2 {
+		t.Errorf("expected both files to be committed to org/a, got %s: %v", a.Status, a.Error)
+	}
+	if b := results["org/b"]; b.Status != NoOpStatus || len(fg.commits["org/b"]) != 0 {
+		t.Errorf("expected nothing to be committed to org/b, got %s: %v", b.Status, b.Error)
+	}
+
+	exec, err := NewRepositoryExecutor(append(edits, WithClient(fg.client()), WithTmpDir(t.TempDir()))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Go(context.Background(), "make"); err == nil {
+		t.Error("expected editing files while running a command to fail")
+	}
+}
@@ -0,0 +1,201 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/google/go-github/v60/github"
+	"go.uber.org/zap"
+)
+
+// RetryPolicy configures retrying a failed operation with exponential backoff
+// and jitter.
+type RetryPolicy struct {
+	// Retries is the number of attempts after the first. Zero disables
+	// retrying.
+	Retries int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts.
+	MaxBackoff time.Duration
+	// Multiplier scales the delay after each attempt.
+	Multiplier float64
+	// Jitter is the fraction of each delay, between 0 and 1, that is
+	// randomized so that parallel workers do not retry in lockstep.
+	Jitter float64
+}
+
+// DefaultRetryPolicy returns a policy making retries further attempts, backing
+// off from one second up to thirty.
+func DefaultRetryPolicy(retries int) RetryPolicy {
+	return RetryPolicy{
+		Retries:        retries,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.5,
+	}
+}
+
+// WithAPIRetryPolicy sets how failed GitHub API requests are retried.
+func WithAPIRetryPolicy(policy RetryPolicy) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.apiRetry = policy
+		return nil
+	}
+}
+
+// WithCloneRetryPolicy sets how failed clones are retried.
+func WithCloneRetryPolicy(policy RetryPolicy) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.cloneRetry = policy
+		return nil
+	}
+}
+
+// WithCommandRetryPolicy sets how a command exiting non-zero is retried. By
+// default commands are not retried.
+func WithCommandRetryPolicy(policy RetryPolicy) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.commandRetry = policy
+		return nil
+	}
+}
+
+// backoff returns the delay before the given retry, counting from 1.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	jitter := math.Min(math.Max(p.Jitter, 0), 1)
+	delay -= delay * jitter * rand.Float64()
+	return time.Duration(delay)
+}
+
+// do calls fn until it succeeds, returns an error that retryable rejects, or
+// the policy's retries are exhausted. It returns the number of attempts made
+// and the last error.
+func (p RetryPolicy) do(ctx context.Context, logger *zap.Logger, operation string, retryable func(error) bool, fn func() error) (int, error) {
+	attempts := 0
+	for {
+		attempts++
+		err := fn()
+		if err == nil || attempts > p.Retries || !retryable(err) || ctx.Err() != nil {
+			return attempts, err
+		}
+		delay := p.backoff(attempts)
+		logger.Warn("retrying after error",
+			zap.String("operation", operation),
+			zap.Int("attempt", attempts),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+		select {
+		case <-ctx.Done():
+			return attempts, err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isRetryableAPIError reports whether a GitHub API request may succeed if
+// repeated: server errors and failures without a response, such as
+// connection resets.
+func isRetryableAPIError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var errResp *github.ErrorResponse
+	if errors.As(err, &errResp) {
+		return errResp.Response != nil && errResp.Response.StatusCode >= http.StatusInternalServerError
+	}
+	var rateLimitErr *github.RateLimitError
+	var abuseErr *github.AbuseRateLimitError
+	return !errors.As(err, &rateLimitErr) && !errors.As(err, &abuseErr)
+}
+
+// isRetryableCloneError reports whether a clone may succeed if repeated.
+func isRetryableCloneError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	for _, permanent := range []error{
+		transport.ErrRepositoryNotFound,
+		transport.ErrEmptyRemoteRepository,
+		transport.ErrAuthenticationRequired,
+		transport.ErrAuthorizationFailed,
+		transport.ErrInvalidAuthMethod,
+	} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+	return true
+}
+
+// isRetryableCommandError retries any failure of the user's command.
+func isRetryableCommandError(err error) bool {
+	return true
+}
+
+// callAPI makes a GitHub API request through fn. Requests wait for a free
+// API slot, pause while a rate limit is in effect and are retried according
+// to the API retry policy. Rate limited requests are retried once the limit
+// resets without counting against the policy, up to maxRateLimitWaits times.
+func (rh *RepositoryExecutor) callAPI(ctx context.Context, operation string, fn func() (*github.Response, error)) error {
+	_, err := rh.apiRetry.do(ctx, rh.logger, operation, isRetryableAPIError, func() error {
+		return rh.callAPIOnce(ctx, operation, fn)
+	})
+	return err
+}
+
+// callAPIOnce calls fn without retrying it on failure, for requests that may
+// have taken effect even if they failed, such as commits. Requests rejected
+// by the rate limit are still repeated once it allows.
+func (rh *RepositoryExecutor) callAPIOnce(ctx context.Context, operation string, fn func() (*github.Response, error)) error {
+	for waits := 0; ; waits++ {
+		if err := rh.apiLimiter.acquire(ctx); err != nil {
+			return err
+		}
+		resp, err := fn()
+		rh.apiLimiter.release()
+		rh.observeRate(resp)
+		wait, limited := rateLimitWait(err)
+		if !limited || waits == maxRateLimitWaits {
+			return err
+		}
+		rh.logger.Warn("api rate limited, pausing requests",
+			zap.String("operation", operation),
+			zap.Duration("wait", wait),
+			zap.Error(err),
+		)
+		rh.apiLimiter.pauseUntil(time.Now().Add(wait))
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2, Jitter: 0.5}
+	for retry, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		for i := 0; i < 100; i++ {
+			if delay := policy.backoff(retry); delay > max || delay < max/2 {
+				t.Fatalf("retry %d: expected delay in [%v, %v], got %v", retry, max/2, max, delay)
+			}
+		}
+	}
+}
+
+func TestRetryPolicy_do(t *testing.T) {
+	policy := RetryPolicy{Retries: 3, InitialBackoff: time.Millisecond}
+	errTransient := errors.New("transient")
+	errPermanent := errors.New("permanent")
+	retryable := func(err error) bool { return errors.Is(err, errTransient) }
+
+	calls := 0
+	attempts, err := policy.do(context.Background(), zap.NewNop(), "test", retryable, func() error {
+		calls++
+		if calls < 3 {
+			return errTransient
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("expected success after 3 attempts, got %v after %d", err, attempts)
+	}
+
+	attempts, err = policy.do(context.Background(), zap.NewNop(), "test", retryable, func() error {
+		return errPermanent
+	})
+	if !errors.Is(err, errPermanent) || attempts != 1 {
+		t.Errorf("expected permanent error after 1 attempt, got %v after %d", err, attempts)
+	}
+
+	attempts, err = policy.do(context.Background(), zap.NewNop(), "test", retryable, func() error {
+		return errTransient
+	})
+	if !errors.Is(err, errTransient) || attempts != 4 {
+		t.Errorf("expected transient error after 4 attempts, got %v after %d", err, attempts)
+	}
+}
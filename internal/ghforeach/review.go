@@ -0,0 +1,288 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// ReviewDecision is the decision made about the changes to a repository in
+// review.
+type ReviewDecision = string
+
+const (
+	ApproveDecision ReviewDecision = "approve"
+	SkipDecision    ReviewDecision = "skip"
+)
+
+// errReviewAborted stops a run when its review is aborted.
+var errReviewAborted = errors.New("review aborted")
+
+// WithReview shows the diff of each repository with changes on out before
+// they are published, and reads a decision for it from in: approve, skip,
+// edit the changed files in $EDITOR or open a shell in the clone (after which
+// the changes are shown again), or abort the run. Repositories are reviewed
+// one at a time, and only approved changes are published. It requires
+// WithCommitMessage.
+func WithReview(in io.Reader, out io.Writer) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.reviewer = &reviewer{in: bufio.NewReader(in), rawIn: in, out: out}
+		return nil
+	}
+}
+
+// WithDecisionsFile saves the decisions made with WithReview to the file at
+// p. Without WithReview, the decisions in the file are applied instead: only
+// the changes it approves are published, and only if they are identical to
+// those reviewed, so that a reviewed run can be repeated non-interactively.
+func WithDecisionsFile(p string) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.decisionsFile = p
+		return nil
+	}
+}
+
+// approveChanges reports whether the changes in result may be published,
+// reviewing them or looking up their decision as configured. Changes are
+// approved if there is no review.
+func (rh *RepositoryExecutor) approveChanges(ctx context.Context, result *executionResult) (bool, error) {
+	switch {
+	case rh.reviewer != nil:
+		decision, err := rh.reviewer.review(ctx, rh, result)
+		if err != nil {
+			return false, err
+		}
+		if rh.decisions != nil && result.Diff != "" {
+			if err := rh.decisions.set(result.Repository, decision, result.Diff); err != nil {
+				return false, fmt.Errorf("saving review decision: %w", err)
+			}
+		}
+		return decision == ApproveDecision, nil
+	case rh.decisions != nil:
+		decision, ok := rh.decisions.get(result.Repository)
+		if !ok || decision.Decision != ApproveDecision {
+			return false, nil
+		}
+		if decision.DiffSHA256 != diffDigest(result.Diff) {
+			return false, fmt.Errorf("changes differ from those approved in review")
+		}
+		return true, nil
+	}
+	return true, nil
+}
+
+// reviewer prompts for a decision on each repository's changes.
+type reviewer struct {
+	in *bufio.Reader
+	// rawIn is given to editors and shells, which need the terminal itself.
+	rawIn io.Reader
+	out   io.Writer
+
+	// mu serializes reviews, which share the terminal.
+	mu      sync.Mutex
+	aborted bool
+}
+
+// review prompts for a decision on the changes in result until one is made,
+// updating its diff if the changes are edited.
+func (rv *reviewer) review(ctx context.Context, rh *RepositoryExecutor, result *executionResult) (ReviewDecision, error) {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	for {
+		if rv.aborted {
+			return "", errReviewAborted
+		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if result.Diff == "" {
+			fmt.Fprintf(rv.out, "===== review %s: no changes left\n", result.Repository)
+			return SkipDecision, nil
+		}
+		fmt.Fprintf(rv.out, "===== review %s\n%s", result.Repository, result.Diff)
+		fmt.Fprint(rv.out, "[a]pprove, [s]kip, [e]dit, open a s[h]ell or [q] abort? ")
+		line, err := rv.in.ReadString('\n')
+		if err != nil && line == "" {
+			// without input there is no one to decide
+			rv.aborted = true
+			return "", fmt.Errorf("%w: reading decision: %w", errReviewAborted, err)
+		}
+		var cmd *exec.Cmd
+		choice := strings.ToLower(strings.TrimSpace(line))
+		if result.Path == "" && slices.Contains([]string{"e", "edit", "h", "shell"}, choice) {
+			// changes made through the API have no clone to edit
+			fmt.Fprintln(rv.out, "error: changes made through the API cannot be edited")
+			continue
+		}
+		switch choice {
+		case "a", "approve":
+			return ApproveDecision, nil
+		case "s", "skip":
+			return SkipDecision, nil
+		case "q", "abort":
+			rv.aborted = true
+			return "", errReviewAborted
+		case "e", "edit":
+			cmd, err = rv.editorCommand(rh, result.Path)
+			if err != nil {
+				fmt.Fprintf(rv.out, "error: %v\n", err)
+				continue
+			}
+		case "h", "shell":
+			shell := os.Getenv("SHELL")
+			if shell == "" {
+				shell = rh.shellPath
+			}
+			fmt.Fprintf(rv.out, "opening a shell in %s; exit it to return to the review\n", result.Path)
+			cmd = exec.Command(shell)
+		default:
+			fmt.Fprintf(rv.out, "unrecognized choice %q\n", strings.TrimSpace(line))
+			continue
+		}
+		if err := rv.run(cmd, result.Path); err != nil {
+			fmt.Fprintf(rv.out, "error: %v\n", err)
+		}
+		diff, err := worktreeDiff(result.Path)
+		if err != nil {
+			return "", fmt.Errorf("computing diff: %w", err)
+		}
+		result.Diff = diff
+	}
+}
+
+// editorCommand returns the command opening the changed files of the clone
+// at dir, that still exist, in $VISUAL or $EDITOR.
+func (rv *reviewer) editorCommand(rh *RepositoryExecutor, dir string) (*exec.Cmd, error) {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := changedPaths(r)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-c", editor + ` "$@"`, editor}
+	for _, p := range paths {
+		if info, err := os.Stat(path.Join(dir, p)); err == nil && info.Mode().IsRegular() {
+			args = append(args, p)
+		}
+	}
+	// the shell splits an editor given with arguments
+	return exec.Command(rh.shellPath, args...), nil
+}
+
+// run runs cmd in dir attached to the terminal of the review.
+func (rv *reviewer) run(cmd *exec.Cmd, dir string) error {
+	cmd.Dir = dir
+	if f, ok := rv.rawIn.(*os.File); ok {
+		cmd.Stdin = f
+	}
+	cmd.Stdout = rv.out
+	cmd.Stderr = rv.out
+	return cmd.Run()
+}
+
+// reviewDecisions is the file of decisions made in review.
+type reviewDecisions struct {
+	path string
+	mu   sync.Mutex
+
+	Repositories map[string]reviewDecision `json:"repositories"`
+}
+
+type reviewDecision struct {
+	Decision ReviewDecision `json:"decision"`
+	// DiffSHA256 identifies the changes decided on.
+	DiffSHA256 string    `json:"diff_sha256"`
+	Time       time.Time `json:"time"`
+}
+
+// loadReviewDecisions reads the decisions file at p. A missing file holds no
+// decisions unless it must exist.
+func loadReviewDecisions(p string, mustExist bool) (*reviewDecisions, error) {
+	rd := &reviewDecisions{path: p, Repositories: map[string]reviewDecision{}}
+	bytes, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) && !mustExist {
+		return rd, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bytes, rd); err != nil {
+		return nil, fmt.Errorf("parsing decisions file %s: %w", p, err)
+	}
+	if rd.Repositories == nil {
+		rd.Repositories = map[string]reviewDecision{}
+	}
+	return rd, nil
+}
+
+func (rd *reviewDecisions) get(repository string) (reviewDecision, bool) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	decision, ok := rd.Repositories[repository]
+	return decision, ok
+}
+
+// set records decision on diff for repository and saves the file, so that
+// decisions survive an aborted review.
+func (rd *reviewDecisions) set(repository string, decision ReviewDecision, diff string) error {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.Repositories[repository] = reviewDecision{
+		Decision:   decision,
+		DiffSHA256: diffDigest(diff),
+		Time:       time.Now(),
+	}
+	bytes, err := json.MarshalIndent(rd, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := rd.path + ".tmp"
+	if err := os.WriteFile(tmp, append(bytes, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rd.path)
+}
+
+func diffDigest(diff string) string {
+	sum := sha256.Sum256([]byte(diff))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,52 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import "context"
+
+// semaphore bounds the number of concurrent holders. A nil semaphore is
+// unbounded.
+type semaphore chan struct{}
+
+// newSemaphore returns a semaphore admitting n holders, or an unbounded one
+// if n is less than one.
+func newSemaphore(n int) semaphore {
+	if n < 1 {
+		return nil
+	}
+	return make(semaphore, n)
+}
+
+// acquire waits for a free slot or for ctx to be done.
+func (s semaphore) acquire(ctx context.Context) error {
+	if s == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case s <- struct{}{}:
+		return nil
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
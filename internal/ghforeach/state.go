@@ -0,0 +1,239 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/v60/github"
+)
+
+// runStateFile is the name of the run state journal within the temp
+// directory. Owner directories cannot start with a dot, so it cannot collide
+// with a clone.
+const runStateFile = ".ghforeach-state.jsonl"
+
+// WithResume resumes the previous run recorded in the temp directory,
+// skipping repositories that already completed and retrying those that
+// failed or never finished. The run must use the same command and filters.
+func WithResume(b bool) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.resume = b
+		return nil
+	}
+}
+
+// runMetadata identifies a run. A run may only be resumed by one with equal
+// metadata.
+type runMetadata struct {
+	Command      string   `json:"command"`
+	Precondition string   `json:"precondition,omitempty"`
+	Orgs         []string `json:"orgs,omitempty"`
+	Users        []string `json:"users,omitempty"`
+	Filter       string   `json:"filter,omitempty"`
+	Properties   []string `json:"properties,omitempty"`
+	Contents     []string `json:"contents,omitempty"`
+}
+
+func (rh *RepositoryExecutor) runMetadata(command string) runMetadata {
+	metadata := runMetadata{
+		Command: command,
+		Orgs:    rh.orgs,
+		Users:   rh.users,
+	}
+	if rh.precondition != nil {
+		metadata.Precondition = *rh.precondition
+	}
+	if rh.filter != nil {
+		metadata.Filter = rh.filter.String()
+	}
+	for _, pp := range rh.propertyPredicates {
+		metadata.Properties = append(metadata.Properties, pp.String())
+	}
+	for _, cp := range rh.contentPredicates {
+		metadata.Contents = append(metadata.Contents, cp.String())
+	}
+	return metadata
+}
+
+// diff describes the first field in which other differs from rm, or returns
+// "" if they are equal.
+func (rm runMetadata) diff(other runMetadata) string {
+	a, b := reflect.ValueOf(rm), reflect.ValueOf(other)
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			name, _, _ := strings.Cut(a.Type().Field(i).Tag.Get("json"), ",")
+			return fmt.Sprintf("%s was %v, now %v", name, a.Field(i).Interface(), b.Field(i).Interface())
+		}
+	}
+	return ""
+}
+
+// runStateEntry is a line of the run state journal. The first line records
+// the run metadata and every following line the latest status of a
+// repository.
+type runStateEntry struct {
+	Time       time.Time        `json:"time"`
+	Metadata   *runMetadata     `json:"metadata,omitempty"`
+	Repository string           `json:"repository,omitempty"`
+	Status     ExecutionStatus  `json:"status,omitempty"`
+	Result     *executionResult `json:"result,omitempty"`
+}
+
+// runState is an append-only journal of a run's progress, so that a run that
+// dies part way through can be resumed.
+type runState struct {
+	mu     sync.Mutex
+	file   journalFile
+	latest map[string]*runStateEntry
+}
+
+// journalFile is the file a runState appends to.
+type journalFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// openRunState starts a new journal in dir, or, if resume is set, reopens the
+// existing one after checking that it was recorded with equal metadata.
+func openRunState(dir string, metadata runMetadata, resume bool) (*runState, error) {
+	p := path.Join(dir, runStateFile)
+	rs := &runState{latest: map[string]*runStateEntry{}}
+	if !resume {
+		file, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		rs.file = file
+		if err := rs.append(&runStateEntry{Metadata: &metadata}); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return rs, nil
+	}
+
+	file, err := os.OpenFile(p, os.O_RDWR|os.O_APPEND, 0600)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("cannot resume: no run state found in %s", dir)
+	} else if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	first := true
+	// offset is the end of the last complete entry
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+		entry := &runStateEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			break
+		}
+		offset += int64(len(line))
+		if first {
+			if entry.Metadata == nil {
+				file.Close()
+				return nil, fmt.Errorf("cannot resume: run state in %s has no metadata", dir)
+			}
+			if diff := entry.Metadata.diff(metadata); diff != "" {
+				file.Close()
+				return nil, fmt.Errorf("cannot resume: run differs from the recorded run: %s", diff)
+			}
+			first = false
+			continue
+		}
+		rs.latest[entry.Repository] = entry
+	}
+	if first {
+		file.Close()
+		return nil, fmt.Errorf("cannot resume: run state in %s is empty", dir)
+	}
+	// a run killed mid-write may leave a partial last line, which would
+	// otherwise run into the first new entry
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	rs.file = file
+	return rs, nil
+}
+
+func (rs *runState) append(entry *runStateEntry) error {
+	entry.Time = time.Now()
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.file.Write(append(bytes, '\n')); err != nil {
+		return err
+	}
+	return rs.file.Sync()
+}
+
+// completed returns the recorded result of repo if it already completed
+// successfully or was skipped.
+func (rs *runState) completed(repo *github.Repository) (*executionResult, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	entry, ok := rs.latest[repo.GetFullName()]
+	if !ok || entry.Result == nil {
+		return nil, false
+	}
+	switch entry.Status {
+	case SucceededStatus, NoOpStatus, SkippedPreconditionStatus, SkippedReviewStatus, DriftedStatus:
+		return entry.Result, true
+	}
+	return nil, false
+}
+
+// record journals the status of repo along with its result, if any.
+func (rs *runState) record(repo *github.Repository, status ExecutionStatus, result *executionResult) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	entry := &runStateEntry{
+		Repository: repo.GetFullName(),
+		Status:     status,
+		Result:     result,
+	}
+	rs.latest[entry.Repository] = entry
+	return rs.append(entry)
+}
+
+func (rs *runState) close() error {
+	return rs.file.Close()
+}
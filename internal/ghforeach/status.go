@@ -0,0 +1,85 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RepositoryStage is the stage of a run a repository has reached.
+type RepositoryStage = string
+
+const (
+	// QueuedStage repositories are waiting for a clone or command slot.
+	QueuedStage  RepositoryStage = "queued"
+	CloningStage RepositoryStage = "cloning"
+	RunningStage RepositoryStage = "running"
+	// DoneStage repositories have a result, whose status the event carries.
+	DoneStage RepositoryStage = "done"
+	// ListedStage is reported once, without a repository, when every
+	// repository to be handled has been queued.
+	ListedStage RepositoryStage = "listed"
+)
+
+// StatusEvent reports a repository moving to a new stage.
+type StatusEvent struct {
+	Time       time.Time
+	Repository string
+	Stage      RepositoryStage
+	// Status and Error are the outcome of repositories in DoneStage.
+	Status ExecutionStatus
+	Error  error
+	// Resumed is set for results recorded by a previous run.
+	Resumed bool
+}
+
+// WithStatusListener registers a function called with every status event of
+// a run, e.g. to display progress. It is called from many goroutines at once
+// and must not block. It may be given more than once.
+func WithStatusListener(listener func(StatusEvent)) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.statusListeners = append(fre.statusListeners, listener)
+		return nil
+	}
+}
+
+// emit reports event to the status listeners.
+func (rh *RepositoryExecutor) emit(event StatusEvent) {
+	event.Time = time.Now()
+	rh.logger.Debug("repository status",
+		zap.String("repository", event.Repository),
+		zap.String("stage", event.Stage),
+		zap.String("status", event.Status),
+	)
+	for _, listener := range rh.statusListeners {
+		listener(event)
+	}
+}
+
+// emitResult reports that result is done.
+func (rh *RepositoryExecutor) emitResult(result *executionResult) {
+	rh.emit(StatusEvent{
+		Repository: result.Repository,
+		Stage:      DoneStage,
+		Status:     result.Status,
+		Error:      result.Error,
+		Resumed:    result.Resumed,
+	})
+}
@@ -0,0 +1,168 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+)
+
+// streamColors are the ANSI colors repository prefixes are drawn from.
+var streamColors = []string{
+	"\x1b[31m", // red
+	"\x1b[32m", // green
+	"\x1b[33m", // yellow
+	"\x1b[34m", // blue
+	"\x1b[35m", // magenta
+	"\x1b[36m", // cyan
+	"\x1b[91m", // bright red
+	"\x1b[92m", // bright green
+	"\x1b[93m", // bright yellow
+	"\x1b[94m", // bright blue
+	"\x1b[95m", // bright magenta
+	"\x1b[96m", // bright cyan
+}
+
+const streamColorReset = "\x1b[0m"
+
+// streamPrefixWidth is the width repository names are padded to, so that
+// output lines up the same from the first line on. Longer names are not
+// padded.
+const streamPrefixWidth = 24
+
+// WithStreamOutput writes the output of commands to w line by line as it
+// arrives, each line prefixed with the repository it came from, instead of
+// only once each repository is done. Prefixes are colored if color is set.
+// Results still carry the full output.
+func WithStreamOutput(w io.Writer, color bool) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.stream = &streamPrinter{w: w, color: color}
+		return nil
+	}
+}
+
+// streamPrinter writes whole lines from many repositories to one writer, so
+// that lines from parallel workers never interleave.
+type streamPrinter struct {
+	w     io.Writer
+	color bool
+
+	mu sync.Mutex
+}
+
+// prefix returns the tag of repository, padded to streamPrefixWidth. It must
+// be called with mu held.
+func (sp *streamPrinter) prefix(repository string) string {
+	tag := "[" + repository + "]"
+	padding := strings.Repeat(" ", max(streamPrefixWidth-len(repository), 0))
+	if !sp.color {
+		return tag + padding + " "
+	}
+	h := fnv.New32a()
+	h.Write([]byte(repository))
+	color := streamColors[h.Sum32()%uint32(len(streamColors))]
+	return color + tag + streamColorReset + padding + " "
+}
+
+// println writes line, which must not contain a newline, tagged with
+// repository.
+func (sp *streamPrinter) println(repository, line string) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	fmt.Fprintf(sp.w, "%s%s\n", sp.prefix(repository), line)
+}
+
+// printText writes each line of text tagged with repository, together so
+// that lines from other repositories do not come between them.
+func (sp *streamPrinter) printText(repository, text string) {
+	if text == "" {
+		return
+	}
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		fmt.Fprintf(sp.w, "%s%s\n", sp.prefix(repository), line)
+	}
+}
+
+// writer returns a writer streaming the output of repository. It must be
+// flushed once the output ends to write any final unterminated line.
+func (sp *streamPrinter) writer(repository string) *streamWriter {
+	return &streamWriter{printer: sp, repository: repository}
+}
+
+// streamWriter splits output into lines for a streamPrinter.
+type streamWriter struct {
+	printer    *streamPrinter
+	repository string
+	partial    []byte
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.partial = append(sw.partial, p...)
+	for {
+		i := bytes.IndexByte(sw.partial, '\n')
+		if i < 0 {
+			break
+		}
+		sw.printer.println(sw.repository, strings.TrimSuffix(string(sw.partial[:i]), "\r"))
+		sw.partial = sw.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes any unterminated line.
+func (sw *streamWriter) Flush() {
+	if len(sw.partial) > 0 {
+		sw.printer.println(sw.repository, string(sw.partial))
+		sw.partial = nil
+	}
+}
+
+// commandOutput returns the writers a command run for repo should write
+// to: the given buffers, teed to the stream if streaming. flush must be
+// called once the command exits.
+func (rh *RepositoryExecutor) commandOutput(repository string, stdout, stderr io.Writer) (io.Writer, io.Writer, func()) {
+	if rh.stream == nil {
+		return stdout, stderr, func() {}
+	}
+	streamStdout := rh.stream.writer(repository)
+	streamStderr := rh.stream.writer(repository)
+	return io.MultiWriter(stdout, streamStdout), io.MultiWriter(stderr, streamStderr), func() {
+		streamStdout.Flush()
+		streamStderr.Flush()
+	}
+}
+
+// statusLine describes the outcome of a result in a line, for output when
+// the command output was already streamed.
+func (er *executionResult) statusLine() string {
+	switch er.Status {
+	case SkippedPreconditionStatus:
+		return fmt.Sprintf("%s: %s", er.Status, er.Precondition)
+	case FailedStatus:
+		if er.Error != nil {
+			return fmt.Sprintf("%s: %v", er.Status, er.Error)
+		}
+	}
+	return er.Status
+}
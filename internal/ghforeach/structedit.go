@@ -0,0 +1,1184 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EditOperation is what a structured edit does at its path.
+type EditOperation = string
+
+const (
+	// SetEditOperation sets the value at the path, creating missing
+	// objects on the way.
+	SetEditOperation EditOperation = "set"
+	// DeleteEditOperation deletes the value at the path, if there is one.
+	DeleteEditOperation EditOperation = "delete"
+	// AppendEditOperation appends to the array at the path, creating it if
+	// it is missing.
+	AppendEditOperation EditOperation = "append"
+)
+
+// FileEdit is an edit of a value in a JSON or YAML file, e.g. setting
+// version in package.json, made in place so that the rest of the file keeps
+// its formatting and comments.
+type FileEdit struct {
+	op   EditOperation
+	file string
+	json bool
+	// expr is the path as given, and path its segments.
+	expr string
+	path []editPathSegment
+	// value is the value set or appended, parsed as YAML.
+	value *yaml.Node
+	spec  string
+}
+
+// editPathSegment is an object key or an array index of a path.
+type editPathSegment struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+func (seg editPathSegment) String() string {
+	if seg.isIndex {
+		return "[" + strconv.Itoa(seg.index) + "]"
+	}
+	return strconv.Quote(seg.key)
+}
+
+// WithFileEdit makes edit in each repository instead of running a command.
+// Files that do not exist are left alone. It may be given more than once,
+// and edits are made in order. It implies WithDiff.
+func WithFileEdit(edit *FileEdit) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.fileEdits = append(fre.fileEdits, edit)
+		fre.captureDiff = true
+		return nil
+	}
+}
+
+// ParseFileEdit parses an edit of op from spec, which is FILE:PATH=VALUE,
+// or FILE:PATH for deletions. FILE must end in .json, .yml or .yaml. PATH
+// is a dot-separated list of keys, with [N] indexing arrays (counting from
+// the end if negative) and ["KEY"] quoting keys, e.g.
+// jobs.build.steps[0].with["node-version"]. VALUE is parsed as YAML, so
+// that 1.0 is a number, '"1.0"' a string and {name: x} an object.
+func ParseFileEdit(op EditOperation, spec string) (*FileEdit, error) {
+	edit := &FileEdit{op: op, spec: spec}
+	switch op {
+	case SetEditOperation, DeleteEditOperation, AppendEditOperation:
+	default:
+		return nil, fmt.Errorf("invalid edit operation %q", op)
+	}
+	file, rest, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid edit %q: expected FILE:PATH", spec)
+	}
+	clean, ok := cleanRepoPath(file)
+	if !ok {
+		return nil, fmt.Errorf("invalid edit %q: invalid file %q", spec, file)
+	}
+	edit.file = clean
+	switch strings.ToLower(path.Ext(clean)) {
+	case ".json":
+		edit.json = true
+	case ".yml", ".yaml":
+	default:
+		return nil, fmt.Errorf("invalid edit %q: expected a .json, .yml or .yaml file", spec)
+	}
+
+	segments, n, err := parseEditPath(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid edit %q: %w", spec, err)
+	}
+	edit.expr, edit.path = rest[:n], segments
+	rest = rest[n:]
+	if op == DeleteEditOperation {
+		if rest != "" {
+			return nil, fmt.Errorf("invalid edit %q: unexpected %q after path", spec, rest)
+		}
+		return edit, nil
+	}
+	if !strings.HasPrefix(rest, "=") {
+		return nil, fmt.Errorf("invalid edit %q: expected FILE:PATH=VALUE", spec)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(rest[1:]), &doc); err != nil {
+		return nil, fmt.Errorf("invalid edit %q: parsing value: %w", spec, err)
+	}
+	edit.value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+	if len(doc.Content) > 0 {
+		edit.value = doc.Content[0]
+	}
+	detachNode(edit.value)
+	return edit, nil
+}
+
+func (fe *FileEdit) String() string {
+	return fe.op + " " + fe.spec
+}
+
+// parseEditPath parses the path at the start of s, up to an unquoted "=",
+// returning its segments and length.
+func parseEditPath(s string) ([]editPathSegment, int, error) {
+	segments := []editPathSegment{}
+	i := 0
+	for i < len(s) && s[i] != '=' {
+		if len(segments) > 0 && s[i] != '.' && s[i] != '[' {
+			return nil, 0, fmt.Errorf("expected . or [ at %d", i)
+		}
+		switch {
+		case s[i] == '[':
+			end := strings.IndexByte(s[i:], ']')
+			if i+1 < len(s) && s[i+1] == '"' {
+				// the key is a JSON string, which may contain ']'
+				var key string
+				decoder := json.NewDecoder(strings.NewReader(s[i+1:]))
+				if err := decoder.Decode(&key); err != nil {
+					return nil, 0, fmt.Errorf("invalid quoted key at %d: %w", i, err)
+				}
+				j := i + 1 + int(decoder.InputOffset())
+				if j >= len(s) || s[j] != ']' {
+					return nil, 0, fmt.Errorf("expected ] at %d", j)
+				}
+				segments = append(segments, editPathSegment{key: key})
+				i = j + 1
+				continue
+			}
+			if end < 0 {
+				return nil, 0, fmt.Errorf("unclosed [ at %d", i)
+			}
+			index, err := strconv.Atoi(s[i+1 : i+end])
+			if err != nil {
+				return nil, 0, fmt.Errorf("invalid index %q", s[i+1:i+end])
+			}
+			segments = append(segments, editPathSegment{index: index, isIndex: true})
+			i += end + 1
+		case s[i] == '.' && len(segments) > 0:
+			i++
+			if i < len(s) && s[i] == '[' {
+				return nil, 0, fmt.Errorf("unexpected [ after . at %d", i)
+			}
+			fallthrough
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(".[=", rune(s[end])) {
+				end++
+			}
+			if end == i {
+				return nil, 0, fmt.Errorf("empty key at %d", i)
+			}
+			segments = append(segments, editPathSegment{key: s[i:end]})
+			i = end
+		}
+	}
+	if len(segments) == 0 {
+		return nil, 0, fmt.Errorf("empty path")
+	}
+	return segments, i, nil
+}
+
+// apply returns content with the edit made. A file with CRLF line endings
+// is edited with LF line endings, then has them restored, so that the lines
+// added end as the others do.
+func (fe *FileEdit) apply(content string) (string, error) {
+	crlf := strings.Contains(content, "\r\n") && strings.Count(content, "\r\n") == strings.Count(content, "\n")
+	if crlf {
+		content = strings.ReplaceAll(content, "\r\n", "\n")
+	}
+	var updated string
+	var err error
+	if fe.json {
+		updated, err = fe.applyJSON(content)
+	} else {
+		updated, err = fe.applyYAML(content)
+	}
+	if err != nil || !crlf {
+		return updated, err
+	}
+	return strings.ReplaceAll(updated, "\n", "\r\n"), nil
+}
+
+// fileEditPaths returns the files edited, in the order they are first
+// edited.
+func (rh *RepositoryExecutor) fileEditPaths() []string {
+	paths := []string{}
+	seen := map[string]bool{}
+	for _, edit := range rh.fileEdits {
+		if !seen[edit.file] {
+			seen[edit.file] = true
+			paths = append(paths, edit.file)
+		}
+	}
+	return paths
+}
+
+// editFile makes the edits of the file at p to its content, listing those
+// that changed it to w.
+func (rh *RepositoryExecutor) editFile(p, content string, w io.Writer) (string, error) {
+	for _, edit := range rh.fileEdits {
+		if edit.file != p {
+			continue
+		}
+		updated, err := edit.apply(content)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", edit, err)
+		}
+		if updated != content {
+			fmt.Fprintf(w, "%s: %s %s\n", p, edit.op, edit.expr)
+		}
+		content = updated
+	}
+	return content, nil
+}
+
+// editFiles makes the edits in the clone at dir, listing those that changed
+// a file to w. Missing files are left alone.
+func (rh *RepositoryExecutor) editFiles(dir string, w io.Writer) error {
+	for _, p := range rh.fileEditPaths() {
+		existing, err := os.ReadFile(path.Join(dir, p))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		updated, err := rh.editFile(p, string(existing), w)
+		if err != nil {
+			return err
+		}
+		if updated == string(existing) {
+			continue
+		}
+		if err := writeRepoFile(path.Join(dir, p), updated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// editAPIFiles makes the edits to files, listing those that changed a file
+// to w. Missing files are left alone.
+func (rh *RepositoryExecutor) editAPIFiles(files []*apiFile, w io.Writer) error {
+	for _, file := range files {
+		if !file.exists() {
+			continue
+		}
+		updated, err := rh.editFile(file.path, file.original, w)
+		if err != nil {
+			return err
+		}
+		file.updated = updated
+	}
+	return nil
+}
+
+// jsonValue is the extent of a value in a JSON document, and of its members
+// or elements.
+type jsonValue struct {
+	start, end int
+	// kind is '{' for objects, '[' for arrays and 0 otherwise.
+	kind byte
+	// keys are the keys of the members of an object, and keyStarts where
+	// they start.
+	keys      []string
+	keyStarts []int
+	items     []*jsonValue
+}
+
+// itemStart returns where member or element i starts.
+func (jv *jsonValue) itemStart(i int) int {
+	if jv.kind == '{' {
+		return jv.keyStarts[i]
+	}
+	return jv.items[i].start
+}
+
+// child returns the index of the item seg selects, or -1 if there is none.
+func (jv *jsonValue) child(seg editPathSegment) (int, error) {
+	switch {
+	case jv.kind == '{' && !seg.isIndex:
+		for i, key := range jv.keys {
+			if key == seg.key {
+				return i, nil
+			}
+		}
+		return -1, nil
+	case jv.kind == '[' && seg.isIndex:
+		return resolveIndex(seg.index, len(jv.items)), nil
+	case seg.isIndex:
+		return 0, fmt.Errorf("cannot index %s: not an array", seg)
+	default:
+		return 0, fmt.Errorf("cannot get %s: not an object", seg)
+	}
+}
+
+// resolveIndex returns the index of an array of length n that index, which
+// counts from the end if negative, selects, or -1 if there is none.
+func resolveIndex(index, n int) int {
+	if index < 0 {
+		index += n
+	}
+	if index < 0 || index >= n {
+		return -1
+	}
+	return index
+}
+
+// jsonParser parses the extents of the values of a valid JSON document.
+type jsonParser struct {
+	s   string
+	pos int
+}
+
+func (jp *jsonParser) skipSpace() {
+	for jp.pos < len(jp.s) && strings.IndexByte(" \t\r\n", jp.s[jp.pos]) >= 0 {
+		jp.pos++
+	}
+}
+
+func (jp *jsonParser) parse() (*jsonValue, error) {
+	jp.skipSpace()
+	if jp.pos >= len(jp.s) {
+		return nil, fmt.Errorf("unexpected end of JSON")
+	}
+	value := &jsonValue{start: jp.pos}
+	switch c := jp.s[jp.pos]; c {
+	case '{', '[':
+		value.kind = c
+		closing := byte('}')
+		if c == '[' {
+			closing = ']'
+		}
+		jp.pos++
+		for {
+			jp.skipSpace()
+			if jp.pos < len(jp.s) && jp.s[jp.pos] == closing {
+				jp.pos++
+				break
+			}
+			if len(value.items) > 0 {
+				// skip the comma
+				jp.pos++
+				jp.skipSpace()
+			}
+			if c == '{' {
+				keyStart := jp.pos
+				if err := jp.skipString(); err != nil {
+					return nil, err
+				}
+				var key string
+				if err := json.Unmarshal([]byte(jp.s[keyStart:jp.pos]), &key); err != nil {
+					return nil, err
+				}
+				value.keys = append(value.keys, key)
+				value.keyStarts = append(value.keyStarts, keyStart)
+				jp.skipSpace()
+				// skip the colon
+				jp.pos++
+			}
+			item, err := jp.parse()
+			if err != nil {
+				return nil, err
+			}
+			value.items = append(value.items, item)
+		}
+	case '"':
+		if err := jp.skipString(); err != nil {
+			return nil, err
+		}
+	default:
+		for jp.pos < len(jp.s) && strings.IndexByte(",]} \t\r\n", jp.s[jp.pos]) < 0 {
+			jp.pos++
+		}
+	}
+	value.end = jp.pos
+	return value, nil
+}
+
+func (jp *jsonParser) skipString() error {
+	for i := jp.pos + 1; i < len(jp.s); i++ {
+		switch jp.s[i] {
+		case '\\':
+			i++
+		case '"':
+			jp.pos = i + 1
+			return nil
+		}
+	}
+	return fmt.Errorf("unterminated string")
+}
+
+// applyJSON makes the edit to the JSON document content, changing only the
+// text of the value edited.
+func (fe *FileEdit) applyJSON(content string) (string, error) {
+	if strings.TrimSpace(content) == "" {
+		content = "{}\n"
+	}
+	if !json.Valid([]byte(content)) {
+		return "", fmt.Errorf("invalid JSON")
+	}
+	jp := &jsonParser{s: content}
+	root, err := jp.parse()
+	if err != nil {
+		return "", err
+	}
+	unit := detectIndent(content, "  ")
+
+	// find the deepest value on the path
+	parents := []*jsonValue{}
+	indexes := []int{}
+	value := root
+	for _, seg := range fe.path {
+		i, err := value.child(seg)
+		if err != nil {
+			return "", err
+		}
+		if i < 0 {
+			break
+		}
+		parents, indexes = append(parents, value), append(indexes, i)
+		value = value.items[i]
+	}
+	found := len(parents) == len(fe.path)
+
+	var edit spliceEdit
+	switch {
+	case fe.op == DeleteEditOperation && !found:
+		return content, nil
+	case fe.op == DeleteEditOperation:
+		edit = deleteJSONItem(parents[len(parents)-1], indexes[len(indexes)-1])
+	case fe.op == AppendEditOperation && found && value.kind != '[':
+		return "", fmt.Errorf("cannot append to %s: not an array", fe.expr)
+	case fe.op == AppendEditOperation && found:
+		text, err := jsonText(fe.value, lineIndent(content, value.start)+unit, unit)
+		if err != nil {
+			return "", err
+		}
+		edit = insertJSONItem(content, parents, value, "", text, unit)
+	case found:
+		text, err := jsonText(fe.value, lineIndent(content, value.start), unit)
+		if err != nil {
+			return "", err
+		}
+		if len(parents) > 0 {
+			parent := parents[len(parents)-1]
+			if !strings.Contains(content[parent.start:parent.end], "\n") {
+				text = compactJSON(text)
+			}
+		}
+		edit = spliceEdit{value.start, value.end, text}
+	default:
+		// create what is missing of the path within the deepest value
+		rest := fe.path[len(parents):]
+		node := fe.value
+		if fe.op == AppendEditOperation {
+			node = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{node}}
+		}
+		node, err := wrapPath(rest[1:], node)
+		if err != nil {
+			return "", err
+		}
+		key := ""
+		if value.kind == '[' {
+			if rest[0].index != len(value.items) {
+				return "", fmt.Errorf("index %d out of range", rest[0].index)
+			}
+		} else {
+			quoted, err := json.Marshal(rest[0].key)
+			if err != nil {
+				return "", err
+			}
+			key = string(quoted) + ": "
+		}
+		text, err := jsonText(node, lineIndent(content, value.start)+unit, unit)
+		if err != nil {
+			return "", err
+		}
+		edit = insertJSONItem(content, parents, value, key, text, unit)
+	}
+	updated := edit.apply(content)
+	if !json.Valid([]byte(updated)) {
+		return "", fmt.Errorf("editing produced invalid JSON")
+	}
+	return updated, nil
+}
+
+// spliceEdit replaces the text between start and end with text.
+type spliceEdit struct {
+	start, end int
+	text       string
+}
+
+func (se spliceEdit) apply(s string) string {
+	return s[:se.start] + se.text + s[se.end:]
+}
+
+// insertJSONItem returns the edit appending an item of text, prefixed with
+// key for objects, to container, matching the layout of its other items, or
+// of the items of its parent, the last of parents, if it is empty.
+func insertJSONItem(content string, parents []*jsonValue, container *jsonValue, key, text, unit string) spliceEdit {
+	if len(container.items) == 0 {
+		if len(parents) > 0 {
+			parent := parents[len(parents)-1]
+			if !strings.Contains(content[parent.start:parent.end], "\n") {
+				return spliceEdit{container.start + 1, container.end - 1, key + compactJSON(text)}
+			}
+		}
+		indent := lineIndent(content, container.start)
+		return spliceEdit{container.start + 1, container.end - 1, "\n" + indent + unit + key + text + "\n" + indent}
+	}
+	last := container.items[len(container.items)-1]
+	first := container.itemStart(0)
+	if !strings.Contains(content[container.start:first], "\n") {
+		return spliceEdit{last.end, last.end, ", " + key + compactJSON(text)}
+	}
+	return spliceEdit{last.end, last.end, ",\n" + lineIndent(content, first) + key + text}
+}
+
+// deleteJSONItem returns the edit removing item i of container, and the
+// separator before or after it.
+func deleteJSONItem(container *jsonValue, i int) spliceEdit {
+	switch {
+	case len(container.items) == 1:
+		return spliceEdit{container.start + 1, container.end - 1, ""}
+	case i < len(container.items)-1:
+		return spliceEdit{container.itemStart(i), container.itemStart(i + 1), ""}
+	default:
+		return spliceEdit{container.items[i-1].end, container.items[i].end, ""}
+	}
+}
+
+// jsonText renders node as JSON, indenting nested lines by indent plus unit
+// per level and keeping the order of object keys.
+func jsonText(node *yaml.Node, indent, unit string) (string, error) {
+	b := &strings.Builder{}
+	if err := writeJSONNode(b, node, indent, unit); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func writeJSONNode(b *strings.Builder, node *yaml.Node, indent, unit string) error {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return writeJSONNode(b, node.Alias, indent, unit)
+	case yaml.MappingNode, yaml.SequenceNode:
+		open, closing, step := "[", "]", 1
+		if node.Kind == yaml.MappingNode {
+			open, closing, step = "{", "}", 2
+		}
+		if len(node.Content) == 0 {
+			b.WriteString(open + closing)
+			return nil
+		}
+		b.WriteString(open + "\n")
+		for i := 0; i < len(node.Content); i += step {
+			if i > 0 {
+				b.WriteString(",\n")
+			}
+			b.WriteString(indent + unit)
+			if node.Kind == yaml.MappingNode {
+				key, err := marshalJSON(node.Content[i].Value)
+				if err != nil {
+					return err
+				}
+				b.WriteString(key + ": ")
+			}
+			if err := writeJSONNode(b, node.Content[i+step-1], indent+unit, unit); err != nil {
+				return err
+			}
+		}
+		b.WriteString("\n" + indent + closing)
+		return nil
+	default:
+		// numbers keep their text, e.g. the trailing zero of 1.50
+		if (node.Tag == "!!int" || node.Tag == "!!float") && json.Valid([]byte(node.Value)) {
+			b.WriteString(node.Value)
+			return nil
+		}
+		var v any
+		if err := node.Decode(&v); err != nil {
+			return err
+		}
+		text, err := marshalJSON(v)
+		if err != nil {
+			return err
+		}
+		b.WriteString(text)
+		return nil
+	}
+}
+
+// marshalJSON encodes v without escaping HTML.
+func marshalJSON(v any) (string, error) {
+	b := &bytes.Buffer{}
+	encoder := json.NewEncoder(b)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// compactJSON puts text on one line, with a space after each separator.
+func compactJSON(text string) string {
+	b := &bytes.Buffer{}
+	if err := json.Compact(b, []byte(text)); err != nil {
+		return text
+	}
+	if !strings.ContainsAny(text, "{[") {
+		return b.String()
+	}
+	// reinsert the spaces compacting removed, outside strings
+	out := &strings.Builder{}
+	inString := false
+	compact := b.String()
+	for i := 0; i < len(compact); i++ {
+		c := compact[i]
+		out.WriteByte(c)
+		switch {
+		case inString && c == '\\':
+			i++
+			out.WriteByte(compact[i])
+		case c == '"':
+			inString = !inString
+		case !inString && (c == ',' || c == ':'):
+			out.WriteByte(' ')
+		}
+	}
+	return out.String()
+}
+
+// wrapPath nests node within objects for each key of path.
+func wrapPath(path []editPathSegment, node *yaml.Node) (*yaml.Node, error) {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i].isIndex {
+			return nil, fmt.Errorf("cannot create array element %s", path[i])
+		}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: path[i].key}
+		node = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{key, node}}
+	}
+	return node, nil
+}
+
+// lineIndent returns the leading whitespace of the line of s containing pos.
+func lineIndent(s string, pos int) string {
+	start := strings.LastIndexByte(s[:pos], '\n') + 1
+	end := start
+	for end < len(s) && (s[end] == ' ' || s[end] == '\t') {
+		end++
+	}
+	return s[start:end]
+}
+
+// detectIndent returns the indentation of the first indented line of s, or
+// def if there is none.
+func detectIndent(s, def string) string {
+	for _, line := range strings.Split(s, "\n") {
+		indent := lineIndent(line, 0)
+		if indent != "" && strings.TrimSpace(line) != "" {
+			return indent
+		}
+	}
+	return def
+}
+
+// applyYAML makes the edit to the YAML document content. The text of the
+// value edited is changed in place where it can be, which keeps the
+// formatting of the rest of the document; otherwise the document is
+// re-encoded, keeping only its comments.
+func (fe *FileEdit) applyYAML(content string) (string, error) {
+	decoder := yaml.NewDecoder(strings.NewReader(content))
+	var doc yaml.Node
+	if err := decoder.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	var next yaml.Node
+	if err := decoder.Decode(&next); !errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("cannot edit a file of more than one YAML document")
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	var before any
+	if err := doc.Decode(&before); err != nil {
+		return "", err
+	}
+
+	lines := strings.SplitAfter(content, "\n")
+	edit, err := fe.editYAMLNode(doc.Content[0], lines)
+	if err != nil {
+		return "", err
+	}
+	var after any
+	if err := doc.Decode(&after); err != nil {
+		return "", err
+	}
+	if reflect.DeepEqual(before, after) {
+		return content, nil
+	}
+
+	if edit != nil {
+		// keep the edit in place only if it means what the edited document does
+		updated := edit(lines)
+		var got any
+		if err := yaml.Unmarshal([]byte(updated), &got); err == nil && reflect.DeepEqual(got, after) {
+			return updated, nil
+		}
+	}
+	b := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(b)
+	encoder.SetIndent(len(detectIndent(content, "  ")))
+	if err := encoder.Encode(&doc); err != nil {
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	var got any
+	if err := yaml.Unmarshal(b.Bytes(), &got); err != nil || !reflect.DeepEqual(got, after) {
+		return "", fmt.Errorf("editing produced invalid YAML")
+	}
+	return b.String(), nil
+}
+
+// yamlTextEdit changes the lines of a YAML document in place.
+type yamlTextEdit = func(lines []string) string
+
+// editYAMLNode makes the edit to the tree of root, returning how to make it
+// to lines in place if it knows how.
+func (fe *FileEdit) editYAMLNode(root *yaml.Node, lines []string) (yamlTextEdit, error) {
+	parents := []*yaml.Node{}
+	indexes := []int{}
+	node := root
+	for _, seg := range fe.path {
+		if node.Kind == yaml.AliasNode {
+			// editing through the alias would edit the anchored value
+			return nil, aliasEditError(fe, node)
+		}
+		if fe.op == DeleteEditOperation && node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+			// there is nothing to delete under an empty value
+			break
+		}
+		i, err := yamlChild(node, seg)
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 {
+			break
+		}
+		parents, indexes = append(parents, node), append(indexes, i)
+		node = node.Content[i]
+	}
+	found := len(parents) == len(fe.path)
+	var value *yaml.Node
+	if fe.value != nil {
+		value = copyYAMLNode(fe.value)
+	}
+
+	switch {
+	case fe.op == DeleteEditOperation && !found:
+		return nil, nil
+	case fe.op == DeleteEditOperation:
+		if anchor := findAnchor(node); anchor != "" {
+			return nil, fmt.Errorf("cannot delete %s: it defines anchor &%s", fe.expr, anchor)
+		}
+		parent, i := parents[len(parents)-1], indexes[len(indexes)-1]
+		edit := deleteYAMLLines(parent, i, lines)
+		if parent.Kind == yaml.MappingNode {
+			parent.Content = append(parent.Content[:i-1], parent.Content[i+1:]...)
+		} else {
+			parent.Content = append(parent.Content[:i], parent.Content[i+1:]...)
+		}
+		return edit, nil
+	case fe.op == AppendEditOperation && found:
+		if node.Kind == yaml.AliasNode {
+			return nil, aliasEditError(fe, node)
+		}
+		if node.Kind != yaml.SequenceNode {
+			return nil, fmt.Errorf("cannot append to %s: not an array", fe.expr)
+		}
+		edit := appendYAMLLines(node, nil, value, lines)
+		node.Content = append(node.Content, value)
+		return edit, nil
+	case found:
+		for _, child := range node.Content {
+			if anchor := findAnchor(child); anchor != "" {
+				return nil, fmt.Errorf("cannot replace %s: it defines anchor &%s", fe.expr, anchor)
+			}
+		}
+		edit := replaceYAMLScalar(node, value, lines)
+		// keep the comments and anchor of the value being replaced
+		head, line, foot, anchor := node.HeadComment, node.LineComment, node.FootComment, node.Anchor
+		if value.Kind != yaml.ScalarNode && line != "" {
+			// a collection takes lines of its own, so a comment at the end
+			// of the line would end up after its last entry instead
+			parent, i := parents[len(parents)-1], indexes[len(indexes)-1]
+			if parent.Kind == yaml.MappingNode && parent.Content[i-1].LineComment == "" {
+				parent.Content[i-1].LineComment = line
+			} else {
+				head = strings.TrimPrefix(head+"\n"+line, "\n")
+			}
+			line = ""
+		}
+		*node = *value
+		node.HeadComment, node.LineComment, node.FootComment, node.Anchor = head, line, foot, anchor
+		return edit, nil
+	}
+
+	rest := fe.path[len(parents):]
+	if fe.op == AppendEditOperation {
+		value = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{value}}
+	}
+	value, err := wrapPath(rest[1:], value)
+	if err != nil {
+		return nil, err
+	}
+	if node.Kind == yaml.SequenceNode {
+		if rest[0].index != len(node.Content) {
+			return nil, fmt.Errorf("index %d out of range", rest[0].index)
+		}
+		edit := appendYAMLLines(node, nil, value, lines)
+		node.Content = append(node.Content, value)
+		return edit, nil
+	}
+	key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: rest[0].key}
+	edit := appendYAMLLines(node, key, value, lines)
+	node.Content = append(node.Content, key, value)
+	return edit, nil
+}
+
+// aliasEditError returns the error for an edit of fe that would change the
+// value alias refers to.
+func aliasEditError(fe *FileEdit, alias *yaml.Node) error {
+	return fmt.Errorf("cannot %s %s through alias *%s", fe.op, fe.expr, alias.Value)
+}
+
+// yamlChild returns the index in the content of node of the value seg
+// selects, or -1 if there is none.
+func yamlChild(node *yaml.Node, seg editPathSegment) (int, error) {
+	switch {
+	case node.Kind == yaml.MappingNode && !seg.isIndex:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == seg.key {
+				return i + 1, nil
+			}
+		}
+		return -1, nil
+	case node.Kind == yaml.SequenceNode && seg.isIndex:
+		return resolveIndex(seg.index, len(node.Content)), nil
+	case node.Kind == yaml.ScalarNode && node.Tag == "!!null":
+		// an empty value is filled in
+		if seg.isIndex {
+			node.Kind, node.Tag, node.Value = yaml.SequenceNode, "!!seq", ""
+		} else {
+			node.Kind, node.Tag, node.Value = yaml.MappingNode, "!!map", ""
+		}
+		return -1, nil
+	case seg.isIndex:
+		return 0, fmt.Errorf("cannot index %s: not an array", seg)
+	default:
+		return 0, fmt.Errorf("cannot get %s: not an object", seg)
+	}
+}
+
+// copyYAMLNode returns a deep copy of node, so that each edit of a run gets
+// a value of its own.
+func copyYAMLNode(node *yaml.Node) *yaml.Node {
+	copied := *node
+	copied.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		copied.Content[i] = copyYAMLNode(child)
+	}
+	return &copied
+}
+
+// findAnchor returns an anchor defined by node or a node within it, or "" if
+// there is none. Removing it would leave its aliases undefined.
+func findAnchor(node *yaml.Node) string {
+	if node.Anchor != "" {
+		return node.Anchor
+	}
+	for _, child := range node.Content {
+		if anchor := findAnchor(child); anchor != "" {
+			return anchor
+		}
+	}
+	return ""
+}
+
+// detachNode forgets where node was parsed, which would otherwise be taken
+// for positions in the file edited, and whether its collections were flow
+// style, so that they take the block style of the file. Scalars keep their
+// quoting.
+func detachNode(node *yaml.Node) {
+	node.Line, node.Column = 0, 0
+	if node.Kind != yaml.ScalarNode {
+		node.Style &^= yaml.FlowStyle
+	}
+	for _, child := range node.Content {
+		detachNode(child)
+	}
+}
+
+// isBlock reports whether node is a non-empty block collection whose lines
+// can be edited.
+func isBlock(node *yaml.Node) bool {
+	return node.Style&yaml.FlowStyle == 0 && len(node.Content) > 0 && node.Line > 0 && node.Column > 0
+}
+
+// blockEnd returns the index of the line after the last line of the block
+// starting on line start at column col, counting a sequence at the same
+// column if seq.
+func blockEnd(lines []string, start, col int, seq bool) int {
+	end := start + 1
+	for i := start + 1; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if trimmed == "" {
+			continue
+		}
+		indent := len(lines[i]) - len(strings.TrimLeft(lines[i], " "))
+		if indent > col || (seq && indent == col && strings.HasPrefix(trimmed, "-")) {
+			end = i + 1
+			continue
+		}
+		break
+	}
+	return end
+}
+
+// entryEnd returns the index of the line after the last line of entry i of
+// the block collection node.
+func entryEnd(node *yaml.Node, i int, lines []string) int {
+	if node.Kind == yaml.MappingNode {
+		key, value := node.Content[i-1], node.Content[i]
+		seq := value.Kind == yaml.SequenceNode && value.Column == key.Column
+		return blockEnd(lines, key.Line-1, key.Column-1, seq)
+	}
+	return blockEnd(lines, node.Content[i].Line-1, node.Column-1, false)
+}
+
+// deleteYAMLLines returns the edit removing the lines of entry i of the
+// block collection node, or nil if it is not in a block of its own.
+func deleteYAMLLines(node *yaml.Node, i int, lines []string) yamlTextEdit {
+	if !isBlock(node) {
+		return nil
+	}
+	start := node.Content[i].Line - 1
+	if node.Kind == yaml.MappingNode {
+		start = node.Content[i-1].Line - 1
+	}
+	end := entryEnd(node, i, lines)
+	return func(lines []string) string {
+		return strings.Join(lines[:start], "") + strings.Join(lines[end:], "")
+	}
+}
+
+// appendYAMLLines returns the edit adding value, under key for mappings,
+// after the last entry of the collection node, or nil if it cannot be made
+// in place.
+func appendYAMLLines(node, key, value *yaml.Node, lines []string) yamlTextEdit {
+	if node.Style&yaml.FlowStyle != 0 {
+		return appendFlowText(node, key, value, lines)
+	}
+	if !isBlock(node) {
+		return nil
+	}
+	entry := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{value}}
+	if key != nil {
+		entry = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{key, value}}
+	}
+	b := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(b)
+	encoder.SetIndent(max(len(detectIndent(strings.Join(lines, ""), "  ")), 2))
+	if err := encoder.Encode(entry); err != nil {
+		return nil
+	}
+	indent := strings.Repeat(" ", node.Column-1)
+	text := ""
+	for _, line := range strings.SplitAfter(b.String(), "\n") {
+		if line != "" {
+			text += indent + line
+		}
+	}
+	end := entryEnd(node, len(node.Content)-1, lines)
+	return func(lines []string) string {
+		before := strings.Join(lines[:end], "")
+		if before != "" && !strings.HasSuffix(before, "\n") {
+			before += "\n"
+		}
+		return before + text + strings.Join(lines[end:], "")
+	}
+}
+
+// appendFlowText returns the edit adding value, under key for mappings, to
+// the end of the flow collection node, or nil if it spans lines.
+func appendFlowText(node, key, value *yaml.Node, lines []string) yamlTextEdit {
+	if node.Line < 1 || node.Line > len(lines) {
+		return nil
+	}
+	line := lines[node.Line-1]
+	start := node.Column - 1
+	if start >= len(line) || (line[start] != '[' && line[start] != '{') {
+		return nil
+	}
+	// find the closing bracket, skipping nested collections and quotes
+	end, depth := -1, 0
+	var quote byte
+	for i := start; i < len(line) && end < 0; i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+			if depth == 0 {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return nil
+	}
+
+	entry := copyYAMLNode(value)
+	setFlowStyle(entry)
+	encoded, err := yaml.Marshal(entry)
+	if err != nil {
+		return nil
+	}
+	text := strings.TrimSuffix(string(encoded), "\n")
+	if key != nil {
+		encodedKey, err := yaml.Marshal(key)
+		if err != nil {
+			return nil
+		}
+		text = strings.TrimSuffix(string(encodedKey), "\n") + ": " + text
+	}
+	if strings.Contains(text, "\n") {
+		return nil
+	}
+	if len(node.Content) > 0 {
+		text = ", " + text
+	}
+	i := node.Line - 1
+	return func(lines []string) string {
+		edited := append([]string{}, lines...)
+		edited[i] = line[:end] + text + line[end:]
+		return strings.Join(edited, "")
+	}
+}
+
+// setFlowStyle makes the collections of node flow style.
+func setFlowStyle(node *yaml.Node) {
+	if node.Kind != yaml.ScalarNode {
+		node.Style |= yaml.FlowStyle
+	}
+	for _, child := range node.Content {
+		setFlowStyle(child)
+	}
+}
+
+// replaceYAMLScalar returns the edit replacing the text of the scalar node
+// with value, keeping its quoting, or nil if either spans lines.
+func replaceYAMLScalar(node, value *yaml.Node, lines []string) yamlTextEdit {
+	if node.Kind != yaml.ScalarNode || value.Kind != yaml.ScalarNode || node.Line < 1 || node.Line > len(lines) {
+		return nil
+	}
+	line := lines[node.Line-1]
+	start := node.Column - 1
+	if node.Anchor != "" {
+		// the anchor stays before the new value
+		if !strings.HasPrefix(line[min(start, len(line)):], "&"+node.Anchor) {
+			return nil
+		}
+		start += len(node.Anchor) + 1
+		for start < len(line) && line[start] == ' ' {
+			start++
+		}
+	}
+	if start >= len(line) {
+		return nil
+	}
+	var end int
+	switch node.Style {
+	case 0, yaml.TaggedStyle:
+		if !strings.HasPrefix(line[start:], node.Value) {
+			return nil
+		}
+		end = start + len(node.Value)
+	case yaml.DoubleQuotedStyle, yaml.SingleQuotedStyle:
+		quote := line[start]
+		end = start + 1
+		for end < len(line) && line[end] != quote {
+			if line[end] == '\\' && quote == '"' {
+				end++
+			} else if quote == '\'' && strings.HasPrefix(line[end:], "''") {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return nil
+		}
+		end++
+	default:
+		return nil
+	}
+
+	replacement := *value
+	if value.Tag == "!!str" && node.Tag == "!!str" {
+		// a string stays quoted as it was, or quoted only if it must be
+		replacement.Style = node.Style & (yaml.DoubleQuotedStyle | yaml.SingleQuotedStyle)
+	}
+	encoded, err := yaml.Marshal(&replacement)
+	if err != nil {
+		return nil
+	}
+	text := strings.TrimSuffix(string(encoded), "\n")
+	if strings.Contains(text, "\n") {
+		return nil
+	}
+	i := node.Line - 1
+	return func(lines []string) string {
+		edited := append([]string{}, lines...)
+		edited[i] = line[:start] + text + line[end:]
+		return strings.Join(edited, "")
+	}
+}
@@ -0,0 +1,206 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseFileEdit(t *testing.T) {
+	tests := []struct {
+		op, spec string
+		file     string
+		path     string
+		err      string
+	}{
+		{SetEditOperation, "package.json:version=1.2.3", "package.json", `"version"`, ""},
+		{SetEditOperation, `./a.yml:jobs.build.steps[-1]["with"].x=1`, "a.yml", `"jobs" "build" "steps" [-1] "with" "x"`, ""},
+		{DeleteEditOperation, `a.json:["a.b=c"][0]`, "a.json", `"a.b=c" [0]`, ""},
+		{AppendEditOperation, "a.yaml:on.push.branches=main", "a.yaml", `"on" "push" "branches"`, ""},
+		{SetEditOperation, "a.toml:a=1", "", "", "expected a .json, .yml or .yaml file"},
+		{SetEditOperation, "../a.json:a=1", "", "", "invalid file"},
+		{SetEditOperation, "a.json", "", "", "expected FILE:PATH"},
+		{SetEditOperation, "a.json:a", "", "", "expected FILE:PATH=VALUE"},
+		{DeleteEditOperation, "a.json:a=1", "", "", "unexpected"},
+		{SetEditOperation, "a.json:=1", "", "", "empty path"},
+		{SetEditOperation, "a.json:a..b=1", "", "", "empty key"},
+		{SetEditOperation, "a.json:a[x]=1", "", "", "invalid index"},
+		{SetEditOperation, "a.json:a[0]b=1", "", "", "expected . or ["},
+		{SetEditOperation, "a.json:a={b", "", "", "parsing value"},
+	}
+	for _, test := range tests {
+		edit, err := ParseFileEdit(test.op, test.spec)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s %q: expected error containing %q, got %v", test.op, test.spec, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: %v", test.op, test.spec, err)
+			continue
+		}
+		segments := []string{}
+		for _, seg := range edit.path {
+			segments = append(segments, seg.String())
+		}
+		if edit.file != test.file || strings.Join(segments, " ") != test.path {
+			t.Errorf("%s %q: expected %s at %s, got %s at %s", test.op, test.spec, test.file, test.path, edit.file, strings.Join(segments, " "))
+		}
+	}
+}
+
+func TestParseEditPath(t *testing.T) {
+	tests := []struct {
+		s    string
+		path string
+		n    int
+		err  string
+	}{
+		{"a", `"a"`, 1, ""},
+		{"a.b=1", `"a" "b"`, 3, ""},
+		{"a[0][-2].b", `"a" [0] [-2] "b"`, 10, ""},
+		{`["a.b"]["c]"].d`, `"a.b" "c]" "d"`, 15, ""},
+		{`a["x\"y"]=z`, `"a" "x\"y"`, 9, ""},
+		{"[1]", `[1]`, 3, ""},
+		{"=1", "", 0, "empty path"},
+		{"a.", "", 0, "empty key"},
+		{"a.[0]", "", 0, "unexpected ["},
+		{"a[0", "", 0, "unclosed ["},
+		{"a[-]", "", 0, "invalid index"},
+		{`a["b`, "", 0, "invalid quoted key"},
+		{`a["b"x`, "", 0, "expected ]"},
+		{"a[0]b", "", 0, "expected . or ["},
+	}
+	for _, test := range tests {
+		segments, n, err := parseEditPath(test.s)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected error containing %q, got %v", test.s, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.s, err)
+			continue
+		}
+		path := []string{}
+		for _, seg := range segments {
+			path = append(path, seg.String())
+		}
+		if strings.Join(path, " ") != test.path || n != test.n {
+			t.Errorf("%q: expected %s of length %d, got %s of length %d", test.s, test.path, test.n, strings.Join(path, " "), n)
+		}
+	}
+}
+
+func TestFileEditApply(t *testing.T) {
+	packageJSON := "{\n  \"name\": \"a\",\n  \"version\": \"1.0.0\",\n  \"files\": [\"dist\"],\n  \"scripts\": {\n    \"test\": \"jest\"\n  }\n}\n"
+	workflow := `# CI
+on:
+  push:
+    branches: [main] # default only
+
+jobs:
+  build:
+    runs-on: ubuntu-latest
+    steps:
+      - uses: actions/checkout@v3
+      - run: make # build it
+
+  lint:
+    runs-on: ubuntu-latest
+`
+	tests := []struct {
+		op, spec string
+		content  string
+		expected string
+		err      string
+	}{
+		// JSON edits change only the text of the value edited
+		{SetEditOperation, `a.json:version="1.1.0"`, packageJSON, strings.Replace(packageJSON, "1.0.0", "1.1.0", 1), ""},
+		{SetEditOperation, `a.json:scripts.lint=eslint .`, packageJSON,
+			strings.Replace(packageJSON, "\"jest\"\n", "\"jest\",\n    \"lint\": \"eslint .\"\n", 1), ""},
+		{SetEditOperation, `a.json:engines.node=">=20"`, packageJSON,
+			strings.Replace(packageJSON, "  }\n}", "  },\n  \"engines\": {\n    \"node\": \">=20\"\n  }\n}", 1), ""},
+		{AppendEditOperation, `a.json:files=lib`, packageJSON, strings.Replace(packageJSON, `["dist"]`, `["dist", "lib"]`, 1), ""},
+		{DeleteEditOperation, `a.json:version`, packageJSON, strings.Replace(packageJSON, "  \"version\": \"1.0.0\",\n", "", 1), ""},
+		{DeleteEditOperation, `a.json:scripts`, packageJSON, strings.Replace(packageJSON, ",\n  \"scripts\": {\n    \"test\": \"jest\"\n  }", "", 1), ""},
+		{DeleteEditOperation, `a.json:files[0]`, packageJSON, strings.Replace(packageJSON, `["dist"]`, `[]`, 1), ""},
+		{DeleteEditOperation, `a.json:missing.key`, packageJSON, packageJSON, ""},
+		{SetEditOperation, `a.json:a={b: 1, c: [x]}`, "", "{\n  \"a\": {\n    \"b\": 1,\n    \"c\": [\n      \"x\"\n    ]\n  }\n}\n", ""},
+		{SetEditOperation, `a.json:version.major=1`, packageJSON, "", "not an object"},
+		{AppendEditOperation, `a.json:name=b`, packageJSON, "", "not an array"},
+		{SetEditOperation, `a.json:a=1`, "{", "", "invalid JSON"},
+		{AppendEditOperation, `a.json:arr=3`, `{"arr": []}`, `{"arr": [3]}`, ""},
+		{SetEditOperation, `a.json:a.b=1`, `{"a": {}, "c": 2}`, `{"a": {"b": 1}, "c": 2}`, ""},
+		{AppendEditOperation, `a.json:arr=3`, "{\n  \"arr\": []\n}\n", "{\n  \"arr\": [\n    3\n  ]\n}\n", ""},
+		{SetEditOperation, `a.json:a=[1, 2.50]`, `{"a": 1, "b": 2}`, `{"a": [1, 2.50], "b": 2}`, ""},
+		{SetEditOperation, `a.json:b=2`, "{\r\n  \"a\": 1\r\n}\r\n", "{\r\n  \"a\": 1,\r\n  \"b\": 2\r\n}\r\n", ""},
+
+		// YAML edits keep comments and layout
+		{SetEditOperation, `a.yml:jobs.build.runs-on=ubuntu-24.04`, workflow, strings.Replace(workflow, "ubuntu-latest", "ubuntu-24.04", 1), ""},
+		{SetEditOperation, `a.yml:jobs.build.steps[0].uses=actions/checkout@v4`, workflow, strings.Replace(workflow, "@v3", "@v4", 1), ""},
+		{AppendEditOperation, `a.yml:jobs.build.steps={run: make test}`, workflow,
+			strings.Replace(workflow, "# build it\n", "# build it\n      - run: make test\n", 1), ""},
+		{SetEditOperation, `a.yml:jobs.build.timeout-minutes=10`, workflow,
+			strings.Replace(workflow, "# build it\n", "# build it\n    timeout-minutes: 10\n", 1), ""},
+		{DeleteEditOperation, `a.yml:jobs.lint`, workflow, strings.Replace(workflow, "\n  lint:\n    runs-on: ubuntu-latest\n", "\n", 1), ""},
+		{DeleteEditOperation, `a.yml:jobs.build.steps[-1]`, workflow, strings.Replace(workflow, "      - run: make # build it\n", "", 1), ""},
+		{AppendEditOperation, `a.yml:on.push.branches=release`, workflow, strings.Replace(workflow, "[main] #", "[main, release] #", 1), ""},
+		{SetEditOperation, `a.yml:version=2`, "# keep\nversion: '1'\n", "# keep\nversion: 2\n", ""},
+		{SetEditOperation, `a.yml:version="2"`, "version: '1' # v\n", "version: '2' # v\n", ""},
+		{SetEditOperation, `a.yml:a.b=1`, "", "a:\n  b: 1\n", ""},
+		{AppendEditOperation, `a.yml:steps={run: b}`, "steps:\n- run: a\n", "steps:\n- run: a\n- run: b\n", ""},
+		{SetEditOperation, `a.yml:a.c=2`, "a:\n    b: 1\n", "a:\n    b: 1\n    c: 2\n", ""},
+		{SetEditOperation, `a.yml:a={k: v}`, "a: 1 # c\nb: 2\n", "a: # c\n  k: v\nb: 2\n", ""},
+		{SetEditOperation, `a.yml:a[0]={k: v}`, "a:\n  - 1 # c\n  - 2\n", "a:\n  # c\n  - k: v\n  - 2\n", ""},
+		{SetEditOperation, `a.yml:a=1`, "a: &anc 5\nb: *anc\n", "a: &anc 1\nb: *anc\n", ""},
+		{SetEditOperation, `a.yml:a=1`, "a: {x: &anc 5}\nb: *anc\n", "", "defines anchor &anc"},
+		{DeleteEditOperation, `a.yml:a`, "a: &anc 5\nb: *anc\n", "", "defines anchor &anc"},
+		{SetEditOperation, `a.yml:b.x=2`, "a: &base {x: 1}\nb: *base\n", "", "cannot set b.x through alias *base"},
+		{AppendEditOperation, `a.yml:b=2`, "a: &base [1]\nb: *base\n", "", "cannot append b through alias *base"},
+		{DeleteEditOperation, `a.yml:b.x`, "a: &base {x: 1}\nb: *base\n", "", "through alias *base"},
+		{SetEditOperation, `a.yml:b=2`, "a: &base {x: 1}\nb: *base\n", "a: &base {x: 1}\nb: 2\n", ""},
+		{SetEditOperation, `a.yml:b.c=2`, "a: 1\r\nb:\r\n  c: 1 # c\r\n", "a: 1\r\nb:\r\n  c: 2 # c\r\n", ""},
+		{SetEditOperation, `a.yml:b.d=2`, "a: 1\r\nb:\r\n  c: 1\r\n", "a: 1\r\nb:\r\n  c: 1\r\n  d: 2\r\n", ""},
+		{SetEditOperation, `a.yml:on.push.branches.main=1`, workflow, "", "not an object"},
+		{SetEditOperation, `a.yml:a=1`, "a: 1\n---\nb: 2\n", "", "more than one YAML document"},
+	}
+	for _, test := range tests {
+		edit, err := ParseFileEdit(test.op, test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := edit.apply(test.content)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error containing %q, got %v", edit, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", edit, err)
+			continue
+		}
+		if got != test.expected {
+			t.Errorf("%s of %q:\nexpected %q\ngot      %q", edit, test.content, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// summaryListLimit bounds the repositories named for an output group in
+// the console summary.
+const summaryListLimit = 5
+
+// runSummary aggregates the results of a run.
+type runSummary struct {
+	Total    int                     `json:"total"`
+	Statuses map[ExecutionStatus]int `json:"statuses"`
+	Failures []summaryFailure        `json:"failures"`
+	// Outputs groups the repositories that ran the command by identical
+	// stdout, largest group first.
+	Outputs []*outputGroup `json:"outputs"`
+
+	groups map[string]*outputGroup
+}
+
+type summaryFailure struct {
+	Repository string `json:"repository"`
+	Error      string `json:"error"`
+}
+
+type outputGroup struct {
+	Stdout       string   `json:"stdout"`
+	Repositories []string `json:"repositories"`
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{
+		Statuses: map[ExecutionStatus]int{},
+		Failures: []summaryFailure{},
+		Outputs:  []*outputGroup{},
+		groups:   map[string]*outputGroup{},
+	}
+}
+
+// add counts result in the summary.
+func (rs *runSummary) add(result *executionResult) {
+	rs.Total++
+	rs.Statuses[result.Status]++
+	if result.Status == FailedStatus {
+		failure := summaryFailure{Repository: result.Repository}
+		if result.Error != nil {
+			failure.Error = firstLine(result.Error.Error())
+		}
+		rs.Failures = append(rs.Failures, failure)
+	}
+	if result.Attempts == 0 {
+		// the command never ran
+		return
+	}
+	group, ok := rs.groups[result.Stdout]
+	if !ok {
+		group = &outputGroup{Stdout: result.Stdout}
+		rs.groups[result.Stdout] = group
+		rs.Outputs = append(rs.Outputs, group)
+	}
+	group.Repositories = append(group.Repositories, result.Repository)
+}
+
+// finish sorts the summary for output.
+func (rs *runSummary) finish() {
+	sort.Slice(rs.Failures, func(i, j int) bool {
+		return rs.Failures[i].Repository < rs.Failures[j].Repository
+	})
+	for _, group := range rs.Outputs {
+		sort.Strings(group.Repositories)
+	}
+	sort.SliceStable(rs.Outputs, func(i, j int) bool {
+		return len(rs.Outputs[i].Repositories) > len(rs.Outputs[j].Repositories)
+	})
+}
+
+func (rs *runSummary) String() string {
+	str := fmt.Sprintf("===== summary: %d %s\n", rs.Total, plural(rs.Total, "repository", "repositories"))
+	statuses := []string{}
+	for _, status := range rs.statuses() {
+		statuses = append(statuses, fmt.Sprintf("%s %d", status, rs.Statuses[status]))
+	}
+	str += strings.Join(statuses, ", ") + "\n"
+	if len(rs.Failures) > 0 {
+		str += "failed:\n"
+		for _, failure := range rs.Failures {
+			str += fmt.Sprintf("  %s: %s\n", failure.Repository, failure.Error)
+		}
+	}
+	if len(rs.Outputs) > 0 {
+		str += "stdout:\n"
+		for _, group := range rs.Outputs {
+			n := len(group.Repositories)
+			str += fmt.Sprintf("  %d %s printed %s", n, plural(n, "repository", "repositories"), describeOutput(group.Stdout))
+			if n <= summaryListLimit && len(rs.Outputs) > 1 {
+				str += ": " + strings.Join(group.Repositories, ", ")
+			}
+			str += "\n"
+		}
+	}
+	return str
+}
+
+// statuses returns the statuses to report totals for: success, failure and
+// skipping, and no-ops, review skips and drift if there were any.
+func (rs *runSummary) statuses() []ExecutionStatus {
+	statuses := []ExecutionStatus{}
+	for _, status := range []ExecutionStatus{SucceededStatus, NoOpStatus, DriftedStatus, FailedStatus, SkippedPreconditionStatus, SkippedReviewStatus} {
+		switch status {
+		case NoOpStatus, DriftedStatus, SkippedReviewStatus:
+			if rs.Statuses[status] == 0 {
+				continue
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (rs *runSummary) JsonString() (string, error) {
+	str, err := json.Marshal(struct {
+		Summary *runSummary `json:"summary"`
+	}{rs})
+	if err != nil {
+		return "", err
+	}
+	return string(str), nil
+}
+
+// describeOutput abbreviates stdout to its first line.
+func describeOutput(stdout string) string {
+	if stdout == "" {
+		return "nothing"
+	}
+	const maxLen = 60
+	lines := strings.Count(strings.TrimSuffix(stdout, "\n"), "\n") + 1
+	line := firstLine(stdout)
+	if utf8.RuneCountInString(line) > maxLen {
+		line = string([]rune(line)[:maxLen]) + "..."
+	}
+	str := strconv.Quote(line)
+	if lines > 1 {
+		str += fmt.Sprintf(" (%d lines)", lines)
+	}
+	return str
+}
+
+func plural(n int, singular, plural string) string {
+	if n == 1 {
+		return singular
+	}
+	return plural
+}
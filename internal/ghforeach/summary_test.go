@@ -0,0 +1,69 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRunSummary_String(t *testing.T) {
+	summary := newRunSummary()
+	for i := 0; i < 7; i++ {
+		summary.add(&executionResult{Repository: "org/ok" + string(rune('a'+i)), Status: SucceededStatus, Stdout: "ok\n", Attempts: 1})
+	}
+	summary.add(&executionResult{Repository: "org/multi", Status: SucceededStatus, Stdout: "one\ntwo\n", Attempts: 1})
+	summary.add(&executionResult{Repository: "org/quiet", Status: FailedStatus, Error: errors.New("exit status 2\ntrace"), Attempts: 1})
+	summary.add(&executionResult{Repository: "org/gone", Status: FailedStatus, Error: errors.New("cloning repository: not found")})
+	summary.add(&executionResult{Repository: "org/skip", Status: SkippedPreconditionStatus})
+	summary.finish()
+
+	expected := `===== summary: 11 repositories
+succeeded 8, failed 2, skipped (precondition) 1
+failed:
+  org/gone: cloning repository: not found
+  org/quiet: exit status 2
+stdout:
+  7 repositories printed "ok"
+  1 repository printed "one" (2 lines): org/multi
+  1 repository printed nothing: org/quiet
+`
+	if got := summary.String(); got != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, got)
+	}
+}
+
+func TestDescribeOutput(t *testing.T) {
+	tests := []struct {
+		stdout   string
+		expected string
+	}{
+		{"", "nothing"},
+		{"ok\n", `"ok"`},
+		{"one\ntwo\n", `"one" (2 lines)`},
+		{strings.Repeat("a", 61), `"` + strings.Repeat("a", 60) + `..."`},
+		// truncated by character, not byte
+		{strings.Repeat("é", 61), `"` + strings.Repeat("é", 60) + `..."`},
+	}
+	for _, test := range tests {
+		if got := describeOutput(test.stdout); got != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.stdout, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/google/go-github/v60/github"
+	"gopkg.in/yaml.v3"
+)
+
+// SyncMode is how a synced file is reconciled with one already in a
+// repository.
+type SyncMode = string
+
+const (
+	// CreateOnlySyncMode creates missing files but leaves existing ones be.
+	CreateOnlySyncMode SyncMode = "create-only"
+	// OverwriteSyncMode replaces files that differ.
+	OverwriteSyncMode SyncMode = "overwrite"
+	// MergeSyncMode merges into existing files: JSON and YAML objects
+	// recursively, keeping keys missing from the synced file, and other files
+	// by appending the lines they lack.
+	MergeSyncMode SyncMode = "merge"
+)
+
+// WithSyncManifest makes the files in each repository match manifest
+// instead of running a command. Without WithCommitMessage, repositories whose
+// files differ are reported as drifted; with it, the differences are
+// committed. It implies WithDiff.
+func WithSyncManifest(manifest *SyncManifest) RepositoryExecutorOption {
+	return func(fre *RepositoryExecutor) error {
+		fre.syncManifest = manifest
+		fre.captureDiff = true
+		return nil
+	}
+}
+
+// SyncManifest lists the files to keep in sync across repositories.
+type SyncManifest struct {
+	name  string
+	files []*syncFile
+}
+
+// syncFile is an entry of a manifest, e.g.
+//
+//   - dest: .github/dependabot.yml
+//     source: dependabot.yml
+//     template: true
+//     mode: merge
+type syncFile struct {
+	// Dest is the path of the file in each repository.
+	Dest string `yaml:"dest"`
+	// Source is the path of the file to sync, relative to the manifest, and
+	// Content the file itself, of which there must be one.
+	Source  string  `yaml:"source"`
+	Content *string `yaml:"content"`
+	// Template renders the file as a Go template of syncTemplateData.
+	Template bool     `yaml:"template"`
+	Mode     SyncMode `yaml:"mode"`
+
+	content string
+	tmpl    *template.Template
+}
+
+// syncTemplateData is the data synced templates are rendered with.
+type syncTemplateData struct {
+	Name          string
+	Owner         string
+	FullName      string
+	DefaultBranch string
+	Topics        []string
+	Repository    *github.Repository
+}
+
+// ReadSyncManifest reads the YAML manifest at p, and the files it names.
+func ReadSyncManifest(p string) (*SyncManifest, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Files []*syncFile `yaml:"files"`
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("parsing sync manifest %s: %w", p, err)
+	}
+	if len(doc.Files) == 0 {
+		return nil, fmt.Errorf("sync manifest %s lists no files", p)
+	}
+	manifest := &SyncManifest{name: p}
+	dests := map[string]bool{}
+	for _, file := range doc.Files {
+		if err := file.load(path.Dir(p)); err != nil {
+			return nil, fmt.Errorf("sync manifest %s: %w", p, err)
+		}
+		if dests[file.Dest] {
+			return nil, fmt.Errorf("sync manifest %s: %s is listed more than once", p, file.Dest)
+		}
+		dests[file.Dest] = true
+		manifest.files = append(manifest.files, file)
+	}
+	return manifest, nil
+}
+
+// load validates file and reads its source from dir.
+func (sf *syncFile) load(dir string) error {
+	dest, ok := cleanRepoPath(sf.Dest)
+	if !ok {
+		return fmt.Errorf("invalid destination %q", sf.Dest)
+	}
+	sf.Dest = dest
+	switch sf.Mode {
+	case "":
+		sf.Mode = OverwriteSyncMode
+	case CreateOnlySyncMode, OverwriteSyncMode, MergeSyncMode:
+	default:
+		return fmt.Errorf("%s: invalid mode %q: expected create-only, overwrite or merge", sf.Dest, sf.Mode)
+	}
+	switch {
+	case (sf.Source == "") == (sf.Content == nil):
+		return fmt.Errorf("%s: expected either a source or content", sf.Dest)
+	case sf.Content != nil:
+		sf.content = *sf.Content
+	default:
+		source := sf.Source
+		if !path.IsAbs(source) {
+			source = path.Join(dir, source)
+		}
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return fmt.Errorf("%s: %w", sf.Dest, err)
+		}
+		sf.content = string(data)
+	}
+	if sf.Template {
+		tmpl, err := template.New(sf.Dest).Option("missingkey=error").Parse(sf.content)
+		if err != nil {
+			return err
+		}
+		sf.tmpl = tmpl
+	}
+	return nil
+}
+
+// cleanRepoPath cleans the path p of a file in a repository, reporting
+// whether it stays within the repository and out of .git.
+func cleanRepoPath(p string) (string, bool) {
+	clean := path.Clean(p)
+	if p == "" || path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") ||
+		clean == ".git" || strings.HasPrefix(clean, ".git/") {
+		return "", false
+	}
+	return clean, true
+}
+
+// render returns the contents of the file for repo.
+func (sf *syncFile) render(repo *github.Repository) (string, error) {
+	if sf.tmpl == nil {
+		return sf.content, nil
+	}
+	b := &strings.Builder{}
+	err := sf.tmpl.Execute(b, syncTemplateData{
+		Name:          repo.GetName(),
+		Owner:         repoOwner(repo),
+		FullName:      repo.GetFullName(),
+		DefaultBranch: repo.GetDefaultBranch(),
+		Topics:        repo.Topics,
+		Repository:    repo,
+	})
+	return b.String(), err
+}
+
+// syncFiles makes the files of the clone of repo at dir match the manifest,
+// listing those that differed to w.
+func (rh *RepositoryExecutor) syncFiles(repo *github.Repository, dir string, w io.Writer) error {
+	for _, file := range rh.syncManifest.files {
+		p := path.Join(dir, file.Dest)
+		existing, err := os.ReadFile(p)
+		exists := err == nil
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		updated, changed, err := file.reconcile(repo, string(existing), exists)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+		reportDrift(w, file.Dest, exists)
+		if err := writeRepoFile(p, updated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRepoFile writes content to the file at p in a clone, creating it and
+// its directories if needed and otherwise keeping its mode.
+func writeRepoFile(p, content string) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(p); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, []byte(content), mode)
+}
+
+// reconcile returns the contents file should have in repo, given the
+// existing contents if it exists, and whether they differ.
+func (sf *syncFile) reconcile(repo *github.Repository, existing string, exists bool) (string, bool, error) {
+	if exists && sf.Mode == CreateOnlySyncMode {
+		return existing, false, nil
+	}
+	want, err := sf.render(repo)
+	if err != nil {
+		return "", false, fmt.Errorf("rendering %s: %w", sf.Dest, err)
+	}
+	if !exists || sf.Mode != MergeSyncMode {
+		return want, !exists || existing != want, nil
+	}
+	updated, changed, err := mergeSyncFile(sf.Dest, existing, want)
+	if err != nil {
+		return "", false, fmt.Errorf("merging %s: %w", sf.Dest, err)
+	}
+	return updated, changed, nil
+}
+
+// reportDrift lists the file at p as differing or missing to w.
+func reportDrift(w io.Writer, p string, exists bool) {
+	if exists {
+		fmt.Fprintf(w, "%s: differs\n", p)
+	} else {
+		fmt.Fprintf(w, "%s: missing\n", p)
+	}
+}
+
+// mergeSyncFile merges want into existing, by the format the extension of
+// dest implies, and reports whether that changed anything.
+func mergeSyncFile(dest, existing, want string) (string, bool, error) {
+	switch strings.ToLower(path.Ext(dest)) {
+	case ".json":
+		return mergeJSON(existing, want)
+	case ".yml", ".yaml":
+		return mergeYAML(existing, want)
+	default:
+		return mergeLines(existing, want)
+	}
+}
+
+// mergeJSON merges the object want into the object existing, rewriting only
+// the values want changes so that the rest of existing keeps its key order
+// and formatting.
+func mergeJSON(existing, want string) (string, bool, error) {
+	if !json.Valid([]byte(existing)) || !json.Valid([]byte(want)) {
+		return "", false, fmt.Errorf("invalid JSON")
+	}
+	var wantDoc yaml.Node
+	if err := yaml.Unmarshal([]byte(want), &wantDoc); err != nil {
+		return "", false, err
+	}
+	merged, err := mergeJSONNode(existing, nil, wantDoc.Content[0])
+	if err != nil {
+		return "", false, err
+	}
+	return merged, merged != existing, nil
+}
+
+// mergeJSONNode merges want into the value at path in content, descending
+// into objects both have, and setting the values that are not equivalent.
+func mergeJSONNode(content string, path []editPathSegment, want *yaml.Node) (string, error) {
+	jp := &jsonParser{s: content}
+	value, err := jp.parse()
+	if err != nil {
+		return "", err
+	}
+	for _, seg := range path {
+		i, err := value.child(seg)
+		if err != nil {
+			return "", err
+		}
+		if i < 0 {
+			value = nil
+			break
+		}
+		value = value.items[i]
+	}
+
+	if want.Kind == yaml.MappingNode && value != nil && value.kind == '{' {
+		for i := 0; i < len(want.Content); i += 2 {
+			key := editPathSegment{key: want.Content[i].Value}
+			content, err = mergeJSONNode(content, append(path[:len(path):len(path)], key), want.Content[i+1])
+			if err != nil {
+				return "", err
+			}
+		}
+		return content, nil
+	}
+	text, err := jsonText(want, "", detectIndent(content, "  "))
+	if err != nil {
+		return "", err
+	}
+	if value != nil && equivalentJSON(content[value.start:value.end], text) {
+		return content, nil
+	}
+	if len(path) == 0 {
+		return text + "\n", nil
+	}
+	edit := &FileEdit{op: SetEditOperation, json: true, path: path, value: want}
+	return edit.applyJSON(content)
+}
+
+// equivalentJSON reports whether the JSON values a and b are equal, comparing
+// numbers by their text.
+func equivalentJSON(a, b string) bool {
+	var values [2]any
+	for i, text := range []string{a, b} {
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+		if err := decoder.Decode(&values[i]); err != nil {
+			return false
+		}
+	}
+	return reflect.DeepEqual(values[0], values[1])
+}
+
+// mergeYAML merges the mapping want into the mapping existing, keeping the
+// comments and order of existing.
+func mergeYAML(existing, want string) (string, bool, error) {
+	var existingDoc, wantDoc yaml.Node
+	if err := yaml.Unmarshal([]byte(existing), &existingDoc); err != nil {
+		return "", false, err
+	}
+	if err := yaml.Unmarshal([]byte(want), &wantDoc); err != nil {
+		return "", false, err
+	}
+	if len(existingDoc.Content) == 0 {
+		return want, strings.TrimSpace(existing) != strings.TrimSpace(want), nil
+	}
+	if len(wantDoc.Content) == 0 {
+		return existing, false, nil
+	}
+	var before any
+	if err := existingDoc.Decode(&before); err != nil {
+		return "", false, err
+	}
+	mergeYAMLNodes(existingDoc.Content[0], wantDoc.Content[0])
+	var after any
+	if err := existingDoc.Decode(&after); err != nil {
+		return "", false, err
+	}
+	if reflect.DeepEqual(before, after) {
+		return existing, false, nil
+	}
+	b := &bytes.Buffer{}
+	encoder := yaml.NewEncoder(b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&existingDoc); err != nil {
+		return "", false, err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", false, err
+	}
+	return b.String(), true, nil
+}
+
+// mergeYAMLNodes merges want into existing in place.
+func mergeYAMLNodes(existing, want *yaml.Node) {
+	if existing.Kind != yaml.MappingNode || want.Kind != yaml.MappingNode {
+		// keep the comments of the value being replaced
+		head, line, foot := existing.HeadComment, existing.LineComment, existing.FootComment
+		*existing = *want
+		existing.HeadComment, existing.LineComment, existing.FootComment = head, line, foot
+		return
+	}
+	for i := 0; i+1 < len(want.Content); i += 2 {
+		key, value := want.Content[i], want.Content[i+1]
+		found := false
+		for j := 0; j+1 < len(existing.Content); j += 2 {
+			if existing.Content[j].Value == key.Value {
+				mergeYAMLNodes(existing.Content[j+1], value)
+				found = true
+				break
+			}
+		}
+		if !found {
+			existing.Content = append(existing.Content, key, value)
+		}
+	}
+}
+
+// mergeLines appends the lines of want that existing lacks.
+func mergeLines(existing, want string) (string, bool, error) {
+	have := map[string]bool{}
+	lines, _ := splitLines(existing)
+	for _, line := range lines {
+		have[line] = true
+	}
+	wantLines, _ := splitLines(want)
+	missing := []string{}
+	for _, line := range wantLines {
+		if !have[line] {
+			missing = append(missing, line)
+			have[line] = true
+		}
+	}
+	if len(missing) == 0 {
+		return existing, false, nil
+	}
+	return joinLines(append(lines, missing...), false), true, nil
+}
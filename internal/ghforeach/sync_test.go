@@ -0,0 +1,118 @@
+/*
+ Copyright (c) 2024 Evan Czyzycki
+
+ This program is free software: you can redistribute it and/or modify
+ it under the terms of the GNU General Public License as published by
+ the Free Software Foundation, either version 3 of the License, or
+ (at your option) any later version.
+
+ This program is distributed in the hope that it will be useful,
+ but WITHOUT ANY WARRANTY; without even the implied warranty of
+ MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+ GNU General Public License for more details.
+
+ You should have received a copy of the GNU General Public License
+ along with this program. If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package ghforeach
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestReadSyncManifest(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "LICENSE"), []byte("MIT\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, manifest, err string
+	}{
+		{"valid", "files:\n  - dest: ./LICENSE\n    source: LICENSE\n  - dest: .editorconfig\n    content: root = true\n    mode: create-only\n", ""},
+		{"unknown field", "files:\n  - dest: LICENSE\n    src: LICENSE\n", "field src not found"},
+		{"no files", "files: []\n", "lists no files"},
+		{"source and content", "files:\n  - dest: LICENSE\n    source: LICENSE\n    content: MIT\n", "either a source or content"},
+		{"missing source", "files:\n  - dest: LICENSE\n    source: COPYING\n", "no such file"},
+		{"escaping", "files:\n  - dest: ../LICENSE\n    content: MIT\n", "invalid destination"},
+		{"git", "files:\n  - dest: .git/config\n    content: x\n", "invalid destination"},
+		{"mode", "files:\n  - dest: LICENSE\n    content: MIT\n    mode: replace\n", "invalid mode"},
+		{"duplicate", "files:\n  - dest: LICENSE\n    content: MIT\n  - dest: ./LICENSE\n    content: MIT\n", "more than once"},
+		{"template", "files:\n  - dest: LICENSE\n    content: '{{ .Name'\n    template: true\n", "unclosed action"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := path.Join(dir, "manifest.yml")
+			if err := os.WriteFile(p, []byte(test.manifest), 0600); err != nil {
+				t.Fatal(err)
+			}
+			manifest, err := ReadSyncManifest(p)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if file := manifest.files[0]; file.Dest != "LICENSE" || file.content != "MIT\n" || file.Mode != OverwriteSyncMode {
+					t.Errorf("unexpected file %+v", file)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestMergeSyncFile(t *testing.T) {
+	tests := []struct {
+		dest, existing, want string
+		expected             string
+		changed              bool
+	}{
+		{"a.json", `{"b": 1, "a": {"x": 1}}`, `{"a": {"y": 2}}`, `{"b": 1, "a": {"x": 1, "y": 2}}`, true},
+		{"a.json", "{\n  \"z\": 1.50,\n  \"url\": \"a?b=<c>&d\",\n  \"a\": {\n    \"y\": 1\n  }\n}\n", `{"a": {"x": 2, "y": 1}, "z": 1.50}`, "{\n  \"z\": 1.50,\n  \"url\": \"a?b=<c>&d\",\n  \"a\": {\n    \"y\": 1,\n    \"x\": 2\n  }\n}\n", true},
+		{"a.json", `{"a": 1, "b": [1]}`, `{"b": [1, 2]}`, `{"a": 1, "b": [1, 2]}`, true},
+		{"a.json", `{"a": 1}`, `[1]`, "[\n  1\n]\n", true},
+		{"a.json", "{\"a\":{\"x\":1}}", `{"a": {"x": 1}}`, "{\"a\":{\"x\":1}}", false},
+		{"a.yml", "# settings\nb: 1 # one\na:\n  x: 1\n", "a:\n  y: 2\nb: 1\n", "# settings\nb: 1 # one\na:\n  x: 1\n  y: 2\n", true},
+		{"a.yaml", "a:\n  x: 1 # keep\n", "a:\n  x: 2\n", "a:\n  x: 2 # keep\n", true},
+		{"a.yml", "a: {x: 1}\n", "a:\n  x: 1\n", "a: {x: 1}\n", false},
+		{"CODEOWNERS", "* @a\ndocs/ @b", "* @a\n/.github/ @c\n", "* @a\ndocs/ @b\n/.github/ @c\n", true},
+		{".gitignore", "tmp/\n", "tmp/\n", "tmp/\n", false},
+	}
+	for _, test := range tests {
+		got, changed, err := mergeSyncFile(test.dest, test.existing, test.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.expected || changed != test.changed {
+			t.Errorf("merging %q into %s %q: expected %q (%v), got %q (%v)", test.want, test.dest, test.existing, test.expected, test.changed, got, changed)
+		}
+	}
+}
+
+func TestCleanRepoPath(t *testing.T) {
+	tests := []struct {
+		p, clean string
+		ok       bool
+	}{
+		{"a/b.txt", "a/b.txt", true},
+		{"./a//b/../c", "a/c", true},
+		{".github/workflows/ci.yml", ".github/workflows/ci.yml", true},
+		{"", "", false},
+		{".", "", false},
+		{"..", "", false},
+		{"a/../../b", "", false},
+		{"/etc/passwd", "", false},
+		{".git/config", "", false},
+		{".git", "", false},
+	}
+	for _, test := range tests {
+		if clean, ok := cleanRepoPath(test.p); clean != test.clean || ok != test.ok {
+			t.Errorf("%q: expected %q (%t), got %q (%t)", test.p, test.clean, test.ok, clean, ok)
+		}
+	}
+}